@@ -3,31 +3,96 @@ package amf
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 )
 
 const (
-	AMF0_MARKER_NUMBER       = 0X00
-	AMF0_MARKER_BOOL         = 0X01
-	AMF0_MARKER_STRING       = 0X02
-	AMF0_MARKER_OBJECT       = 0X03
-	AMF0_MARKER_NULL         = 0X05
-	AMF0_MARKER_ECMA_ARRAY   = 0X08
-	AMF0_MARKER_OBJECT_END   = 0X09
-	AMF0_MARKER_STRICT_ARRAY = 0X0a
-	AMF0_MARKER_DATE         = 0X0b
-	AMF0_MARKER_LONG_STRING  = 0X0c
-	AMF0_MARKER_XML          = 0X0f
-	AMF0_MARKER_TYPED_OBJECT = 0X10
-	AMF0_MARKER_AMF3         = 0X11
+	AMF0_MARKER_NUMBER       = 0x00
+	AMF0_MARKER_BOOL         = 0x01
+	AMF0_MARKER_STRING       = 0x02
+	AMF0_MARKER_OBJECT       = 0x03
+	AMF0_MARKER_MOVIECLIP    = 0x04 // reserved, not supported
+	AMF0_MARKER_NULL         = 0x05
+	AMF0_MARKER_UNDEFINED    = 0x06
+	AMF0_MARKER_REFERENCE    = 0x07
+	AMF0_MARKER_ECMA_ARRAY   = 0x08
+	AMF0_MARKER_OBJECT_END   = 0x09
+	AMF0_MARKER_STRICT_ARRAY = 0x0a
+	AMF0_MARKER_DATE         = 0x0b
+	AMF0_MARKER_LONG_STRING  = 0x0c
+	AMF0_MARKER_UNSUPPORTED  = 0x0d
+	AMF0_MARKER_RECORDSET    = 0x0e // reserved, not supported
+	AMF0_MARKER_XML          = 0x0f
+	AMF0_MARKER_TYPED_OBJECT = 0x10
+	AMF0_MARKER_AMF3         = 0x11
 )
 
+// objects and arrays nested deeper are rejected
+const AMF_MAX_DEPTH = 64
+
+// Decoded values are represented with the following go types:
+//
+//	number                float64
+//	boolean               bool
+//	string, long string   string
+//	object                Object
+//	null                  nil
+//	undefined             Undefined
+//	ecma array            EcmaArray
+//	strict array          []interface{}
+//	date                  time.Time
+//	xml document          XMLDocument
+//	typed object          TypedObject
+//	unsupported           Unsupported
+//
+// A reference decodes to the value it refers to, a value switched to AMF3
+// decodes as described in amf3.go.
+
+// anonymous object
+type Object map[string]interface{}
+
+// associative array, encoded with a count hint
+type EcmaArray map[string]interface{}
+
+type TypedObject struct {
+	ClassName string
+	Object    Object
+}
+
+type XMLDocument string
+
+type Undefined struct{}
+
+type Unsupported struct{}
+
+var (
+	ErrShortBuffer = errors.New("amf: short buffer")
+	ErrTooDeep     = errors.New("amf: values nested too deep")
+)
+
+func errMarker(marker byte, expect string) error {
+	return fmt.Errorf("amf: unexpected marker 0x%02x, expect %s", marker, expect)
+}
+
 func EncodeByte(buf *bytes.Buffer, b byte) {
 	binary.Write(buf, binary.LittleEndian, b)
 }
 
 func EncodeString(buf *bytes.Buffer, s string) {
-	EncodeByte(buf, byte(AMF0_MARKER_STRING))
-	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	if len(s) > math.MaxUint16 {
+		EncodeByte(buf, byte(AMF0_MARKER_LONG_STRING))
+		binary.Write(buf, binary.BigEndian, uint32(len(s)))
+	} else {
+		EncodeByte(buf, byte(AMF0_MARKER_STRING))
+		binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	}
 	binary.Write(buf, binary.LittleEndian, []byte(s))
 }
 
@@ -36,42 +101,554 @@ func EncodeNumber(buf *bytes.Buffer, f float64) {
 	binary.Write(buf, binary.BigEndian, f)
 }
 
-func DecodeBytes(buf *bytes.Buffer, n int) (bool, []byte) {
-	return true, buf.Next(n)
+func EncodeBool(buf *bytes.Buffer, b bool) {
+	EncodeByte(buf, byte(AMF0_MARKER_BOOL))
+	if b {
+		EncodeByte(buf, 1)
+	} else {
+		EncodeByte(buf, 0)
+	}
+}
+
+func EncodeNull(buf *bytes.Buffer) {
+	EncodeByte(buf, byte(AMF0_MARKER_NULL))
+}
+
+// the key of an object property, not preceded by a marker
+func EncodeObjectKey(buf *bytes.Buffer, key string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(key)))
+	binary.Write(buf, binary.LittleEndian, []byte(key))
+}
+
+// empty key followed by the object end marker
+func EncodeObjectEnd(buf *bytes.Buffer) {
+	EncodeObjectKey(buf, "")
+	EncodeByte(buf, byte(AMF0_MARKER_OBJECT_END))
+}
+
+// properties are written in key order so the output is stable
+func encodeProperties(buf *bytes.Buffer, m map[string]interface{}) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		EncodeObjectKey(buf, k)
+		if err := Encode(buf, m[k]); err != nil {
+			return err
+		}
+	}
+
+	EncodeObjectEnd(buf)
+	return nil
+}
+
+// Encode writes v as an AMF0 value. Besides the types listed above, any
+// numeric kind is a number, a map with string keys is an object, a slice or
+// an array is a strict array and a struct is an object of its exported
+// fields, named by the `amf` tag if any. Nil pointers are null.
+func Encode(buf *bytes.Buffer, v interface{}) error {
+	switch vv := v.(type) {
+	case nil:
+		EncodeNull(buf)
+		return nil
+	case Undefined:
+		EncodeByte(buf, byte(AMF0_MARKER_UNDEFINED))
+		return nil
+	case Unsupported:
+		EncodeByte(buf, byte(AMF0_MARKER_UNSUPPORTED))
+		return nil
+	case float64:
+		EncodeNumber(buf, vv)
+		return nil
+	case bool:
+		EncodeBool(buf, vv)
+		return nil
+	case string:
+		EncodeString(buf, vv)
+		return nil
+	case XMLDocument:
+		EncodeByte(buf, byte(AMF0_MARKER_XML))
+		binary.Write(buf, binary.BigEndian, uint32(len(vv)))
+		buf.WriteString(string(vv))
+		return nil
+	case time.Time:
+		EncodeByte(buf, byte(AMF0_MARKER_DATE))
+		binary.Write(buf, binary.BigEndian, float64(vv.UnixNano()/int64(time.Millisecond)))
+		// time zone, should be 0
+		binary.Write(buf, binary.BigEndian, int16(0))
+		return nil
+	case Object:
+		EncodeByte(buf, byte(AMF0_MARKER_OBJECT))
+		return encodeProperties(buf, vv)
+	case EcmaArray:
+		EncodeByte(buf, byte(AMF0_MARKER_ECMA_ARRAY))
+		binary.Write(buf, binary.BigEndian, uint32(len(vv)))
+		return encodeProperties(buf, vv)
+	case TypedObject:
+		EncodeByte(buf, byte(AMF0_MARKER_TYPED_OBJECT))
+		EncodeObjectKey(buf, vv.ClassName)
+		return encodeProperties(buf, vv.Object)
+	case []interface{}:
+		EncodeByte(buf, byte(AMF0_MARKER_STRICT_ARRAY))
+		binary.Write(buf, binary.BigEndian, uint32(len(vv)))
+		for _, e := range vv {
+			if err := Encode(buf, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	g, err := toGeneric(reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	return Encode(buf, g)
+}
+
+// toGeneric converts go values of other types to the value model
+func toGeneric(rv reflect.Value) (interface{}, error) {
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return rv.Elem().Interface(), nil
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil, nil
+		}
+		arr := make([]interface{}, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			arr[i] = rv.Index(i).Interface()
+		}
+		return arr, nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("amf: unsupported map key type %s", rv.Type().Key())
+		}
+		if rv.IsNil() {
+			return nil, nil
+		}
+		obj := Object{}
+		iter := rv.MapRange()
+		for iter.Next() {
+			obj[iter.Key().String()] = iter.Value().Interface()
+		}
+		return obj, nil
+	case reflect.Struct:
+		obj := Object{}
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			f := rt.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+
+			name := f.Name
+			omitempty := false
+			if tag, ok := f.Tag.Lookup("amf"); ok {
+				opts := strings.Split(tag, ",")
+				if opts[0] == "-" {
+					continue
+				}
+				if opts[0] != "" {
+					name = opts[0]
+				}
+				for _, o := range opts[1:] {
+					omitempty = omitempty || o == "omitempty"
+				}
+			}
+
+			if omitempty && rv.Field(i).IsZero() {
+				continue
+			}
+			obj[name] = rv.Field(i).Interface()
+		}
+		return obj, nil
+	}
+
+	return nil, fmt.Errorf("amf: unsupported type %s", rv.Type())
+}
+
+// Decoder reads successive AMF0 values sharing one reference table
+type Decoder struct {
+	buf   *bytes.Buffer
+	refs  []interface{}
+	amf3  *Decoder3 // context of the values switched to AMF3
+	depth int
+}
+
+func NewDecoder(buf *bytes.Buffer) *Decoder {
+	return &Decoder{buf: buf}
+}
+
+func (d *Decoder) next(n int) ([]byte, error) {
+	if d.buf.Len() < n {
+		return nil, ErrShortBuffer
+	}
+	return d.buf.Next(n), nil
+}
+
+func (d *Decoder) readU16() (uint16, error) {
+	b, err := d.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func (d *Decoder) readU32() (uint32, error) {
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (d *Decoder) readNumber() (float64, error) {
+	b, err := d.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+}
+
+func (d *Decoder) readUTF8(n int) (string, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readProperties reads key/value pairs up to the object end marker
+func (d *Decoder) readProperties(m map[string]interface{}) error {
+	for {
+		klen, err := d.readU16()
+		if err != nil {
+			return err
+		}
+
+		key, err := d.readUTF8(int(klen))
+		if err != nil {
+			return err
+		}
+
+		if d.buf.Len() > 0 && d.buf.Bytes()[0] == AMF0_MARKER_OBJECT_END {
+			if klen != 0 {
+				return fmt.Errorf("amf: object end after key %q", key)
+			}
+			d.buf.Next(1)
+			return nil
+		}
+
+		v, err := d.Decode()
+		if err != nil {
+			return err
+		}
+		m[key] = v
+	}
 }
 
-func DecodeString(buf *bytes.Buffer) (bool, string) {
-	// skip marker
-	buf.Next(1)
-	var strlen uint16 = binary.BigEndian.Uint16(buf.Next(2))
-	str := buf.Next(int(strlen))
+// Decode reads one value of any AMF0 type
+func (d *Decoder) Decode() (interface{}, error) {
+	if d.depth >= AMF_MAX_DEPTH {
+		return nil, ErrTooDeep
+	}
+	d.depth++
+	defer func() { d.depth-- }()
 
-	return true, string(str)
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	marker := b[0]
+
+	switch marker {
+	case AMF0_MARKER_NUMBER:
+		return d.readNumber()
+	case AMF0_MARKER_BOOL:
+		b, err := d.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case AMF0_MARKER_STRING:
+		n, err := d.readU16()
+		if err != nil {
+			return nil, err
+		}
+		return d.readUTF8(int(n))
+	case AMF0_MARKER_LONG_STRING:
+		n, err := d.readU32()
+		if err != nil {
+			return nil, err
+		}
+		return d.readUTF8(int(n))
+	case AMF0_MARKER_XML:
+		n, err := d.readU32()
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.readUTF8(int(n))
+		return XMLDocument(s), err
+	case AMF0_MARKER_NULL:
+		return nil, nil
+	case AMF0_MARKER_UNDEFINED:
+		return Undefined{}, nil
+	case AMF0_MARKER_UNSUPPORTED:
+		return Unsupported{}, nil
+	case AMF0_MARKER_DATE:
+		ms, err := d.readNumber()
+		if err != nil {
+			return nil, err
+		}
+		// time zone, ignored
+		if _, err := d.readU16(); err != nil {
+			return nil, err
+		}
+		return time.Unix(0, int64(ms)*int64(time.Millisecond)), nil
+	case AMF0_MARKER_OBJECT:
+		obj := Object{}
+		d.refs = append(d.refs, obj)
+		return obj, d.readProperties(obj)
+	case AMF0_MARKER_ECMA_ARRAY:
+		// the count is only a hint, the array ends like an object
+		if _, err := d.readU32(); err != nil {
+			return nil, err
+		}
+		arr := EcmaArray{}
+		d.refs = append(d.refs, arr)
+		return arr, d.readProperties(arr)
+	case AMF0_MARKER_TYPED_OBJECT:
+		n, err := d.readU16()
+		if err != nil {
+			return nil, err
+		}
+		name, err := d.readUTF8(int(n))
+		if err != nil {
+			return nil, err
+		}
+		to := TypedObject{ClassName: name, Object: Object{}}
+		d.refs = append(d.refs, to)
+		return to, d.readProperties(to.Object)
+	case AMF0_MARKER_STRICT_ARRAY:
+		n, err := d.readU32()
+		if err != nil {
+			return nil, err
+		}
+		if int(n) > d.buf.Len() {
+			return nil, ErrShortBuffer
+		}
+		arr := make([]interface{}, n)
+		idx := len(d.refs)
+		d.refs = append(d.refs, arr)
+		for i := range arr {
+			if arr[i], err = d.Decode(); err != nil {
+				return nil, err
+			}
+		}
+		d.refs[idx] = arr
+		return arr, nil
+	case AMF0_MARKER_AMF3:
+		if d.amf3 == nil {
+			d.amf3 = NewDecoder3(d.buf)
+		}
+		// the nesting goes on in AMF3
+		d.amf3.depth = d.depth - 1
+		return d.amf3.Decode()
+	case AMF0_MARKER_REFERENCE:
+		idx, err := d.readU16()
+		if err != nil {
+			return nil, err
+		}
+		if int(idx) >= len(d.refs) {
+			return nil, fmt.Errorf("amf: reference %d out of range", idx)
+		}
+		return d.refs[idx], nil
+	}
+
+	return nil, fmt.Errorf("amf: unsupported marker 0x%02x", marker)
 }
 
-func DecodeObjectKey(buf *bytes.Buffer) (bool, string) {
-	// skip marker
-	var strlen uint16 = binary.BigEndian.Uint16(buf.Next(2))
+// Decode reads one value with its own reference table
+func Decode(buf *bytes.Buffer) (interface{}, error) {
+	return NewDecoder(buf).Decode()
+}
+
+func DecodeBytes(buf *bytes.Buffer, n int) ([]byte, error) {
+	if buf.Len() < n {
+		return nil, ErrShortBuffer
+	}
+	return buf.Next(n), nil
+}
+
+func peekMarker(buf *bytes.Buffer) (byte, error) {
+	if buf.Len() < 1 {
+		return 0, ErrShortBuffer
+	}
+	return buf.Bytes()[0], nil
+}
+
+func DecodeString(buf *bytes.Buffer) (string, error) {
+	marker, err := peekMarker(buf)
+	if err != nil {
+		return "", err
+	}
+	if marker != AMF0_MARKER_STRING && marker != AMF0_MARKER_LONG_STRING &&
+		marker != AMF0_MARKER_AMF3 {
+		return "", errMarker(marker, "string")
+	}
+
+	v, err := Decode(buf)
+	if err != nil {
+		return "", err
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("amf: %T is not a string", v)
+}
+
+// DecodeObjectKey reads the key of an object property, the empty key of
+// the object end is returned as io.EOF
+func DecodeObjectKey(buf *bytes.Buffer) (string, error) {
+	d := NewDecoder(buf)
+	strlen, err := d.readU16()
+	if err != nil {
+		return "", err
+	}
+
 	// the end of object
 	if strlen == 0 {
-		return false, ""
+		marker, err := d.next(1)
+		if err != nil {
+			return "", err
+		}
+		if marker[0] != AMF0_MARKER_OBJECT_END {
+			return "", errMarker(marker[0], "object end")
+		}
+		return "", io.EOF
 	}
-	str := buf.Next(int(strlen))
 
-	return true, string(str)
+	return d.readUTF8(int(strlen))
 }
 
-func DecodeNumber(buf *bytes.Buffer) (bool, float64) {
-	buf.Next(1)
-	var f float64 = 0
-	binary.Read(buf, binary.BigEndian, &f)
+func DecodeNumber(buf *bytes.Buffer) (float64, error) {
+	marker, err := peekMarker(buf)
+	if err != nil {
+		return 0, err
+	}
+	if marker != AMF0_MARKER_NUMBER && marker != AMF0_MARKER_AMF3 {
+		return 0, errMarker(marker, "number")
+	}
+
+	v, err := Decode(buf)
+	if err != nil {
+		return 0, err
+	}
+	switch vv := v.(type) {
+	case float64:
+		return vv, nil
+	case int32:
+		// AMF3 integer
+		return float64(vv), nil
+	}
+	return 0, fmt.Errorf("amf: %T is not a number", v)
+}
+
+func DecodeBool(buf *bytes.Buffer) (bool, error) {
+	marker, err := peekMarker(buf)
+	if err != nil {
+		return false, err
+	}
+	if marker != AMF0_MARKER_BOOL && marker != AMF0_MARKER_AMF3 {
+		return false, errMarker(marker, "bool")
+	}
+
+	v, err := Decode(buf)
+	if err != nil {
+		return false, err
+	}
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return false, fmt.Errorf("amf: %T is not a bool", v)
+}
+
+// DecodeNull consumes a null or undefined value, as found before the
+// arguments of most commands
+func DecodeNull(buf *bytes.Buffer) error {
+	marker, err := peekMarker(buf)
+	if err != nil {
+		return err
+	}
+	if marker != AMF0_MARKER_NULL && marker != AMF0_MARKER_UNDEFINED &&
+		marker != AMF0_MARKER_AMF3 {
+		return errMarker(marker, "null")
+	}
+
+	v, err := Decode(buf)
+	if err != nil {
+		return err
+	}
+	switch v.(type) {
+	case nil, Undefined:
+		return nil
+	}
+	return fmt.Errorf("amf: %T is not null", v)
+}
+
+// DecodeObject reads an object, an ecma array or a typed object as a map of
+// properties, null gives an empty one
+func DecodeObject(buf *bytes.Buffer) (Object, error) {
+	v, err := Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	switch vv := v.(type) {
+	case nil, Undefined:
+		return Object{}, nil
+	case Object:
+		return vv, nil
+	case EcmaArray:
+		return Object(vv), nil
+	case TypedObject:
+		return vv.Object, nil
+	}
+
+	return nil, fmt.Errorf("amf: %T is not an object", v)
+}
+
+// helpers to read typed properties out of a decoded object
+
+func (o Object) String(key string) string {
+	s, _ := o[key].(string)
+	return s
+}
 
-	return true, f
+func (o Object) Number(key string) float64 {
+	f, _ := o[key].(float64)
+	return f
 }
 
-func DecodeBool(buf *bytes.Buffer) (bool, bool) {
-	buf.Next(1)
-	var b bool = false
-	binary.Read(buf, binary.LittleEndian, &b)
-	return true, b
+func (o Object) Bool(key string) bool {
+	b, _ := o[key].(bool)
+	return b
 }
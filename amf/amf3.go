@@ -0,0 +1,678 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	AMF3_MARKER_UNDEFINED     = 0x00
+	AMF3_MARKER_NULL          = 0x01
+	AMF3_MARKER_FALSE         = 0x02
+	AMF3_MARKER_TRUE          = 0x03
+	AMF3_MARKER_INTEGER       = 0x04
+	AMF3_MARKER_DOUBLE        = 0x05
+	AMF3_MARKER_STRING        = 0x06
+	AMF3_MARKER_XML_DOC       = 0x07
+	AMF3_MARKER_DATE          = 0x08
+	AMF3_MARKER_ARRAY         = 0x09
+	AMF3_MARKER_OBJECT        = 0x0a
+	AMF3_MARKER_XML           = 0x0b
+	AMF3_MARKER_BYTE_ARRAY    = 0x0c
+	AMF3_MARKER_VECTOR_INT    = 0x0d
+	AMF3_MARKER_VECTOR_UINT   = 0x0e
+	AMF3_MARKER_VECTOR_DOUBLE = 0x0f
+	AMF3_MARKER_VECTOR_OBJECT = 0x10
+	AMF3_MARKER_DICTIONARY    = 0x11
+)
+
+// range of the 29 bits signed integers
+const (
+	AMF3_INTEGER_MAX = 1<<28 - 1
+	AMF3_INTEGER_MIN = -1 << 28
+)
+
+// AMF3 values decode to the AMF0 value model plus:
+//
+//	integer               int32
+//	xml                   XML
+//	array                 []interface{} if it only has a dense part,
+//	                      EcmaArray keyed by index and name otherwise
+//	byte array            []byte
+//	vector of int         []int32
+//	vector of uint        []uint32
+//	vector of double      []float64
+//	vector of object      []interface{}
+//	dictionary            Dictionary
+//
+// Externalizable objects can't be decoded without knowing their class.
+
+// E4X xml, the xml document is the legacy flash.xml.XMLDocument
+type XML string
+
+type DictionaryEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// keys of a dictionary may be any value, so it's kept as a list
+type Dictionary []DictionaryEntry
+
+type amf3Traits struct {
+	classname      string
+	externalizable bool
+	dynamic        bool
+	members        []string
+}
+
+// Decoder3 reads successive AMF3 values sharing the string, object and
+// traits reference tables
+type Decoder3 struct {
+	buf     *bytes.Buffer
+	strings []string
+	objects []interface{}
+	traits  []*amf3Traits
+	depth   int
+}
+
+func NewDecoder3(buf *bytes.Buffer) *Decoder3 {
+	return &Decoder3{buf: buf}
+}
+
+// Decode3 reads one AMF3 value with its own reference tables
+func Decode3(buf *bytes.Buffer) (interface{}, error) {
+	return NewDecoder3(buf).Decode()
+}
+
+func (d *Decoder3) next(n int) ([]byte, error) {
+	if n < 0 || d.buf.Len() < n {
+		return nil, ErrShortBuffer
+	}
+	return d.buf.Next(n), nil
+}
+
+// readU29 reads a variable length unsigned 29 bits integer
+func (d *Decoder3) readU29() (uint32, error) {
+	var v uint32 = 0
+	for i := 0; i < 4; i++ {
+		b, err := d.buf.ReadByte()
+		if err != nil {
+			return 0, ErrShortBuffer
+		}
+
+		if i == 3 {
+			return v<<8 | uint32(b), nil
+		}
+
+		v = v<<7 | uint32(b&0x7f)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return v, nil
+}
+
+func (d *Decoder3) readDouble() (float64, error) {
+	b, err := d.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+}
+
+// readRef reads the U29 header of a value which may be a reference,
+// returning the reference index or the inline value
+func (d *Decoder3) readRef() (bool, uint32, error) {
+	u, err := d.readU29()
+	if err != nil {
+		return false, 0, err
+	}
+	return u&1 == 0, u >> 1, nil
+}
+
+func (d *Decoder3) objectRef(idx uint32) (interface{}, error) {
+	if int(idx) >= len(d.objects) {
+		return nil, fmt.Errorf("amf3: object reference %d out of range", idx)
+	}
+	return d.objects[idx], nil
+}
+
+func (d *Decoder3) readString() (string, error) {
+	isref, v, err := d.readRef()
+	if err != nil {
+		return "", err
+	}
+
+	if isref {
+		if int(v) >= len(d.strings) {
+			return "", fmt.Errorf("amf3: string reference %d out of range", v)
+		}
+		return d.strings[v], nil
+	}
+
+	b, err := d.next(int(v))
+	if err != nil {
+		return "", err
+	}
+
+	// the empty string is never sent by reference
+	s := string(b)
+	if s != "" {
+		d.strings = append(d.strings, s)
+	}
+	return s, nil
+}
+
+func (d *Decoder3) readTraits(v uint32) (*amf3Traits, error) {
+	// v is the U29 header shifted by the object reference bit
+	if v&1 == 0 {
+		idx := v >> 1
+		if int(idx) >= len(d.traits) {
+			return nil, fmt.Errorf("amf3: traits reference %d out of range", idx)
+		}
+		return d.traits[idx], nil
+	}
+
+	t := new(amf3Traits)
+	t.externalizable = v&2 != 0
+	t.dynamic = v&4 != 0
+
+	var err error
+	if t.classname, err = d.readString(); err != nil {
+		return nil, err
+	}
+
+	for i := uint32(0); i < v>>3; i++ {
+		name, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		t.members = append(t.members, name)
+	}
+
+	d.traits = append(d.traits, t)
+	return t, nil
+}
+
+func (d *Decoder3) readObject() (interface{}, error) {
+	isref, v, err := d.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if isref {
+		return d.objectRef(v)
+	}
+
+	t, err := d.readTraits(v)
+	if err != nil {
+		return nil, err
+	}
+	if t.externalizable {
+		return nil, fmt.Errorf("amf3: externalizable class %q not supported", t.classname)
+	}
+
+	obj := Object{}
+	var ret interface{} = obj
+	if t.classname != "" {
+		ret = TypedObject{ClassName: t.classname, Object: obj}
+	}
+	d.objects = append(d.objects, ret)
+
+	for _, name := range t.members {
+		if obj[name], err = d.Decode(); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.dynamic {
+		for {
+			name, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			if name == "" {
+				break
+			}
+			if obj[name], err = d.Decode(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+func (d *Decoder3) readArray() (interface{}, error) {
+	isref, v, err := d.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if isref {
+		return d.objectRef(v)
+	}
+
+	idx := len(d.objects)
+	d.objects = append(d.objects, nil)
+
+	assoc := EcmaArray{}
+	for {
+		name, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			break
+		}
+		if assoc[name], err = d.Decode(); err != nil {
+			return nil, err
+		}
+	}
+
+	if int(v) > d.buf.Len() {
+		return nil, ErrShortBuffer
+	}
+	dense := make([]interface{}, v)
+	d.objects[idx] = dense
+	for i := range dense {
+		if dense[i], err = d.Decode(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(assoc) == 0 {
+		return dense, nil
+	}
+
+	for i, e := range dense {
+		assoc[strconv.Itoa(i)] = e
+	}
+	d.objects[idx] = assoc
+	return assoc, nil
+}
+
+func (d *Decoder3) readVector(marker byte) (interface{}, error) {
+	isref, n, err := d.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if isref {
+		return d.objectRef(n)
+	}
+
+	// fixed-length flag
+	if _, err := d.next(1); err != nil {
+		return nil, err
+	}
+
+	if int(n) > d.buf.Len() {
+		return nil, ErrShortBuffer
+	}
+
+	switch marker {
+	case AMF3_MARKER_VECTOR_INT, AMF3_MARKER_VECTOR_UINT:
+		b, err := d.next(int(n) * 4)
+		if err != nil {
+			return nil, err
+		}
+		var ret interface{}
+		if marker == AMF3_MARKER_VECTOR_INT {
+			vec := make([]int32, n)
+			for i := range vec {
+				vec[i] = int32(binary.BigEndian.Uint32(b[i*4:]))
+			}
+			ret = vec
+		} else {
+			vec := make([]uint32, n)
+			for i := range vec {
+				vec[i] = binary.BigEndian.Uint32(b[i*4:])
+			}
+			ret = vec
+		}
+		d.objects = append(d.objects, ret)
+		return ret, nil
+	case AMF3_MARKER_VECTOR_DOUBLE:
+		b, err := d.next(int(n) * 8)
+		if err != nil {
+			return nil, err
+		}
+		vec := make([]float64, n)
+		for i := range vec {
+			vec[i] = math.Float64frombits(binary.BigEndian.Uint64(b[i*8:]))
+		}
+		d.objects = append(d.objects, vec)
+		return vec, nil
+	}
+
+	// object type name, not kept
+	if _, err := d.readString(); err != nil {
+		return nil, err
+	}
+
+	vec := make([]interface{}, n)
+	d.objects = append(d.objects, vec)
+	for i := range vec {
+		if vec[i], err = d.Decode(); err != nil {
+			return nil, err
+		}
+	}
+	return vec, nil
+}
+
+func (d *Decoder3) readDictionary() (interface{}, error) {
+	isref, n, err := d.readRef()
+	if err != nil {
+		return nil, err
+	}
+	if isref {
+		return d.objectRef(n)
+	}
+
+	// weak keys flag
+	if _, err := d.next(1); err != nil {
+		return nil, err
+	}
+
+	if int(n) > d.buf.Len() {
+		return nil, ErrShortBuffer
+	}
+
+	dict := make(Dictionary, n)
+	idx := len(d.objects)
+	d.objects = append(d.objects, dict)
+	for i := range dict {
+		if dict[i].Key, err = d.Decode(); err != nil {
+			return nil, err
+		}
+		if dict[i].Value, err = d.Decode(); err != nil {
+			return nil, err
+		}
+	}
+	d.objects[idx] = dict
+	return dict, nil
+}
+
+// Decode reads one value of any AMF3 type
+func (d *Decoder3) Decode() (interface{}, error) {
+	if d.depth >= AMF_MAX_DEPTH {
+		return nil, ErrTooDeep
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+
+	marker, err := d.buf.ReadByte()
+	if err != nil {
+		return nil, ErrShortBuffer
+	}
+
+	switch marker {
+	case AMF3_MARKER_UNDEFINED:
+		return Undefined{}, nil
+	case AMF3_MARKER_NULL:
+		return nil, nil
+	case AMF3_MARKER_FALSE:
+		return false, nil
+	case AMF3_MARKER_TRUE:
+		return true, nil
+	case AMF3_MARKER_INTEGER:
+		u, err := d.readU29()
+		if err != nil {
+			return nil, err
+		}
+		// sign extend the 29 bits
+		return int32(u<<3) >> 3, nil
+	case AMF3_MARKER_DOUBLE:
+		return d.readDouble()
+	case AMF3_MARKER_STRING:
+		return d.readString()
+	case AMF3_MARKER_XML_DOC, AMF3_MARKER_XML, AMF3_MARKER_BYTE_ARRAY:
+		isref, v, err := d.readRef()
+		if err != nil {
+			return nil, err
+		}
+		if isref {
+			return d.objectRef(v)
+		}
+
+		b, err := d.next(int(v))
+		if err != nil {
+			return nil, err
+		}
+
+		var ret interface{}
+		if marker == AMF3_MARKER_XML_DOC {
+			ret = XMLDocument(b)
+		} else if marker == AMF3_MARKER_XML {
+			ret = XML(b)
+		} else {
+			ret = append([]byte(nil), b...)
+		}
+		d.objects = append(d.objects, ret)
+		return ret, nil
+	case AMF3_MARKER_DATE:
+		isref, v, err := d.readRef()
+		if err != nil {
+			return nil, err
+		}
+		if isref {
+			return d.objectRef(v)
+		}
+
+		ms, err := d.readDouble()
+		if err != nil {
+			return nil, err
+		}
+		ret := time.Unix(0, int64(ms)*int64(time.Millisecond))
+		d.objects = append(d.objects, ret)
+		return ret, nil
+	case AMF3_MARKER_ARRAY:
+		return d.readArray()
+	case AMF3_MARKER_OBJECT:
+		return d.readObject()
+	case AMF3_MARKER_VECTOR_INT, AMF3_MARKER_VECTOR_UINT,
+		AMF3_MARKER_VECTOR_DOUBLE, AMF3_MARKER_VECTOR_OBJECT:
+		return d.readVector(marker)
+	case AMF3_MARKER_DICTIONARY:
+		return d.readDictionary()
+	}
+
+	return nil, fmt.Errorf("amf3: unsupported marker 0x%02x", marker)
+}
+
+// Encoder3 writes successive AMF3 values, strings are sent by reference
+// once written
+type Encoder3 struct {
+	buf     *bytes.Buffer
+	strings map[string]int
+}
+
+func NewEncoder3(buf *bytes.Buffer) *Encoder3 {
+	return &Encoder3{buf: buf, strings: make(map[string]int)}
+}
+
+// Encode3 writes one AMF3 value with its own reference tables
+func Encode3(buf *bytes.Buffer, v interface{}) error {
+	return NewEncoder3(buf).Encode(v)
+}
+
+func (e *Encoder3) writeU29(v uint32) {
+	v &= 0x1fffffff
+	if v < 0x80 {
+		e.buf.WriteByte(byte(v))
+	} else if v < 0x4000 {
+		e.buf.WriteByte(byte(v>>7 | 0x80))
+		e.buf.WriteByte(byte(v & 0x7f))
+	} else if v < 0x200000 {
+		e.buf.WriteByte(byte(v>>14 | 0x80))
+		e.buf.WriteByte(byte(v>>7 | 0x80))
+		e.buf.WriteByte(byte(v & 0x7f))
+	} else {
+		e.buf.WriteByte(byte(v>>22 | 0x80))
+		e.buf.WriteByte(byte(v>>15 | 0x80))
+		e.buf.WriteByte(byte(v>>8 | 0x80))
+		e.buf.WriteByte(byte(v))
+	}
+}
+
+func (e *Encoder3) writeString(s string) {
+	if idx, ok := e.strings[s]; ok {
+		e.writeU29(uint32(idx) << 1)
+		return
+	}
+
+	if s != "" {
+		e.strings[s] = len(e.strings)
+	}
+	e.writeU29(uint32(len(s))<<1 | 1)
+	e.buf.WriteString(s)
+}
+
+func (e *Encoder3) writeNumber(f float64) {
+	if f == math.Trunc(f) && f >= AMF3_INTEGER_MIN && f <= AMF3_INTEGER_MAX {
+		e.buf.WriteByte(AMF3_MARKER_INTEGER)
+		e.writeU29(uint32(int32(f)))
+		return
+	}
+
+	e.buf.WriteByte(AMF3_MARKER_DOUBLE)
+	binary.Write(e.buf, binary.BigEndian, f)
+}
+
+// writeDynamic writes an object with no sealed members
+func (e *Encoder3) writeDynamic(classname string, m map[string]interface{}) error {
+	e.buf.WriteByte(AMF3_MARKER_OBJECT)
+	// inline object, inline traits, dynamic, no sealed member
+	e.writeU29(0x0b)
+	e.writeString(classname)
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if k == "" {
+			continue
+		}
+		e.writeString(k)
+		if err := e.Encode(m[k]); err != nil {
+			return err
+		}
+	}
+	e.writeString("")
+	return nil
+}
+
+// Encode writes v as an AMF3 value, other go types are converted as for
+// AMF0, integers in the 29 bits range are written as integers
+func (e *Encoder3) Encode(v interface{}) error {
+	switch vv := v.(type) {
+	case nil:
+		e.buf.WriteByte(AMF3_MARKER_NULL)
+	case Undefined:
+		e.buf.WriteByte(AMF3_MARKER_UNDEFINED)
+	case bool:
+		if vv {
+			e.buf.WriteByte(AMF3_MARKER_TRUE)
+		} else {
+			e.buf.WriteByte(AMF3_MARKER_FALSE)
+		}
+	case int32:
+		e.writeNumber(float64(vv))
+	case int:
+		e.writeNumber(float64(vv))
+	case float64:
+		e.writeNumber(vv)
+	case string:
+		e.buf.WriteByte(AMF3_MARKER_STRING)
+		e.writeString(vv)
+	case XMLDocument:
+		e.buf.WriteByte(AMF3_MARKER_XML_DOC)
+		e.writeU29(uint32(len(vv))<<1 | 1)
+		e.buf.WriteString(string(vv))
+	case XML:
+		e.buf.WriteByte(AMF3_MARKER_XML)
+		e.writeU29(uint32(len(vv))<<1 | 1)
+		e.buf.WriteString(string(vv))
+	case []byte:
+		e.buf.WriteByte(AMF3_MARKER_BYTE_ARRAY)
+		e.writeU29(uint32(len(vv))<<1 | 1)
+		e.buf.Write(vv)
+	case time.Time:
+		e.buf.WriteByte(AMF3_MARKER_DATE)
+		e.writeU29(1)
+		binary.Write(e.buf, binary.BigEndian, float64(vv.UnixNano()/int64(time.Millisecond)))
+	case []interface{}:
+		e.buf.WriteByte(AMF3_MARKER_ARRAY)
+		e.writeU29(uint32(len(vv))<<1 | 1)
+		e.writeString("")
+		for _, x := range vv {
+			if err := e.Encode(x); err != nil {
+				return err
+			}
+		}
+	case EcmaArray:
+		e.buf.WriteByte(AMF3_MARKER_ARRAY)
+		e.writeU29(1)
+		keys := make([]string, 0, len(vv))
+		for k := range vv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if k == "" {
+				continue
+			}
+			e.writeString(k)
+			if err := e.Encode(vv[k]); err != nil {
+				return err
+			}
+		}
+		e.writeString("")
+	case Object:
+		return e.writeDynamic("", vv)
+	case TypedObject:
+		return e.writeDynamic(vv.ClassName, vv.Object)
+	case []int32:
+		e.buf.WriteByte(AMF3_MARKER_VECTOR_INT)
+		e.writeU29(uint32(len(vv))<<1 | 1)
+		e.buf.WriteByte(0)
+		binary.Write(e.buf, binary.BigEndian, vv)
+	case []uint32:
+		e.buf.WriteByte(AMF3_MARKER_VECTOR_UINT)
+		e.writeU29(uint32(len(vv))<<1 | 1)
+		e.buf.WriteByte(0)
+		binary.Write(e.buf, binary.BigEndian, vv)
+	case []float64:
+		e.buf.WriteByte(AMF3_MARKER_VECTOR_DOUBLE)
+		e.writeU29(uint32(len(vv))<<1 | 1)
+		e.buf.WriteByte(0)
+		binary.Write(e.buf, binary.BigEndian, vv)
+	case Dictionary:
+		e.buf.WriteByte(AMF3_MARKER_DICTIONARY)
+		e.writeU29(uint32(len(vv))<<1 | 1)
+		e.buf.WriteByte(0)
+		for _, x := range vv {
+			if err := e.Encode(x.Key); err != nil {
+				return err
+			}
+			if err := e.Encode(x.Value); err != nil {
+				return err
+			}
+		}
+	default:
+		g, err := toGeneric(reflect.ValueOf(v))
+		if err != nil {
+			return err
+		}
+		return e.Encode(g)
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package amf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var amf3_values = []struct {
+	name string
+	v    interface{}
+}{
+	{"null", nil},
+	{"undefined", Undefined{}},
+	{"true", true},
+	{"false", false},
+	{"integer", int32(5)},
+	{"negative integer", int32(-1)},
+	{"largest integer", int32(AMF3_INTEGER_MAX)},
+	{"smallest integer", int32(AMF3_INTEGER_MIN)},
+	{"double", 1.5},
+	{"integer out of 29 bits", float64(1 << 30)},
+	{"string", "hello"},
+	{"empty string", ""},
+	{"xml document", XMLDocument("<a/>")},
+	{"xml", XML("<b/>")},
+	{"byte array", []byte{1, 2, 3}},
+	{"date", time.Unix(1600000000, 123000000)},
+	{"dense array", []interface{}{int32(1), "a", nil}},
+	{"associative array", EcmaArray{"a": int32(1), "b": "x"}},
+	{"object", Object{"a": "a", "b": Object{"a": 2.5}}},
+	{"typed object", TypedObject{ClassName: "Cls", Object: Object{"x": true}}},
+	{"vector of int", []int32{-1, 0, 1}},
+	{"vector of uint", []uint32{0, 1, 0xffffffff}},
+	{"vector of double", []float64{0.5, -2}},
+	{"dictionary", Dictionary{{Key: "k", Value: int32(1)}, {Key: int32(2), Value: "v"}}},
+}
+
+func TestRoundTrip3(t *testing.T) {
+	for _, tt := range amf3_values {
+		var buf bytes.Buffer
+		if err := Encode3(&buf, tt.v); err != nil {
+			t.Errorf("%s: encode: %v", tt.name, err)
+			continue
+		}
+
+		v, err := Decode3(&buf)
+		if err != nil {
+			t.Errorf("%s: decode: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, tt.v) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, v, tt.v)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: %d bytes left", tt.name, buf.Len())
+		}
+	}
+}
+
+func TestDecodeTruncated3(t *testing.T) {
+	for _, tt := range amf3_values {
+		var buf bytes.Buffer
+		Encode3(&buf, tt.v)
+		b := buf.Bytes()
+
+		for n := 0; n < len(b); n++ {
+			if _, err := Decode3(bytes.NewBuffer(b[:n])); err == nil {
+				t.Errorf("%s: no error with %d of %d bytes", tt.name, n, len(b))
+				break
+			}
+		}
+	}
+}
+
+func TestDecodeMalformed3(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"unknown marker", []byte{0x12}},
+		{"object reference out of range", []byte{AMF3_MARKER_OBJECT, 0x02}},
+		{"string reference out of range", []byte{AMF3_MARKER_STRING, 0x02}},
+		{"traits reference out of range", []byte{AMF3_MARKER_OBJECT, 0x01}},
+		{"externalizable object", []byte{AMF3_MARKER_OBJECT, 0x07, 0x01}},
+		{"dense array longer than the buffer", []byte{AMF3_MARKER_ARRAY, 0x7f, 0x01}},
+		{"vector longer than the buffer", []byte{AMF3_MARKER_VECTOR_INT, 0x7f, 0x00, 0, 0, 0, 0}},
+		{"dictionary longer than the buffer", []byte{AMF3_MARKER_DICTIONARY, 0x7f, 0x00}},
+		{"string longer than the buffer", []byte{AMF3_MARKER_STRING, 0x21, 'a'}},
+	}
+
+	for _, tt := range tests {
+		if v, err := Decode3(bytes.NewBuffer(tt.b)); err == nil {
+			t.Errorf("%s: decoded %#v", tt.name, v)
+		}
+	}
+}
+
+// nested3 gives n values of one element each around null, made of the
+// header of a container and what follows its element
+func nested3(n int, header []byte, trailer []byte) []byte {
+	var b []byte
+	for i := 0; i < n; i++ {
+		b = append(b, header...)
+	}
+	b = append(b, AMF3_MARKER_NULL)
+	for i := 0; i < n; i++ {
+		b = append(b, trailer...)
+	}
+	return b
+}
+
+func TestDecodeDepth3(t *testing.T) {
+	// dense array of one element, no associative part
+	array := []byte{AMF3_MARKER_ARRAY, 0x03, 0x01}
+	// dynamic anonymous object with a member a, then the empty name
+	object := []byte{AMF3_MARKER_OBJECT, 0x0b, 0x01, 0x03, 'a'}
+	// vector of one object of no type name
+	vector := []byte{AMF3_MARKER_VECTOR_OBJECT, 0x03, 0x00, 0x01}
+	// dictionary of one entry keyed by null
+	dict := []byte{AMF3_MARKER_DICTIONARY, 0x03, 0x00, AMF3_MARKER_NULL}
+
+	tests := []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{"arrays at the limit", nested3(AMF_MAX_DEPTH-1, array, nil), nil},
+		{"arrays too deep", nested3(AMF_MAX_DEPTH, array, nil), ErrTooDeep},
+		{"objects at the limit", nested3(AMF_MAX_DEPTH-1, object, []byte{0x01}), nil},
+		{"objects too deep", nested3(AMF_MAX_DEPTH, object, []byte{0x01}), ErrTooDeep},
+		{"vectors too deep", nested3(AMF_MAX_DEPTH, vector, nil), ErrTooDeep},
+		{"dictionaries too deep", nested3(AMF_MAX_DEPTH, dict, nil), ErrTooDeep},
+		{"far too deep", nested3(1000000, array, nil), ErrTooDeep},
+	}
+
+	for _, tt := range tests {
+		buf := bytes.NewBuffer(tt.b)
+		_, err := Decode3(buf)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+		if err == nil && buf.Len() != 0 {
+			t.Errorf("%s: %d bytes left", tt.name, buf.Len())
+		}
+	}
+}
+
+func TestDecoder3References(t *testing.T) {
+	// the second object refers to the traits and to the strings of the
+	// first one
+	obj := TypedObject{ClassName: "Cls", Object: Object{"name": "name"}}
+	b := []byte{
+		AMF3_MARKER_OBJECT, 0x13, 0x07, 'C', 'l', 's', 0x09, 'n', 'a', 'm', 'e',
+		AMF3_MARKER_STRING, 0x02,
+		AMF3_MARKER_OBJECT, 0x01, AMF3_MARKER_STRING, 0x02,
+		// the first object itself
+		AMF3_MARKER_OBJECT, 0x00,
+	}
+
+	d := NewDecoder3(bytes.NewBuffer(b))
+	for i := 0; i < 3; i++ {
+		v, err := d.Decode()
+		if err != nil {
+			t.Fatalf("value %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(v, obj) {
+			t.Errorf("value %d: got %#v, want %#v", i, v, obj)
+		}
+	}
+}
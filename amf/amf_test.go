@@ -0,0 +1,214 @@
+package amf
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var amf0_values = []struct {
+	name string
+	v    interface{}
+}{
+	{"number", 3.5},
+	{"true", true},
+	{"false", false},
+	{"string", "hello"},
+	{"empty string", ""},
+	{"long string", strings.Repeat("a", 70000)},
+	{"null", nil},
+	{"undefined", Undefined{}},
+	{"unsupported", Unsupported{}},
+	{"xml", XMLDocument("<a/>")},
+	{"date", time.Unix(1600000000, 123000000)},
+	{"empty object", Object{}},
+	{"object", Object{"a": 1.0, "b": "x", "c": Object{"d": nil}}},
+	{"ecma array", EcmaArray{"duration": 10.0, "width": 1280.0}},
+	{"typed object", TypedObject{ClassName: "Cls", Object: Object{"x": true}}},
+	{"strict array", []interface{}{1.0, "a", nil, Object{"b": false}}},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tt := range amf0_values {
+		var buf bytes.Buffer
+		if err := Encode(&buf, tt.v); err != nil {
+			t.Errorf("%s: encode: %v", tt.name, err)
+			continue
+		}
+
+		v, err := Decode(&buf)
+		if err != nil {
+			t.Errorf("%s: decode: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, tt.v) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, v, tt.v)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: %d bytes left", tt.name, buf.Len())
+		}
+	}
+}
+
+func TestEncodeGoTypes(t *testing.T) {
+	type info struct {
+		Code    string `amf:"code"`
+		Level   string `amf:"level,omitempty"`
+		Skipped int    `amf:"-"`
+		Count   int
+		private int
+	}
+
+	tests := []struct {
+		name string
+		v    interface{}
+		want interface{}
+	}{
+		{"int", 42, 42.0},
+		{"uint8", uint8(7), 7.0},
+		{"float32", float32(0.5), 0.5},
+		{"map", map[string]int{"a": 1}, Object{"a": 1.0}},
+		{"slice", []string{"a", "b"}, []interface{}{"a", "b"}},
+		{"nil slice", []int(nil), nil},
+		{"nil pointer", (*info)(nil), nil},
+		{"struct", info{Code: "ok", Skipped: 1, Count: 2}, Object{"code": "ok", "Count": 2.0}},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := Encode(&buf, tt.v); err != nil {
+			t.Errorf("%s: encode: %v", tt.name, err)
+			continue
+		}
+
+		v, err := Decode(&buf)
+		if err != nil {
+			t.Errorf("%s: decode: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, v, tt.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, map[int]string{1: "a"}); err == nil {
+		t.Error("map with int keys: no error")
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for _, tt := range amf0_values {
+		var buf bytes.Buffer
+		Encode(&buf, tt.v)
+		b := buf.Bytes()
+
+		for n := 0; n < len(b); n++ {
+			if _, err := Decode(bytes.NewBuffer(b[:n])); err == nil {
+				t.Errorf("%s: no error with %d of %d bytes", tt.name, n, len(b))
+				break
+			}
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"reserved marker", []byte{AMF0_MARKER_RECORDSET}},
+		{"unknown marker", []byte{0x20}},
+		{"reference out of range", []byte{AMF0_MARKER_REFERENCE, 0x00, 0x05}},
+		{"object end after a key", []byte{AMF0_MARKER_OBJECT, 0x00, 0x01, 'a', AMF0_MARKER_OBJECT_END}},
+		{"strict array longer than the buffer", []byte{AMF0_MARKER_STRICT_ARRAY, 0xff, 0xff, 0xff, 0xff}},
+		{"string longer than the buffer", []byte{AMF0_MARKER_STRING, 0x00, 0x10, 'a'}},
+		{"long string longer than the buffer", []byte{AMF0_MARKER_LONG_STRING, 0xff, 0xff, 0xff, 0xff}},
+	}
+
+	for _, tt := range tests {
+		if v, err := Decode(bytes.NewBuffer(tt.b)); err == nil {
+			t.Errorf("%s: decoded %#v", tt.name, v)
+		}
+	}
+}
+
+var amf0_number = []byte{AMF0_MARKER_NUMBER, 0, 0, 0, 0, 0, 0, 0, 0}
+
+// nestedArrays gives n strict arrays of one element each around leaf
+func nestedArrays(n int, leaf []byte) []byte {
+	var b []byte
+	for i := 0; i < n; i++ {
+		b = append(b, AMF0_MARKER_STRICT_ARRAY, 0, 0, 0, 1)
+	}
+	return append(b, leaf...)
+}
+
+// nestedObjects gives n objects of one property each around null
+func nestedObjects(n int) []byte {
+	var b []byte
+	for i := 0; i < n; i++ {
+		b = append(b, AMF0_MARKER_OBJECT, 0, 1, 'a')
+	}
+	b = append(b, AMF0_MARKER_NULL)
+	for i := 0; i < n; i++ {
+		b = append(b, 0, 0, AMF0_MARKER_OBJECT_END)
+	}
+	return b
+}
+
+func TestDecodeDepth(t *testing.T) {
+	// AMF3 arrays of one element around null, switched to within AMF0
+	// arrays
+	amf3 := []byte{AMF0_MARKER_AMF3}
+	for i := 0; i < AMF_MAX_DEPTH/2; i++ {
+		amf3 = append(amf3, AMF3_MARKER_ARRAY, 0x03, 0x01)
+	}
+	amf3 = append(amf3, AMF3_MARKER_NULL)
+
+	tests := []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{"arrays at the limit", nestedArrays(AMF_MAX_DEPTH-1, amf0_number), nil},
+		{"arrays too deep", nestedArrays(AMF_MAX_DEPTH, amf0_number), ErrTooDeep},
+		{"objects at the limit", nestedObjects(AMF_MAX_DEPTH - 1), nil},
+		{"objects too deep", nestedObjects(AMF_MAX_DEPTH), ErrTooDeep},
+		{"far too deep", nestedArrays(1000000, amf0_number), ErrTooDeep},
+		{"AMF3 at the limit", nestedArrays(AMF_MAX_DEPTH/2-1, amf3), nil},
+		{"too deep across AMF3", nestedArrays(AMF_MAX_DEPTH/2, amf3), ErrTooDeep},
+	}
+
+	for _, tt := range tests {
+		buf := bytes.NewBuffer(tt.b)
+		_, err := Decode(buf)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+		if err == nil && buf.Len() != 0 {
+			t.Errorf("%s: %d bytes left", tt.name, buf.Len())
+		}
+	}
+}
+
+func TestDecoderReferences(t *testing.T) {
+	obj := Object{"a": 1.0}
+	var buf bytes.Buffer
+	Encode(&buf, obj)
+	// a reference to the first object
+	buf.Write([]byte{AMF0_MARKER_REFERENCE, 0x00, 0x00})
+
+	d := NewDecoder(&buf)
+	for i := 0; i < 2; i++ {
+		v, err := d.Decode()
+		if err != nil {
+			t.Fatalf("value %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(v, obj) {
+			t.Errorf("value %d: got %#v, want %#v", i, v, obj)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"go_rtmp_srv/fmp4"
+	"log"
+	"time"
+)
+
+// samples in an AAC frame
+const CMAF_AAC_FRAME = 1024
+
+// flv timestamps are in ms
+const CMAF_VIDEO_PER_MS = fmp4.VIDEO_TIMESCALE / 1000
+
+type cmafSample struct {
+	dts  uint32 // ms
+	cts  int32  // ms
+	sync bool
+	data []byte
+}
+
+type CMAFFragment struct {
+	seq           uint32
+	frags         []fmp4.Fragment
+	start         uint32 // dts of its first frame, in ms
+	duration      float64
+	independent   bool // starts with a key frame
+	last          bool // ends its segment
+	discontinuity bool // first after a timestamp jump or a new init
+	tracks        []*fmp4.Track
+	initver       int // changes with the tracks
+}
+
+// mux writes the samples of all the tracks in a moof and mdat
+func (f *CMAFFragment) mux() []byte {
+	var b bytes.Buffer
+	fmp4.WriteFragment(&b, f.seq, f.frags)
+	return b.Bytes()
+}
+
+// track writes the samples of one track in a moof and mdat, it tells
+// whether there were any
+func (f *CMAFFragment) track(t *fmp4.Track) ([]byte, fmp4.Fragment, bool) {
+	for _, frag := range f.frags {
+		if frag.Track == t {
+			var b bytes.Buffer
+			fmp4.WriteFragment(&b, f.seq, []fmp4.Fragment{frag})
+			return b.Bytes(), frag, true
+		}
+	}
+	return nil, fmp4.Fragment{}, false
+}
+
+// cmafInit writes the init segment of the tracks
+func cmafInit(tracks ...*fmp4.Track) []byte {
+	var b bytes.Buffer
+	fmp4.WriteInit(&b, tracks)
+	return b.Bytes()
+}
+
+// CMAFFragmenter cuts a stream in fMP4 fragments: segments start on key
+// frames once the segment target is reached, within them parts are cut on
+// any frame at the part target. Without a part target a fragment is a whole
+// segment.
+type CMAFFragmenter struct {
+	name       string
+	segtarget  uint32 // ms
+	parttarget uint32
+	emit       func(f *CMAFFragment)
+
+	video     *fmp4.Track
+	audio     *fmp4.Track
+	avcc      []byte
+	asc       []byte
+	initdirty bool
+	tracks    []*fmp4.Track
+	initver   int
+
+	vq          []cmafSample
+	aq          []cmafSample
+	started     bool
+	segstart    uint32
+	partstart   uint32
+	lastdts     uint32
+	lastdelta   uint32
+	independent bool
+	disc        bool
+	fragseq     uint32
+	audionext   uint64 // end of the last audio fragment, in samples
+}
+
+func NewCMAFFragmenter(name string, segtarget, parttarget time.Duration,
+	emit func(f *CMAFFragment)) *CMAFFragmenter {
+	f := new(CMAFFragmenter)
+	f.name = name
+	f.segtarget = uint32(segtarget / time.Millisecond)
+	f.parttarget = uint32(parttarget / time.Millisecond)
+	f.emit = emit
+	f.initver = -1
+	return f
+}
+
+func (f *CMAFFragmenter) handleTag(tag bytes.Buffer) {
+	ret, fh, body := ParseFlvTag(tag.Bytes())
+	if !ret || len(body) < 2 {
+		return
+	}
+	dts := fh.ts | uint32(fh.exts)<<24
+
+	switch fh.t {
+	case RTMP_MSG_TYPEID_VIDEO_PKT:
+		if body[0]&FLV_EX_HEADER != 0 || body[0]&0x0f != FLV_CODEC_AVC || len(body) < 5 {
+			return
+		}
+
+		if isVideoSeqHeader(body) {
+			if bytes.Equal(body[5:], f.avcc) {
+				return
+			}
+			t, err := fmp4.NewVideoTrack(1, body[5:])
+			if err != nil {
+				log.Println("cmaf:", err)
+				return
+			}
+			f.video = t
+			f.avcc = t.AVCConfig
+			f.restart()
+			return
+		}
+
+		if f.video == nil {
+			return
+		}
+
+		cts := int32(uint32(body[2])<<16|uint32(body[3])<<8|uint32(body[4])) << 8 >> 8
+		keyframe := isKeyFrame(body)
+		if !f.cut(dts, keyframe) {
+			return
+		}
+		f.vq = append(f.vq, cmafSample{dts, cts, keyframe, body[5:]})
+	case RTMP_MSG_TYPEID_AUDIO_PKT:
+		if body[0]>>4 != FLV_SOUND_AAC {
+			return
+		}
+
+		if isAudioSeqHeader(body) {
+			if bytes.Equal(body[2:], f.asc) {
+				return
+			}
+			t, err := fmp4.NewAudioTrack(2, body[2:])
+			if err != nil {
+				log.Println("cmaf:", err)
+				return
+			}
+			f.audio = t
+			f.asc = t.AudioConfig
+			f.restart()
+			return
+		}
+
+		if f.audio == nil {
+			return
+		}
+
+		// an audio only stream is cut on any frame, else the audio
+		// follows the video
+		if f.video == nil {
+			if !f.cut(dts, true) {
+				return
+			}
+		} else if !f.started {
+			return
+		}
+		f.aq = append(f.aq, cmafSample{dts, 0, true, body[2:]})
+	}
+}
+
+// restart takes the new tracks in a new init segment, the fragments
+// start again on the next key frame
+func (f *CMAFFragmenter) restart() {
+	if f.started {
+		log.Printf("cmaf %s: new codec configuration\n", f.name)
+		f.stop()
+	}
+	f.initdirty = true
+}
+
+// stop ends the segment, the next fragment follows a discontinuity
+func (f *CMAFFragmenter) stop() {
+	f.flush(f.lastdts+f.lastdelta, true)
+	f.aq = nil
+	f.audionext = 0
+	f.started = false
+	f.disc = true
+}
+
+// cut starts a new segment or a new part before the frame, it tells
+// whether the frame can be added
+func (f *CMAFFragmenter) cut(dts uint32, keyframe bool) bool {
+	// the publisher reset its clock
+	if f.started && (int64(dts)+FLV_TS_MAX_BACKWARD < int64(f.lastdts) ||
+		int64(dts) > int64(f.lastdts)+FLV_TS_MAX_FORWARD) {
+		log.Printf("cmaf %s: timestamp jumps from %d to %d\n", f.name, f.lastdts, dts)
+		f.stop()
+	}
+
+	if !f.started {
+		if !keyframe {
+			return false
+		}
+
+		if f.initdirty {
+			f.tracks = nil
+			for _, t := range []*fmp4.Track{f.video, f.audio} {
+				if t != nil {
+					f.tracks = append(f.tracks, t)
+				}
+			}
+			f.initver++
+			f.initdirty = false
+		}
+
+		f.started = true
+		f.segstart = dts
+		f.partstart = dts
+		f.lastdts = dts
+		f.lastdelta = 0
+		f.independent = true
+		return true
+	}
+
+	delta := dts - f.lastdts
+	if dts < f.lastdts {
+		delta = 0
+	}
+
+	if keyframe && dts-f.segstart >= f.segtarget {
+		f.flush(dts, true)
+		f.segstart = dts
+		f.partstart = dts
+		f.independent = true
+	} else if f.parttarget > 0 && dts-f.partstart+delta > f.parttarget {
+		// a part never goes over the part target
+		f.flush(dts, false)
+		f.partstart = dts
+		f.independent = keyframe
+	}
+
+	f.lastdts = dts
+	if delta > 0 {
+		f.lastdelta = delta
+	}
+	return true
+}
+
+// flush writes the queued frames up to enddts as a fragment
+func (f *CMAFFragmenter) flush(enddts uint32, last bool) {
+	if len(f.vq) == 0 && len(f.aq) == 0 {
+		return
+	}
+
+	var frags []fmp4.Fragment
+	if f.video != nil && len(f.vq) > 0 {
+		frag := fmp4.Fragment{Track: f.video, BaseTime: uint64(f.vq[0].dts) * CMAF_VIDEO_PER_MS}
+		for i, s := range f.vq {
+			end := enddts
+			if i+1 < len(f.vq) {
+				end = f.vq[i+1].dts
+			}
+			var duration uint32
+			if end > s.dts {
+				duration = (end - s.dts) * CMAF_VIDEO_PER_MS
+			}
+			frag.Samples = append(frag.Samples, fmp4.Sample{
+				Duration: duration,
+				CTS:      s.cts * CMAF_VIDEO_PER_MS,
+				Sync:     s.sync,
+				Data:     s.data,
+			})
+		}
+		frags = append(frags, frag)
+		f.vq = nil
+	}
+
+	// the audio after the end goes to the next fragment
+	n := 0
+	for n < len(f.aq) && f.aq[n].dts < enddts {
+		n++
+	}
+	if f.audio != nil && n > 0 {
+		// the ms of flv are rounded, the audio goes on from the last
+		// fragment unless a frame is missing
+		base := uint64(f.aq[0].dts) * uint64(f.audio.Timescale) / 1000
+		if f.audionext > 0 && base+CMAF_AAC_FRAME/2 > f.audionext &&
+			base < f.audionext+CMAF_AAC_FRAME/2 {
+			base = f.audionext
+		}
+		f.audionext = base + uint64(n)*CMAF_AAC_FRAME
+		frag := fmp4.Fragment{Track: f.audio, BaseTime: base}
+		for _, s := range f.aq[:n] {
+			frag.Samples = append(frag.Samples, fmp4.Sample{
+				Duration: CMAF_AAC_FRAME,
+				Sync:     true,
+				Data:     s.data,
+			})
+		}
+		frags = append(frags, frag)
+		f.aq = f.aq[n:]
+	}
+
+	if len(frags) == 0 {
+		return
+	}
+
+	f.fragseq++
+	f.emit(&CMAFFragment{
+		seq:           f.fragseq,
+		frags:         frags,
+		start:         f.partstart,
+		duration:      float64(enddts-f.partstart) / 1000,
+		independent:   f.independent,
+		last:          last,
+		discontinuity: f.disc,
+		tracks:        f.tracks,
+		initver:       f.initver,
+	})
+	f.disc = false
+}
+
+// Close writes what is left once the stream ended
+func (f *CMAFFragmenter) Close() {
+	if f.started {
+		f.stop()
+	}
+}
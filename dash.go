@@ -0,0 +1,500 @@
+package main
+
+import (
+	"fmt"
+	"go_rtmp_srv/fmp4"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DASHConf struct {
+	enabled bool
+	target  time.Duration // segment duration, cut on the next key frame
+	window  int           // segments in the manifest
+}
+
+var default_dash_conf = DASHConf{
+	enabled: true,
+	target:  4 * time.Second,
+	window:  5,
+}
+
+// segments kept out of the manifest for the players still loading them
+const DASH_EXTRA_SEGMENTS = 2
+
+type dashSegment struct {
+	t    uint64 // in the timescale of the track
+	d    uint64
+	data []byte
+}
+
+type dashTrack struct {
+	track *fmp4.Track
+	init  []byte
+}
+
+// dashFragment is a segment of each track, nil for a track without samples
+type dashFragment struct {
+	duration float64
+	video    *dashSegment
+	audio    *dashSegment
+}
+
+// dashPeriod starts at each new init segment or timestamp jump
+type dashPeriod struct {
+	id        int
+	start     float64 // seconds from the availability start time
+	duration  float64
+	base      uint32 // dts at the start, in ms
+	initver   int
+	video     *dashTrack
+	audio     *dashTrack
+	fragments []dashFragment
+}
+
+// DASHMuxer cuts a stream in fMP4 segments, a track each, and keeps a
+// sliding window of them in memory, it reads the stream as a pull node
+type DASHMuxer struct {
+	name string // app/stream
+	conf DASHConf
+	frag *CMAFFragmenter
+
+	// protects the fields below, taken by the http handlers
+	lock         sync.Mutex
+	availability time.Time // wall clock of the start of the first period
+	periods      []*dashPeriod
+	nextperiod   int
+	ended        bool
+}
+
+func NewDASHMuxer(name string, conf DASHConf) *DASHMuxer {
+	m := new(DASHMuxer)
+	m.name = name
+	m.conf = conf
+	m.frag = NewCMAFFragmenter(name, conf.target, 0, m.addFragment)
+	return m
+}
+
+// run feeds the muxer from the stream until it ends
+func (m *DASHMuxer) run(pi *PullInfo) {
+	for _, tag := range pi.takeReplay() {
+		m.frag.handleTag(tag)
+	}
+
+	for {
+		tag, status := pi.Next(nil)
+		if status != PULL_OK {
+			break
+		}
+		m.frag.handleTag(tag)
+	}
+
+	m.frag.Close()
+	m.lock.Lock()
+	m.ended = true
+	m.lock.Unlock()
+	log.Printf("dash %s ended\n", m.name)
+}
+
+// addFragment adds a segment to the last period, it's called by the
+// fragmenter
+func (m *DASHMuxer) addFragment(f *CMAFFragment) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var p *dashPeriod
+	if n := len(m.periods); n > 0 {
+		p = m.periods[n-1]
+	} else {
+		// the fragment is written once its duration elapsed
+		m.availability = time.Now().Add(-time.Duration(f.duration * float64(time.Second)))
+	}
+
+	if p == nil || f.discontinuity || f.initver != p.initver {
+		np := &dashPeriod{id: m.nextperiod, base: f.start, initver: f.initver}
+		m.nextperiod++
+		if p != nil {
+			// after a gap the wall clock ran ahead of the timeline, the
+			// period starts when its first fragment began so that its
+			// segments are asked for when they exist
+			np.start = math.Max(p.start+p.duration,
+				time.Since(m.availability).Seconds()-f.duration)
+		}
+		for _, t := range f.tracks {
+			dt := &dashTrack{track: t, init: cmafInit(t)}
+			if t.Video {
+				np.video = dt
+			} else {
+				np.audio = dt
+			}
+		}
+		m.periods = append(m.periods, np)
+		p = np
+	}
+
+	frag := dashFragment{duration: f.duration}
+	for _, dt := range []*dashTrack{p.video, p.audio} {
+		if dt == nil {
+			continue
+		}
+		data, tf, ok := f.track(dt.track)
+		if !ok {
+			continue
+		}
+		seg := &dashSegment{t: tf.BaseTime, data: data}
+		for _, s := range tf.Samples {
+			seg.d += uint64(s.Duration)
+		}
+		if dt.track.Video {
+			frag.video = seg
+		} else {
+			frag.audio = seg
+		}
+	}
+	p.fragments = append(p.fragments, frag)
+	p.duration += f.duration
+
+	// slide the window, the periods left empty go
+	total := 0
+	for _, p := range m.periods {
+		total += len(p.fragments)
+	}
+	if total > m.conf.window+DASH_EXTRA_SEGMENTS {
+		m.periods[0].fragments = m.periods[0].fragments[1:]
+		if len(m.periods[0].fragments) == 0 {
+			m.periods = m.periods[1:]
+		}
+	}
+}
+
+// dashDuration formats seconds as an xs:duration
+func dashDuration(s float64) string {
+	return fmt.Sprintf("PT%.3fS", s)
+}
+
+func dashTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// writeTimeline writes the SegmentTimeline of a track, the segments
+// following each other with the same duration are repeated
+func writeTimeline(b *strings.Builder, segs []*dashSegment) {
+	b.WriteString("        <SegmentTimeline>\n")
+	for i := 0; i < len(segs); {
+		r := 0
+		for i+r+1 < len(segs) && segs[i+r+1].d == segs[i].d &&
+			segs[i+r+1].t == segs[i+r].t+segs[i+r].d {
+			r++
+		}
+		if r > 0 {
+			fmt.Fprintf(b, "          <S t=\"%d\" d=\"%d\" r=\"%d\"/>\n", segs[i].t, segs[i].d, r)
+		} else {
+			fmt.Fprintf(b, "          <S t=\"%d\" d=\"%d\"/>\n", segs[i].t, segs[i].d)
+		}
+		i += r + 1
+	}
+	b.WriteString("        </SegmentTimeline>\n")
+}
+
+// bandwidth gives the bits per second of the segments
+func bandwidth(segs []*dashSegment, timescale uint32) int {
+	var size, duration uint64
+	for _, seg := range segs {
+		size += uint64(len(seg.data))
+		duration += seg.d
+	}
+	if duration == 0 {
+		return 1
+	}
+	return int(math.Max(1, float64(size*8)*float64(timescale)/float64(duration)))
+}
+
+// Manifest gives the dynamic MPD of the latest segments
+func (m *DASHMuxer) Manifest() (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// the window is of the last segments, over the periods
+	skip := -m.conf.window
+	for _, p := range m.periods {
+		skip += len(p.fragments)
+	}
+	if len(m.periods) == 0 {
+		return "", false
+	}
+
+	target := m.conf.target.Seconds()
+	for _, p := range m.periods {
+		for _, f := range p.fragments {
+			target = math.Max(target, f.duration)
+		}
+	}
+
+	base := path.Base(m.name)
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n")
+	b.WriteString("<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" " +
+		"profiles=\"urn:mpeg:dash:profile:isoff-live:2011\" type=\"dynamic\"")
+	fmt.Fprintf(&b, " availabilityStartTime=\"%s\"", dashTime(m.availability))
+	fmt.Fprintf(&b, " publishTime=\"%s\"", dashTime(time.Now()))
+	if m.ended {
+		last := m.periods[len(m.periods)-1]
+		fmt.Fprintf(&b, " mediaPresentationDuration=\"%s\"", dashDuration(last.start+last.duration))
+	} else {
+		fmt.Fprintf(&b, " minimumUpdatePeriod=\"%s\"", dashDuration(m.conf.target.Seconds()))
+	}
+	fmt.Fprintf(&b, " minBufferTime=\"%s\"", dashDuration(m.conf.target.Seconds()))
+	fmt.Fprintf(&b, " timeShiftBufferDepth=\"%s\"", dashDuration(float64(m.conf.window)*target))
+	fmt.Fprintf(&b, " suggestedPresentationDelay=\"%s\"", dashDuration(3*m.conf.target.Seconds()))
+	fmt.Fprintf(&b, " maxSegmentDuration=\"%s\">\n", dashDuration(math.Ceil(target)))
+
+	for _, p := range m.periods {
+		frags := p.fragments
+		if skip >= len(frags) {
+			skip -= len(frags)
+			continue
+		} else if skip > 0 {
+			frags = frags[skip:]
+			skip = 0
+		}
+
+		fmt.Fprintf(&b, "  <Period id=\"%d\" start=\"%s\">\n", p.id, dashDuration(p.start))
+		for i, dt := range []*dashTrack{p.video, p.audio} {
+			if dt == nil {
+				continue
+			}
+			var segs []*dashSegment
+			for _, f := range frags {
+				if dt.track.Video && f.video != nil {
+					segs = append(segs, f.video)
+				} else if !dt.track.Video && f.audio != nil {
+					segs = append(segs, f.audio)
+				}
+			}
+			if len(segs) == 0 {
+				continue
+			}
+
+			t := dt.track
+			ext := "m4a"
+			if t.Video {
+				ext = "m4v"
+				fmt.Fprintf(&b, "    <AdaptationSet id=\"%d\" contentType=\"video\" mimeType=\"video/mp4\" "+
+					"segmentAlignment=\"true\" startWithSAP=\"1\">\n", i)
+				fmt.Fprintf(&b, "      <Representation id=\"video\" codecs=\"%s\" bandwidth=\"%d\" "+
+					"width=\"%d\" height=\"%d\">\n", t.Codec(), bandwidth(segs, t.Timescale), t.Width, t.Height)
+			} else {
+				fmt.Fprintf(&b, "    <AdaptationSet id=\"%d\" contentType=\"audio\" mimeType=\"audio/mp4\" "+
+					"segmentAlignment=\"true\" startWithSAP=\"1\">\n", i)
+				fmt.Fprintf(&b, "      <Representation id=\"audio\" codecs=\"%s\" bandwidth=\"%d\" "+
+					"audioSamplingRate=\"%d\">\n", t.Codec(), bandwidth(segs, t.Timescale), t.SampleRate)
+				fmt.Fprintf(&b, "        <AudioChannelConfiguration schemeIdUri=\"urn:mpeg:dash:23003:3:"+
+					"audio_channel_configuration:2011\" value=\"%d\"/>\n", t.Channels)
+			}
+			fmt.Fprintf(&b, "        <SegmentTemplate timescale=\"%d\" presentationTimeOffset=\"%d\" "+
+				"initialization=\"%s-init%d.%s\" media=\"%s-%d_$Time$.%s\">\n",
+				t.Timescale, uint64(p.base)*uint64(t.Timescale)/1000, base, p.initver, ext, base, p.id, ext)
+			writeTimeline(&b, segs)
+			b.WriteString("        </SegmentTemplate>\n")
+			b.WriteString("      </Representation>\n")
+			b.WriteString("    </AdaptationSet>\n")
+		}
+		b.WriteString("  </Period>\n")
+	}
+
+	fmt.Fprintf(&b, "  <UTCTiming schemeIdUri=\"urn:mpeg:dash:utc:direct:2014\" value=\"%s\"/>\n",
+		dashTime(time.Now()))
+	b.WriteString("</MPD>\n")
+
+	return b.String(), true
+}
+
+// Segment gives the segment of a track starting at t in a period, the
+// times of two periods may be the same
+func (m *DASHMuxer) Segment(video bool, period int, t uint64) ([]byte, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, p := range m.periods {
+		if p.id != period {
+			continue
+		}
+		for _, f := range p.fragments {
+			seg := f.audio
+			if video {
+				seg = f.video
+			}
+			if seg != nil && seg.t == t {
+				return seg.data, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Init gives the init segment of a track for a version of the tracks
+func (m *DASHMuxer) Init(video bool, version int) ([]byte, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, p := range m.periods {
+		dt := p.audio
+		if video {
+			dt = p.video
+		}
+		if p.initver == version && dt != nil {
+			return dt.init, true
+		}
+	}
+	return nil, false
+}
+
+// DASHServer keeps the muxers of the published streams, by app/stream
+type DASHServer struct {
+	lock   sync.Mutex
+	conf   DASHConf
+	muxers map[string]*DASHMuxer
+}
+
+func NewDASHServer() *DASHServer {
+	ds := new(DASHServer)
+	ds.conf = default_dash_conf
+	ds.muxers = make(map[string]*DASHMuxer)
+	return ds
+}
+
+var dash = NewDASHServer()
+
+func (ds *DASHServer) SetConf(conf DASHConf) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	ds.conf = conf
+}
+
+// onStreamEvent starts a muxer for each new stream, it's kept a while
+// after the stream ended for the players to get the last segments
+func (ds *DASHServer) onStreamEvent(event int, ls *LiveStream) {
+	if event != STREAM_EVENT_CREATED {
+		return
+	}
+
+	ds.lock.Lock()
+	conf := ds.conf
+	ds.lock.Unlock()
+	if !conf.enabled {
+		return
+	}
+
+	name := path.Join(ls.app, ls.name)
+
+	cn := NewClientNode(nil, 0)
+	cn.addr = "dash"
+	_, pi, ok := streams.Subscribe(ls.app, ls.name, cn)
+	if !ok {
+		return
+	}
+
+	m := NewDASHMuxer(name, conf)
+	ds.lock.Lock()
+	ds.muxers[name] = m
+	ds.lock.Unlock()
+	log.Printf("dash %s started\n", name)
+
+	go func() {
+		m.run(pi)
+		streams.Unsubscribe(ls, cn)
+
+		linger := time.Duration(conf.window) * conf.target
+		time.AfterFunc(linger, func() {
+			ds.lock.Lock()
+			defer ds.lock.Unlock()
+			if ds.muxers[name] == m {
+				delete(ds.muxers, name)
+			}
+		})
+	}()
+}
+
+func (ds *DASHServer) lookup(name string) (*DASHMuxer, bool) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	m, ok := ds.muxers[name]
+	return m, ok
+}
+
+// ServeHTTP serves /app/stream.mpd, the init segments of its tracks
+// /app/stream-initV.m4v and .m4a, and their segments of period P
+// /app/stream-P_T.m4v and .m4a
+func (ds *DASHServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+
+	if strings.HasSuffix(p, ".mpd") {
+		m, ok := ds.lookup(strings.TrimSuffix(p, ".mpd"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		manifest, ok := m.Manifest()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(manifest))
+		return
+	}
+
+	ext := path.Ext(p)
+	video := ext == ".m4v"
+	p = strings.TrimSuffix(p, ext)
+	i := strings.LastIndex(p, "-")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	m, ok := ds.lookup(p[:i])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var data []byte
+	file := p[i+1:]
+	if strings.HasPrefix(file, "init") {
+		version, err := strconv.Atoi(strings.TrimPrefix(file, "init"))
+		if err == nil {
+			data, ok = m.Init(video, version)
+		}
+	} else if j := strings.Index(file, "_"); j > 0 {
+		period, err := strconv.Atoi(file[:j])
+		var t uint64
+		if err == nil {
+			t, err = strconv.ParseUint(file[j+1:], 10, 64)
+		}
+		if err == nil {
+			data, ok = m.Segment(video, period, t)
+		}
+	}
+	if data == nil || !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if video {
+		w.Header().Set("Content-Type", "video/mp4")
+	} else {
+		w.Header().Set("Content-Type", "audio/mp4")
+	}
+	w.Write(data)
+}
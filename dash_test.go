@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"go_rtmp_srv/fmp4"
+)
+
+// periodStart reads the start of a period in a manifest
+func periodStart(t *testing.T, mpd string, id int) float64 {
+	t.Helper()
+	tag := fmt.Sprintf("<Period id=\"%d\" start=\"", id)
+	i := strings.Index(mpd, tag)
+	if i < 0 {
+		t.Fatalf("no period %d in %s", id, mpd)
+	}
+	var start float64
+	if _, err := fmt.Sscanf(mpd[i+len(tag):], "PT%fS", &start); err != nil {
+		t.Fatalf("period %d: %v", id, err)
+	}
+	return start
+}
+
+func TestDASHPeriodStart(t *testing.T) {
+	tr, err := fmp4.NewAudioTrack(2, []byte{0x12, 0x10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fragments of 2s
+	fragment := func(seq uint32, start uint32, discontinuity bool) *CMAFFragment {
+		return &CMAFFragment{
+			seq: seq,
+			frags: []fmp4.Fragment{{Track: tr, BaseTime: uint64(start) * 441 / 10,
+				Samples: []fmp4.Sample{{Duration: 88200, Sync: true, Data: []byte{1}}}}},
+			start:         start,
+			duration:      2,
+			independent:   true,
+			last:          true,
+			discontinuity: discontinuity,
+			tracks:        []*fmp4.Track{tr},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		gap   time.Duration // of the publisher before the discontinuity
+		start float64
+	}{
+		{"no gap", 0, 4},
+		{"gap", time.Minute, 60},
+	}
+
+	for _, tt := range tests {
+		m := NewDASHMuxer("live/gap", default_dash_conf)
+		m.addFragment(fragment(1, 0, false))
+		m.addFragment(fragment(2, 2000, false))
+		m.availability = m.availability.Add(-tt.gap)
+		// the publisher came back with its timestamps from 0
+		m.addFragment(fragment(3, 0, true))
+
+		mpd, ok := m.Manifest()
+		if !ok {
+			t.Fatalf("%s: no manifest", tt.name)
+		}
+		if start := periodStart(t, mpd, 0); start != 0 {
+			t.Errorf("%s: first period at %f", tt.name, start)
+		}
+		if start := periodStart(t, mpd, 1); math.Abs(start-tt.start) > 0.5 {
+			t.Errorf("%s: second period at %f, want %f", tt.name, start, tt.start)
+		}
+	}
+}
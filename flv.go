@@ -3,6 +3,13 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"log"
+)
+
+// track flags of the flv header
+const (
+	FLV_HEADER_AUDIO = 0x04
+	FLV_HEADER_VIDEO = 0x01
 )
 
 type FLVHeader struct {
@@ -24,6 +31,109 @@ func (f *FLVHeader) toBytes() []byte {
 	return b[:]
 }
 
+// first bytes of the audio/video tag bodies
+const (
+	FLV_SOUND_AAC        = 10
+	FLV_AAC_SEQ_HEADER   = 0
+	FLV_FRAME_KEY        = 1
+	FLV_FRAME_DISPOSABLE = 3 // h.263 only
+	FLV_CODEC_AVC        = 7
+	FLV_CODEC_HEVC       = 12 // not in the spec but widely used
+	FLV_AVC_SEQ_HEADER   = 0
+	FLV_EX_HEADER        = 0x80 // enhanced rtmp, the codec is a fourcc
+	FLV_EX_SEQ_START     = 0
+	FLV_EX_CODED_FRAMES  = 1
+)
+
+// isAudioSeqHeader tells whether an audio tag body carries the AAC
+// AudioSpecificConfig
+func isAudioSeqHeader(body []byte) bool {
+	return len(body) >= 2 && body[0]>>4 == FLV_SOUND_AAC &&
+		body[1] == FLV_AAC_SEQ_HEADER
+}
+
+// isVideoSeqHeader tells whether a video tag body carries the AVC/HEVC
+// decoder configuration, legacy or enhanced
+func isVideoSeqHeader(body []byte) bool {
+	if len(body) < 2 {
+		return false
+	}
+
+	if body[0]&FLV_EX_HEADER != 0 {
+		return body[0]&0x0f == FLV_EX_SEQ_START
+	}
+
+	codec := body[0] & 0x0f
+	return (codec == FLV_CODEC_AVC || codec == FLV_CODEC_HEVC) &&
+		body[1] == FLV_AVC_SEQ_HEADER
+}
+
+// isKeyFrame tells whether a video tag body is a key frame, not counting the
+// sequence headers
+func isKeyFrame(body []byte) bool {
+	if len(body) < 2 || isVideoSeqHeader(body) {
+		return false
+	}
+
+	return (body[0]>>4)&0x07 == FLV_FRAME_KEY
+}
+
+// isNonRefFrame tells whether a video tag body is a frame no other frame
+// refers to, so that it can be dropped without breaking the decoding. The
+// AVC/HEVC NAL units are assumed to have 4 bytes lengths.
+func isNonRefFrame(body []byte) bool {
+	if len(body) < 5 || body[0]&FLV_EX_HEADER != 0 || isVideoSeqHeader(body) {
+		return false
+	}
+
+	frametype := (body[0] >> 4) & 0x07
+	if frametype == FLV_FRAME_DISPOSABLE {
+		return true
+	} else if frametype == FLV_FRAME_KEY {
+		return false
+	}
+
+	codec := body[0] & 0x0f
+	if codec != FLV_CODEC_AVC && codec != FLV_CODEC_HEVC {
+		return false
+	}
+
+	// all the slices of the frame have to be non reference ones
+	found := false
+	nalus := body[5:]
+	for len(nalus) > 4 {
+		n := int(binary.BigEndian.Uint32(nalus))
+		nalus = nalus[4:]
+		if n == 0 || n > len(nalus) {
+			return false
+		}
+
+		nal := nalus[0]
+		nalus = nalus[n:]
+		if codec == FLV_CODEC_AVC {
+			naltype := nal & 0x1f
+			if naltype < 1 || naltype > 5 {
+				continue
+			}
+			if nal&0x60 != 0 {
+				return false
+			}
+		} else {
+			// the even types up to 14 are sub-layer non reference
+			naltype := (nal >> 1) & 0x3f
+			if naltype > 31 {
+				continue
+			}
+			if naltype > 14 || naltype%2 != 0 {
+				return false
+			}
+		}
+		found = true
+	}
+
+	return found
+}
+
 type FLVTagHeader struct {
 	t        uint8
 	size     uint32 // 3B
@@ -44,7 +154,7 @@ func (f *FLVTagHeader) toBytes() []byte {
 	b[5] = uint8(f.ts >> 8)
 	b[6] = uint8(f.ts)
 
-	b[7] = 0
+	b[7] = f.exts
 
 	b[8] = uint8(f.streamid >> 16)
 	b[9] = uint8(f.streamid >> 8)
@@ -58,8 +168,80 @@ func PackFlvTag(ft *bytes.Buffer, msgtype uint8, timestamp uint32,
 	fh.t = msgtype
 	fh.size = uint32(body.Len())
 	fh.streamid = 0
-	fh.ts = timestamp
+	// the upper 8 bits go in the extended timestamp
+	fh.ts = timestamp & 0xffffff
+	fh.exts = uint8(timestamp >> 24)
+
+	ft.Write(fh.toBytes())
+	ft.Write(body.Bytes())
+}
+
+// ParseFlvTag splits a tag packed by PackFlvTag into its header and body
+func ParseFlvTag(b []byte) (bool, FLVTagHeader, []byte) {
+	var fh FLVTagHeader
+	if len(b) < 11 {
+		return false, fh, nil
+	}
+
+	fh.t = b[0]
+	fh.size = uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	fh.ts = uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	fh.exts = b[7]
+	fh.streamid = uint32(b[8])<<16 | uint32(b[9])<<8 | uint32(b[10])
+
+	if uint32(len(b)-11) < fh.size {
+		return false, fh, nil
+	}
+
+	return true, fh, b[11 : 11+fh.size]
+}
+
+// timestamp gaps beyond which the publisher is assumed to have reset its
+// clock, in ms. Audio and video may go slightly backwards when interleaved.
+const (
+	FLV_TS_MAX_BACKWARD = 1000
+	FLV_TS_MAX_FORWARD  = 5000
+)
+
+// TimestampRebaser makes the timestamps of a subscriber start at zero with
+// the first frame, keeping the gaps between tags so audio and video stay in
+// sync. After a reset or a jump of the publisher timestamps, they go on from
+// the latest one given.
+type TimestampRebaser struct {
+	started bool
+	offset  int64  // subtracted from the publisher timestamps
+	last    uint32 // latest publisher timestamp
+	lastout uint32 // latest timestamp given
+}
+
+// Rebase gives the subscriber timestamp of a tag. Metadata and sequence
+// headers before the first frame are at zero.
+func (tr *TimestampRebaser) Rebase(t uint8, ts uint32, body []byte) uint32 {
+	if !tr.started {
+		if t != RTMP_MSG_TYPEID_AUDIO_PKT && t != RTMP_MSG_TYPEID_VIDEO_PKT ||
+			isAudioSeqHeader(body) || isVideoSeqHeader(body) {
+			return 0
+		}
+
+		tr.started = true
+		tr.offset = int64(ts)
+		tr.last = ts
+	}
+
+	if int64(ts)+FLV_TS_MAX_BACKWARD < int64(tr.last) ||
+		int64(ts) > int64(tr.last)+FLV_TS_MAX_FORWARD {
+		log.Printf("timestamp jumps from %d to %d, rebase\n", tr.last, ts)
+		tr.offset = int64(ts) - int64(tr.lastout)
+	}
+	tr.last = ts
 
-	binary.Write(ft, binary.LittleEndian, fh.toBytes())
-	binary.Write(ft, binary.LittleEndian, body.Bytes())
+	out := int64(ts) - tr.offset
+	if out < 0 {
+		// a bit before the first frame
+		out = 0
+	}
+	if uint32(out) > tr.lastout {
+		tr.lastout = uint32(out)
+	}
+	return uint32(out)
 }
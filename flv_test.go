@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTimestampRebaser(t *testing.T) {
+	var (
+		metadata = []byte{0x02}
+		aacseq   = []byte{0xaf, FLV_AAC_SEQ_HEADER, 0x12, 0x10}
+		aac      = []byte{0xaf, 0x01, 0x21}
+		avcseq   = []byte{0x17, FLV_AVC_SEQ_HEADER, 0, 0, 0, 0x01}
+		keyframe = []byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, 1, 0x65}
+		frame    = []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 1, 0x41}
+	)
+	const (
+		audio = RTMP_MSG_TYPEID_AUDIO_PKT
+		video = RTMP_MSG_TYPEID_VIDEO_PKT
+		data  = RTMP_MSG_TYPEID_INVIKE
+	)
+
+	type tag struct {
+		t    uint8
+		ts   uint32
+		body []byte
+		out  uint32
+	}
+	tests := []struct {
+		name string
+		tags []tag
+	}{
+		{"starts at zero", []tag{
+			{data, 5000, metadata, 0}, {audio, 5000, aacseq, 0}, {video, 5000, avcseq, 0},
+			{video, 5000, keyframe, 0}, {audio, 5023, aac, 23}, {video, 5040, frame, 40}}},
+		{"configuration once started", []tag{
+			{video, 5000, keyframe, 0}, {video, 6000, avcseq, 1000}, {data, 6000, metadata, 1000}}},
+		{"before the first frame", []tag{
+			{audio, 1000, aac, 0}, {video, 990, keyframe, 0}, {video, 1040, frame, 40}}},
+		{"small step back", []tag{
+			{video, 1000, keyframe, 0}, {video, 1040, frame, 40}, {audio, 1020, aac, 20},
+			{video, 1080, frame, 80}}},
+		{"reset", []tag{
+			{video, 10000, keyframe, 0}, {video, 10040, frame, 40}, {video, 0, keyframe, 40},
+			{video, 40, frame, 80}}},
+		{"jump forward", []tag{
+			{video, 0, keyframe, 0}, {video, 40, frame, 40}, {video, 100000, frame, 40},
+			{video, 100040, frame, 80}}},
+		{"wrap", []tag{
+			{video, 0xffffff00, keyframe, 0}, {video, 0xffffff40, frame, 64}, {video, 0x10, frame, 64},
+			{video, 0x50, frame, 128}}},
+		{"reset after a step back", []tag{
+			{video, 1000, keyframe, 0}, {video, 1040, frame, 40}, {audio, 1020, aac, 20},
+			{video, 0, keyframe, 40}}},
+	}
+
+	for _, tt := range tests {
+		var tr TimestampRebaser
+		for i, tag := range tt.tags {
+			if out := tr.Rebase(tag.t, tag.ts, tag.body); out != tag.out {
+				t.Errorf("%s: tag %d at %d rebased to %d, want %d", tt.name, i, tag.ts, out, tag.out)
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+var (
+	ErrBadAVCConfig = errors.New("fmp4: bad AVCDecoderConfigurationRecord")
+	ErrBadSPS       = errors.New("fmp4: bad SPS")
+	ErrBadAACConfig = errors.New("fmp4: bad AudioSpecificConfig")
+)
+
+const VIDEO_TIMESCALE = 90000
+
+// NewVideoTrack makes an H.264 track of the AVCDecoderConfigurationRecord
+// sent as the AVC sequence header, its size is read from the first SPS
+func NewVideoTrack(id uint32, avcc []byte) (*Track, error) {
+	if len(avcc) < 8 || avcc[5]&0x1f == 0 {
+		return nil, ErrBadAVCConfig
+	}
+	l := int(binary.BigEndian.Uint16(avcc[6:]))
+	if len(avcc) < 8+l {
+		return nil, ErrBadAVCConfig
+	}
+
+	width, height, err := spsSize(avcc[8 : 8+l])
+	if err != nil {
+		return nil, err
+	}
+
+	t := new(Track)
+	t.ID = id
+	t.Video = true
+	t.Timescale = VIDEO_TIMESCALE
+	t.Width = uint16(width)
+	t.Height = uint16(height)
+	t.AVCConfig = append([]byte(nil), avcc...)
+	return t, nil
+}
+
+var aac_sample_rates = []uint32{96000, 88200, 64000, 48000, 44100, 32000,
+	24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// NewAudioTrack makes an AAC track of the AudioSpecificConfig sent as the
+// AAC sequence header, its timescale is the sample rate
+func NewAudioTrack(id uint32, asc []byte) (*Track, error) {
+	if len(asc) < 2 {
+		return nil, ErrBadAACConfig
+	}
+	index := (asc[0]&0x07)<<1 | asc[1]>>7
+	if asc[0]>>3 == 0 || int(index) >= len(aac_sample_rates) {
+		return nil, ErrBadAACConfig
+	}
+
+	t := new(Track)
+	t.ID = id
+	t.SampleRate = aac_sample_rates[index]
+	t.Timescale = t.SampleRate
+	t.Channels = uint16((asc[1] >> 3) & 0x0f)
+	if t.Channels == 0 {
+		t.Channels = 2
+	}
+	t.AudioConfig = append([]byte(nil), asc...)
+	return t, nil
+}
+
+// Codec gives the RFC 6381 codec of the track, as in avc1.64001f
+func (t *Track) Codec() string {
+	if t.Video {
+		const hex = "0123456789abcdef"
+		c := []byte("avc1.")
+		for _, v := range t.AVCConfig[1:4] {
+			c = append(c, hex[v>>4], hex[v&0x0f])
+		}
+		return string(c)
+	}
+	return "mp4a.40." + strconv.Itoa(int(t.AudioConfig[0]>>3))
+}
+
+// bitReader reads the exp-golomb coded fields of an SPS
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+	err bool
+}
+
+func (r *bitReader) bit() uint32 {
+	if r.pos >= len(r.b)*8 {
+		r.err = true
+		return 0
+	}
+	v := r.b[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+	r.pos++
+	return uint32(v)
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bit() == 0 && !r.err && zeros < 32 {
+		zeros++
+	}
+	return 1<<uint(zeros) - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 != 0 {
+		return int32(v+1) / 2
+	}
+	return -int32(v / 2)
+}
+
+// spsSize reads the picture size of an SPS NAL unit
+func spsSize(sps []byte) (int, int, error) {
+	if len(sps) < 4 {
+		return 0, 0, ErrBadSPS
+	}
+
+	// remove the emulation prevention bytes
+	rbsp := make([]byte, 0, len(sps))
+	for i := 0; i < len(sps); i++ {
+		if i >= 2 && sps[i] == 0x03 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+	if len(rbsp) < 4 {
+		return 0, 0, ErrBadSPS
+	}
+
+	profile := rbsp[1]
+	r := &bitReader{b: rbsp[4:]}
+	r.ue() // seq_parameter_set_id
+
+	chroma := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma = r.ue()
+		if chroma == 3 {
+			r.bit() // separate_colour_plane_flag
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		if r.bit() != 0 {
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit()
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && !r.err; n-- {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+
+	width := (r.ue() + 1) * 16
+	mapunits := r.ue() + 1
+	framembs := r.bit()
+	height := (2 - framembs) * mapunits * 16
+	if framembs == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	if r.bit() != 0 {
+		// cropping is in chroma samples
+		cropx, cropy := uint32(1), 2-framembs
+		if chroma == 1 || chroma == 2 {
+			cropx = 2
+		}
+		if chroma == 1 {
+			cropy *= 2
+		}
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		width -= (left + right) * cropx
+		height -= (top + bottom) * cropy
+	}
+
+	if r.err || width == 0 || height == 0 || width > 0xffff || height > 0xffff {
+		return 0, 0, ErrBadSPS
+	}
+	return int(width), int(height), nil
+}
@@ -0,0 +1,305 @@
+package fmp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+// bitWriter writes the exp-golomb coded fields of an SPS
+type bitWriter struct {
+	b []byte
+	n int // bits
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&1) << (7 - uint(w.n%8))
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	n := 0
+	for (v+1)>>uint(n) > 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v+1, n+1)
+}
+
+func (w *bitWriter) se(v int32) {
+	if v > 0 {
+		w.ue(uint32(2*v - 1))
+	} else {
+		w.ue(uint32(-2 * v))
+	}
+}
+
+// escape adds the emulation prevention bytes
+func escape(rbsp []byte) []byte {
+	var b []byte
+	zeros := 0
+	for _, v := range rbsp {
+		if zeros >= 2 && v <= 3 {
+			b = append(b, 3)
+			zeros = 0
+		}
+		b = append(b, v)
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return b
+}
+
+type testSPS struct {
+	profile   byte
+	chroma    uint32 // of the high profiles
+	scaling   bool
+	poctype   uint32
+	offset    int32 // of the poc type 1
+	widthmbs  uint32
+	mapunits  uint32
+	frameonly bool
+	crop      [4]uint32 // left, right, top, bottom
+}
+
+// makeSPS writes an SPS NAL unit with its emulation prevention bytes
+func makeSPS(s testSPS) []byte {
+	w := &bitWriter{b: []byte{0x67, s.profile, 0x00, 0x1f}, n: 32}
+	w.ue(0) // seq_parameter_set_id
+	if s.profile == 100 {
+		w.ue(s.chroma)
+		if s.chroma == 3 {
+			w.bits(0, 1)
+		}
+		w.ue(0)
+		w.ue(0)
+		w.bits(0, 1)
+		if s.scaling {
+			w.bits(1, 1)
+			lists := 8
+			if s.chroma == 3 {
+				lists = 12
+			}
+			// the first list is sent with one delta, then 0 ends it
+			w.bits(1, 1)
+			w.se(4)
+			w.se(-12)
+			w.bits(0, lists-1)
+		} else {
+			w.bits(0, 1)
+		}
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(s.poctype)
+	switch s.poctype {
+	case 0:
+		w.ue(0)
+	case 1:
+		w.bits(0, 1)
+		w.se(s.offset)
+		w.se(0)
+		w.ue(2)
+		w.se(1)
+		w.se(-1)
+	}
+	w.ue(1)
+	w.bits(0, 1)
+	w.ue(s.widthmbs - 1)
+	w.ue(s.mapunits - 1)
+	if s.frameonly {
+		w.bits(1, 1)
+	} else {
+		w.bits(0, 1)
+		w.bits(0, 1)
+	}
+	w.bits(1, 1)
+	if s.crop != [4]uint32{} {
+		w.bits(1, 1)
+		for _, c := range s.crop {
+			w.ue(c)
+		}
+	} else {
+		w.bits(0, 1)
+	}
+	w.bits(0, 1) // vui_parameters_present_flag
+	w.bits(1, 1) // rbsp_stop_one_bit
+	return escape(w.b)
+}
+
+// makeAVCC wraps an SPS and a PPS in an AVCDecoderConfigurationRecord
+func makeAVCC(sps []byte) []byte {
+	b := []byte{0x01, sps[1], sps[2], sps[3], 0xff, 0xe1, byte(len(sps) >> 8), byte(len(sps))}
+	b = append(b, sps...)
+	return append(b, 0x01, 0x00, 0x02, 0x68, 0xee)
+}
+
+func TestSPSSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		sps           testSPS
+		width, height int
+	}{
+		{"baseline 720p", testSPS{profile: 66, widthmbs: 80, mapunits: 45, frameonly: true}, 1280, 720},
+		{"high 1080p cropped", testSPS{profile: 100, chroma: 1, widthmbs: 120, mapunits: 68, frameonly: true,
+			crop: [4]uint32{0, 0, 0, 4}}, 1920, 1080},
+		{"high 4:4:4 cropped", testSPS{profile: 100, chroma: 3, widthmbs: 40, mapunits: 30, frameonly: true,
+			crop: [4]uint32{0, 3, 0, 5}}, 637, 475},
+		{"high 4:2:2 cropped", testSPS{profile: 100, chroma: 2, widthmbs: 40, mapunits: 30, frameonly: true,
+			crop: [4]uint32{1, 1, 1, 1}}, 636, 478},
+		{"scaling lists", testSPS{profile: 100, chroma: 1, scaling: true, widthmbs: 80, mapunits: 45, frameonly: true}, 1280, 720},
+		{"interlaced", testSPS{profile: 66, widthmbs: 45, mapunits: 18}, 720, 576},
+		{"interlaced cropped", testSPS{profile: 66, widthmbs: 120, mapunits: 34, crop: [4]uint32{0, 0, 0, 2}}, 1920, 1080},
+		{"poc type 1", testSPS{profile: 66, poctype: 1, widthmbs: 20, mapunits: 15, frameonly: true}, 320, 240},
+		{"poc type 2", testSPS{profile: 66, poctype: 2, widthmbs: 20, mapunits: 15, frameonly: true}, 320, 240},
+	}
+
+	for _, tt := range tests {
+		w, h, err := spsSize(makeSPS(tt.sps))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if w != tt.width || h != tt.height {
+			t.Errorf("%s: got %dx%d, want %dx%d", tt.name, w, h, tt.width, tt.height)
+		}
+	}
+}
+
+func TestSPSEmulationPrevention(t *testing.T) {
+	// a large offset is written with enough zeros to need escaping
+	s := testSPS{profile: 66, poctype: 1, offset: -1 << 26, widthmbs: 20, mapunits: 15, frameonly: true}
+	sps := makeSPS(s)
+	if !bytes.Contains(sps, []byte{0, 0, 3}) {
+		t.Fatalf("no emulation prevention byte in %x", sps)
+	}
+
+	w, h, err := spsSize(sps)
+	if err != nil || w != 320 || h != 240 {
+		t.Errorf("got %dx%d, %v", w, h, err)
+	}
+}
+
+func TestSPSMalformed(t *testing.T) {
+	valid := makeSPS(testSPS{profile: 100, chroma: 1, widthmbs: 120, mapunits: 68, frameonly: true,
+		crop: [4]uint32{0, 0, 0, 4}})
+
+	tests := []struct {
+		name string
+		sps  []byte
+	}{
+		{"empty", nil},
+		{"shorter than its header", []byte{0x67, 0x64, 0x00}},
+		{"short once unescaped", []byte{0x67, 0x00, 0x00, 0x03}},
+		{"header only", valid[:4]},
+		{"cut", valid[:len(valid)-2]},
+		{"cropped to nothing", makeSPS(testSPS{profile: 66, widthmbs: 1, mapunits: 1, frameonly: true,
+			crop: [4]uint32{0, 8, 0, 0}})},
+		{"too wide", makeSPS(testSPS{profile: 66, widthmbs: 4096, mapunits: 1, frameonly: true})},
+	}
+
+	for _, tt := range tests {
+		if w, h, err := spsSize(tt.sps); err != ErrBadSPS {
+			t.Errorf("%s: got %dx%d, %v", tt.name, w, h, err)
+		}
+	}
+}
+
+func TestNewVideoTrack(t *testing.T) {
+	sps := makeSPS(testSPS{profile: 100, chroma: 1, widthmbs: 120, mapunits: 68, frameonly: true,
+		crop: [4]uint32{0, 0, 0, 4}})
+	avcc := makeAVCC(sps)
+
+	tr, err := NewVideoTrack(1, avcc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tr.Video || tr.ID != 1 || tr.Timescale != VIDEO_TIMESCALE {
+		t.Errorf("got track %+v", tr)
+	}
+	if tr.Width != 1920 || tr.Height != 1080 {
+		t.Errorf("got %dx%d", tr.Width, tr.Height)
+	}
+	if codec := tr.Codec(); codec != "avc1.64001f" {
+		t.Errorf("codec %s", codec)
+	}
+	if !bytes.Equal(tr.AVCConfig, avcc) {
+		t.Error("configuration changed")
+	}
+	avcc[0] = 0
+	if tr.AVCConfig[0] != 1 {
+		t.Error("configuration not copied")
+	}
+}
+
+func TestNewVideoTrackMalformed(t *testing.T) {
+	avcc := makeAVCC(makeSPS(testSPS{profile: 66, widthmbs: 80, mapunits: 45, frameonly: true}))
+	nosps := append([]byte(nil), avcc...)
+	nosps[5] = 0xe0
+
+	tests := []struct {
+		name string
+		avcc []byte
+		err  error
+	}{
+		{"shorter than its header", avcc[:7], ErrBadAVCConfig},
+		{"no sps", nosps, ErrBadAVCConfig},
+		{"sps cut", avcc[:10], ErrBadAVCConfig},
+		{"sps short once unescaped", []byte{0x01, 0x00, 0x00, 0x00, 0xff, 0xe1, 0x00, 0x04,
+			0x67, 0x00, 0x00, 0x03}, ErrBadSPS},
+		{"bad sps", makeAVCC([]byte{0x67, 0x42, 0x00, 0x1f, 0x00}), ErrBadSPS},
+	}
+
+	for _, tt := range tests {
+		if tr, err := NewVideoTrack(1, tt.avcc); err != tt.err {
+			t.Errorf("%s: got %+v, %v, want %v", tt.name, tr, err, tt.err)
+		}
+	}
+}
+
+func TestNewAudioTrack(t *testing.T) {
+	tests := []struct {
+		name       string
+		asc        []byte
+		samplerate uint32
+		channels   uint16
+		codec      string
+		err        error
+	}{
+		{"lc 44.1kHz stereo", []byte{0x12, 0x10}, 44100, 2, "mp4a.40.2", nil},
+		{"lc 48kHz stereo", []byte{0x11, 0x90}, 48000, 2, "mp4a.40.2", nil},
+		{"lc 96kHz 5.1", []byte{0x10, 0x30}, 96000, 6, "mp4a.40.2", nil},
+		{"he 24kHz mono", []byte{0x2b, 0x08}, 24000, 1, "mp4a.40.5", nil},
+		{"channels in the program config", []byte{0x12, 0x00}, 44100, 2, "mp4a.40.2", nil},
+		{"no object type", []byte{0x02, 0x10}, 0, 0, "", ErrBadAACConfig},
+		{"escape sample rate", []byte{0x17, 0x90}, 0, 0, "", ErrBadAACConfig},
+		{"reserved sample rate", []byte{0x16, 0x90}, 0, 0, "", ErrBadAACConfig},
+		{"short", []byte{0x12}, 0, 0, "", ErrBadAACConfig},
+	}
+
+	for _, tt := range tests {
+		tr, err := NewAudioTrack(2, tt.asc)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if tr.Video || tr.ID != 2 || tr.Timescale != tt.samplerate {
+			t.Errorf("%s: got track %+v", tt.name, tr)
+		}
+		if tr.SampleRate != tt.samplerate || tr.Channels != tt.channels {
+			t.Errorf("%s: got %dHz %d channels", tt.name, tr.SampleRate, tr.Channels)
+		}
+		if codec := tr.Codec(); codec != tt.codec {
+			t.Errorf("%s: codec %s", tt.name, codec)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+// Package fmp4 writes fragmented MP4 (CMAF): an init segment with the
+// decoder configurations of H.264 and AAC tracks, then moof/mdat fragments.
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// sample flags of trun
+const (
+	SAMPLE_FLAGS_SYNC     = 0x02000000 // depends on no other sample
+	SAMPLE_FLAGS_NON_SYNC = 0x01010000 // depends on others, not a sync sample
+)
+
+type Track struct {
+	ID        uint32
+	Video     bool
+	Timescale uint32
+
+	// video
+	Width     uint16
+	Height    uint16
+	AVCConfig []byte // AVCDecoderConfigurationRecord
+
+	// audio
+	Channels    uint16
+	SampleRate  uint32
+	AudioConfig []byte // AudioSpecificConfig
+}
+
+type Sample struct {
+	Duration uint32 // in the timescale of the track
+	CTS      int32  // pts - dts
+	Sync     bool
+	Data     []byte // length prefixed NAL units or a raw AAC frame
+}
+
+// Fragment is the samples of a track in a moof
+type Fragment struct {
+	Track    *Track
+	BaseTime uint64 // decode time of the first sample
+	Samples  []Sample
+}
+
+// box writes a box whose content is written by f, its size is set after
+func box(b *bytes.Buffer, typ string, f func()) {
+	start := b.Len()
+	b.Write([]byte{0, 0, 0, 0})
+	b.WriteString(typ)
+	f()
+	binary.BigEndian.PutUint32(b.Bytes()[start:], uint32(b.Len()-start))
+}
+
+// fullBox writes a box with a version and flags
+func fullBox(b *bytes.Buffer, typ string, version byte, flags uint32, f func()) {
+	box(b, typ, func() {
+		putU32(b, uint32(version)<<24|flags&0xffffff)
+		f()
+	})
+}
+
+func putU16(b *bytes.Buffer, v uint16) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+func putU32(b *bytes.Buffer, v uint32) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+func putU64(b *bytes.Buffer, v uint64) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+var unity_matrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func putMatrix(b *bytes.Buffer) {
+	for _, v := range unity_matrix {
+		putU32(b, v)
+	}
+}
+
+// WriteInit writes the ftyp and moov of the tracks
+func WriteInit(b *bytes.Buffer, tracks []*Track) {
+	box(b, "ftyp", func() {
+		b.WriteString("iso6")
+		putU32(b, 0)
+		b.WriteString("iso6cmfcmp41")
+	})
+
+	// the ids need not follow each other, an audio only init keeps the
+	// id of the audio track
+	var next uint32 = 1
+	for _, t := range tracks {
+		if t.ID >= next {
+			next = t.ID + 1
+		}
+	}
+
+	box(b, "moov", func() {
+		fullBox(b, "mvhd", 0, 0, func() {
+			putU32(b, 0) // creation time
+			putU32(b, 0) // modification time
+			putU32(b, 1000)
+			putU32(b, 0) // duration
+			putU32(b, 0x00010000)
+			putU16(b, 0x0100)
+			b.Write(make([]byte, 10))
+			putMatrix(b)
+			b.Write(make([]byte, 24))
+			putU32(b, next) // next track id
+		})
+
+		for _, t := range tracks {
+			writeTrak(b, t)
+		}
+
+		box(b, "mvex", func() {
+			for _, t := range tracks {
+				fullBox(b, "trex", 0, 0, func() {
+					putU32(b, t.ID)
+					putU32(b, 1) // sample description
+					putU32(b, 0)
+					putU32(b, 0)
+					putU32(b, 0)
+				})
+			}
+		})
+	})
+}
+
+func writeTrak(b *bytes.Buffer, t *Track) {
+	box(b, "trak", func() {
+		fullBox(b, "tkhd", 0, 0x03, func() {
+			putU32(b, 0)
+			putU32(b, 0)
+			putU32(b, t.ID)
+			putU32(b, 0)
+			putU32(b, 0) // duration
+			b.Write(make([]byte, 8))
+			putU16(b, 0) // layer
+			putU16(b, 0) // alternate group
+			if t.Video {
+				putU16(b, 0)
+			} else {
+				putU16(b, 0x0100)
+			}
+			putU16(b, 0)
+			putMatrix(b)
+			putU32(b, uint32(t.Width)<<16)
+			putU32(b, uint32(t.Height)<<16)
+		})
+
+		box(b, "mdia", func() {
+			fullBox(b, "mdhd", 0, 0, func() {
+				putU32(b, 0)
+				putU32(b, 0)
+				putU32(b, t.Timescale)
+				putU32(b, 0)
+				putU16(b, 0x55c4) // und
+				putU16(b, 0)
+			})
+
+			fullBox(b, "hdlr", 0, 0, func() {
+				putU32(b, 0)
+				if t.Video {
+					b.WriteString("vide")
+				} else {
+					b.WriteString("soun")
+				}
+				b.Write(make([]byte, 12))
+				if t.Video {
+					b.WriteString("VideoHandler\x00")
+				} else {
+					b.WriteString("SoundHandler\x00")
+				}
+			})
+
+			box(b, "minf", func() {
+				if t.Video {
+					fullBox(b, "vmhd", 0, 1, func() {
+						b.Write(make([]byte, 8))
+					})
+				} else {
+					fullBox(b, "smhd", 0, 0, func() {
+						putU32(b, 0)
+					})
+				}
+
+				box(b, "dinf", func() {
+					fullBox(b, "dref", 0, 0, func() {
+						putU32(b, 1)
+						fullBox(b, "url ", 0, 1, func() {})
+					})
+				})
+
+				box(b, "stbl", func() {
+					fullBox(b, "stsd", 0, 0, func() {
+						putU32(b, 1)
+						if t.Video {
+							writeAVC1(b, t)
+						} else {
+							writeMP4A(b, t)
+						}
+					})
+					// the samples are in the fragments
+					fullBox(b, "stts", 0, 0, func() { putU32(b, 0) })
+					fullBox(b, "stsc", 0, 0, func() { putU32(b, 0) })
+					fullBox(b, "stsz", 0, 0, func() { putU32(b, 0); putU32(b, 0) })
+					fullBox(b, "stco", 0, 0, func() { putU32(b, 0) })
+				})
+			})
+		})
+	})
+}
+
+func writeAVC1(b *bytes.Buffer, t *Track) {
+	box(b, "avc1", func() {
+		b.Write(make([]byte, 6))
+		putU16(b, 1) // data reference
+		b.Write(make([]byte, 16))
+		putU16(b, t.Width)
+		putU16(b, t.Height)
+		putU32(b, 0x00480000) // 72 dpi
+		putU32(b, 0x00480000)
+		putU32(b, 0)
+		putU16(b, 1) // frame count
+		b.Write(make([]byte, 32))
+		putU16(b, 0x0018)
+		putU16(b, 0xffff)
+		box(b, "avcC", func() {
+			b.Write(t.AVCConfig)
+		})
+	})
+}
+
+// descriptor writes an MPEG-4 descriptor of esds, sizes fit in one byte
+func descriptor(b *bytes.Buffer, tag byte, f func()) {
+	b.WriteByte(tag)
+	start := b.Len()
+	b.WriteByte(0)
+	f()
+	b.Bytes()[start] = byte(b.Len() - start - 1)
+}
+
+func writeMP4A(b *bytes.Buffer, t *Track) {
+	box(b, "mp4a", func() {
+		b.Write(make([]byte, 6))
+		putU16(b, 1)
+		b.Write(make([]byte, 8))
+		putU16(b, t.Channels)
+		putU16(b, 16) // sample size
+		putU32(b, 0)
+		// 16.16 fixed point, 88.2 and 96kHz don't fit and are left to the
+		// AudioSpecificConfig
+		if t.SampleRate <= 0xffff {
+			putU32(b, t.SampleRate<<16)
+		} else {
+			putU32(b, 0)
+		}
+		fullBox(b, "esds", 0, 0, func() {
+			descriptor(b, 0x03, func() {
+				putU16(b, uint16(t.ID))
+				b.WriteByte(0)
+				descriptor(b, 0x04, func() {
+					b.WriteByte(0x40) // mpeg-4 audio
+					b.WriteByte(0x15) // audio stream
+					b.Write([]byte{0, 0, 0})
+					putU32(b, 0) // max bitrate
+					putU32(b, 0) // avg bitrate
+					descriptor(b, 0x05, func() {
+						b.Write(t.AudioConfig)
+					})
+				})
+				descriptor(b, 0x06, func() {
+					b.WriteByte(0x02)
+				})
+			})
+		})
+	})
+}
+
+// WriteFragment writes a moof with a traf for each fragment and the mdat
+// of their samples
+func WriteFragment(b *bytes.Buffer, seq uint32, frags []Fragment) {
+	moofstart := b.Len()
+	var offsets []int // positions of the trun data offsets
+
+	box(b, "moof", func() {
+		fullBox(b, "mfhd", 0, 0, func() {
+			putU32(b, seq)
+		})
+
+		for _, f := range frags {
+			box(b, "traf", func() {
+				// the data offsets are from the moof
+				fullBox(b, "tfhd", 0, 0x020000, func() {
+					putU32(b, f.Track.ID)
+				})
+				fullBox(b, "tfdt", 1, 0, func() {
+					putU64(b, f.BaseTime)
+				})
+				// data offset, durations, sizes, flags and signed cts
+				fullBox(b, "trun", 1, 0x000f01, func() {
+					putU32(b, uint32(len(f.Samples)))
+					offsets = append(offsets, b.Len())
+					putU32(b, 0)
+					for _, s := range f.Samples {
+						putU32(b, s.Duration)
+						putU32(b, uint32(len(s.Data)))
+						if s.Sync {
+							putU32(b, SAMPLE_FLAGS_SYNC)
+						} else {
+							putU32(b, SAMPLE_FLAGS_NON_SYNC)
+						}
+						putU32(b, uint32(s.CTS))
+					}
+				})
+			})
+		}
+	})
+
+	// mdat header then the samples of each traf in turn
+	dataoffset := b.Len() - moofstart + 8
+	for i, f := range frags {
+		binary.BigEndian.PutUint32(b.Bytes()[offsets[i]:], uint32(dataoffset))
+		for _, s := range f.Samples {
+			dataoffset += len(s.Data)
+		}
+	}
+
+	box(b, "mdat", func() {
+		for _, f := range frags {
+			for _, s := range f.Samples {
+				b.Write(s.Data)
+			}
+		}
+	})
+}
@@ -0,0 +1,297 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type testBox struct {
+	typ  string
+	data []byte // after the header
+	off  int    // of the box in what was parsed
+}
+
+// readBoxes splits b in boxes and checks their sizes
+func readBoxes(t *testing.T, b []byte) []testBox {
+	t.Helper()
+	var boxes []testBox
+	for off := 0; off < len(b); {
+		if len(b)-off < 8 {
+			t.Fatalf("%d bytes left for a box header", len(b)-off)
+		}
+		size := int(binary.BigEndian.Uint32(b[off:]))
+		if size < 8 || off+size > len(b) {
+			t.Fatalf("box %q of size %d at %d of %d", b[off+4:off+8], size, off, len(b))
+		}
+		boxes = append(boxes, testBox{string(b[off+4 : off+8]), b[off+8 : off+size], off})
+		off += size
+	}
+	return boxes
+}
+
+// children gives the boxes of a path, each element after the first is
+// looked for in the content of the former one, past the fields of the
+// sample description and of the sample entries
+func children(t *testing.T, b []byte, path ...string) []testBox {
+	t.Helper()
+	var found []testBox
+	for _, box := range readBoxes(t, b) {
+		if box.typ != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			found = append(found, box)
+			continue
+		}
+		data := box.data
+		switch box.typ {
+		case "stsd":
+			data = data[8:] // version, flags and count
+		case "avc1":
+			data = data[78:]
+		case "mp4a":
+			data = data[28:]
+		}
+		found = append(found, children(t, data, path[1:]...)...)
+	}
+	return found
+}
+
+// child gives the only box of a path
+func child(t *testing.T, b []byte, path ...string) []byte {
+	t.Helper()
+	boxes := children(t, b, path...)
+	if len(boxes) != 1 {
+		t.Fatalf("%d boxes %v", len(boxes), path)
+	}
+	return boxes[0].data
+}
+
+func testTracks(t *testing.T) (*Track, *Track) {
+	t.Helper()
+	sps := makeSPS(testSPS{profile: 100, chroma: 1, widthmbs: 80, mapunits: 45, frameonly: true})
+	video, err := NewVideoTrack(1, makeAVCC(sps))
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := NewAudioTrack(2, []byte{0x11, 0x90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video, audio
+}
+
+func TestWriteInit(t *testing.T) {
+	video, audio := testTracks(t)
+	var b bytes.Buffer
+	WriteInit(&b, []*Track{video, audio})
+
+	boxes := readBoxes(t, b.Bytes())
+	if len(boxes) != 2 || boxes[0].typ != "ftyp" || boxes[1].typ != "moov" {
+		t.Fatalf("top level boxes %v", boxes)
+	}
+	moov := b.Bytes()[boxes[1].off:]
+
+	mvhd := child(t, moov, "moov", "mvhd")
+	if next := binary.BigEndian.Uint32(mvhd[len(mvhd)-4:]); next != 3 {
+		t.Errorf("next track id %d", next)
+	}
+
+	traks := children(t, moov, "moov", "trak")
+	if len(traks) != 2 {
+		t.Fatalf("%d traks", len(traks))
+	}
+	trexs := children(t, moov, "moov", "mvex", "trex")
+	if len(trexs) != 2 {
+		t.Fatalf("%d trexs", len(trexs))
+	}
+
+	for i, tr := range []*Track{video, audio} {
+		tkhd := child(t, traks[i].data, "tkhd")
+		if id := binary.BigEndian.Uint32(tkhd[12:]); id != tr.ID {
+			t.Errorf("track %d: tkhd id %d", tr.ID, id)
+		}
+		w, h := binary.BigEndian.Uint32(tkhd[76:]), binary.BigEndian.Uint32(tkhd[80:])
+		if w != uint32(tr.Width)<<16 || h != uint32(tr.Height)<<16 {
+			t.Errorf("track %d: tkhd size %x %x", tr.ID, w, h)
+		}
+
+		mdhd := child(t, traks[i].data, "mdia", "mdhd")
+		if ts := binary.BigEndian.Uint32(mdhd[12:]); ts != tr.Timescale {
+			t.Errorf("track %d: timescale %d", tr.ID, ts)
+		}
+
+		hdlr := child(t, traks[i].data, "mdia", "hdlr")
+		handler := "soun"
+		if tr.Video {
+			handler = "vide"
+		}
+		if string(hdlr[8:12]) != handler {
+			t.Errorf("track %d: handler %q", tr.ID, hdlr[8:12])
+		}
+
+		if id := binary.BigEndian.Uint32(trexs[i].data[4:]); id != tr.ID {
+			t.Errorf("track %d: trex id %d", tr.ID, id)
+		}
+	}
+
+	avc1 := child(t, traks[0].data, "mdia", "minf", "stbl", "stsd", "avc1")
+	if w, h := binary.BigEndian.Uint16(avc1[24:]), binary.BigEndian.Uint16(avc1[26:]); w != 1280 || h != 720 {
+		t.Errorf("avc1 size %dx%d", w, h)
+	}
+	avcc := child(t, traks[0].data, "mdia", "minf", "stbl", "stsd", "avc1", "avcC")
+	if !bytes.Equal(avcc, video.AVCConfig) {
+		t.Errorf("avcC %x, want %x", avcc, video.AVCConfig)
+	}
+
+	mp4a := child(t, traks[1].data, "mdia", "minf", "stbl", "stsd", "mp4a")
+	if ch := binary.BigEndian.Uint16(mp4a[16:]); ch != 2 {
+		t.Errorf("mp4a channels %d", ch)
+	}
+	esds := child(t, traks[1].data, "mdia", "minf", "stbl", "stsd", "mp4a", "esds")
+	// the DecoderSpecificInfo descriptor ends the DecoderConfigDescriptor
+	dsi := append([]byte{0x05, byte(len(audio.AudioConfig))}, audio.AudioConfig...)
+	if !bytes.Contains(esds, dsi) {
+		t.Errorf("esds %x without the AudioSpecificConfig", esds)
+	}
+}
+
+func TestWriteInitNextTrackID(t *testing.T) {
+	video, audio := testTracks(t)
+	tests := []struct {
+		name   string
+		tracks []*Track
+		next   uint32
+	}{
+		{"video and audio", []*Track{video, audio}, 3},
+		{"audio and video", []*Track{audio, video}, 3},
+		{"video only", []*Track{video}, 2},
+		{"audio only", []*Track{audio}, 3},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+		WriteInit(&b, tt.tracks)
+		mvhd := child(t, b.Bytes(), "moov", "mvhd")
+		if next := binary.BigEndian.Uint32(mvhd[len(mvhd)-4:]); next != tt.next {
+			t.Errorf("%s: next track id %d, want %d", tt.name, next, tt.next)
+		}
+	}
+}
+
+func TestMP4ASampleRate(t *testing.T) {
+	tests := []struct {
+		asc   []byte
+		field uint32
+	}{
+		{[]byte{0x15, 0x90}, 8000 << 16},
+		{[]byte{0x12, 0x10}, 44100 << 16},
+		{[]byte{0x11, 0x90}, 48000 << 16},
+		{[]byte{0x10, 0x90}, 0}, // 88.2kHz
+		{[]byte{0x10, 0x10}, 0}, // 96kHz
+	}
+
+	for _, tt := range tests {
+		tr, err := NewAudioTrack(1, tt.asc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		WriteInit(&b, []*Track{tr})
+
+		mp4a := child(t, b.Bytes(), "moov", "trak", "mdia", "minf", "stbl", "stsd", "mp4a")
+		if field := binary.BigEndian.Uint32(mp4a[24:]); field != tt.field {
+			t.Errorf("%dHz: sample rate field 0x%08x, want 0x%08x", tr.SampleRate, field, tt.field)
+		}
+	}
+}
+
+func TestWriteFragment(t *testing.T) {
+	video, audio := testTracks(t)
+	frags := []Fragment{
+		{Track: video, BaseTime: 1 << 33, Samples: []Sample{
+			{Duration: 3000, CTS: 6000, Sync: true, Data: []byte{1, 2, 3}},
+			{Duration: 3000, CTS: -3000, Data: []byte{4, 5}},
+			{Duration: 0, Data: []byte{6}},
+		}},
+		{Track: audio, BaseTime: 48000, Samples: []Sample{
+			{Duration: 1024, Sync: true, Data: []byte{7, 8, 9, 10}},
+			{Duration: 1024, Sync: true, Data: []byte{11}},
+		}},
+	}
+
+	var b bytes.Buffer
+	b.WriteString("before")
+	WriteFragment(&b, 7, frags)
+	out := b.Bytes()[len("before"):]
+
+	boxes := readBoxes(t, out)
+	if len(boxes) != 2 || boxes[0].typ != "moof" || boxes[1].typ != "mdat" {
+		t.Fatalf("top level boxes %v", boxes)
+	}
+
+	mfhd := child(t, out, "moof", "mfhd")
+	if seq := binary.BigEndian.Uint32(mfhd[4:]); seq != 7 {
+		t.Errorf("sequence %d", seq)
+	}
+
+	trafs := children(t, out, "moof", "traf")
+	if len(trafs) != len(frags) {
+		t.Fatalf("%d trafs", len(trafs))
+	}
+
+	for i, f := range frags {
+		tfhd := child(t, trafs[i].data, "tfhd")
+		if flags := binary.BigEndian.Uint32(tfhd); flags != 0x020000 {
+			t.Errorf("traf %d: tfhd flags 0x%x", i, flags)
+		}
+		if id := binary.BigEndian.Uint32(tfhd[4:]); id != f.Track.ID {
+			t.Errorf("traf %d: track %d", i, id)
+		}
+
+		tfdt := child(t, trafs[i].data, "tfdt")
+		if tfdt[0] != 1 || binary.BigEndian.Uint64(tfdt[4:]) != f.BaseTime {
+			t.Errorf("traf %d: tfdt %x", i, tfdt)
+		}
+
+		trun := child(t, trafs[i].data, "trun")
+		if vf := binary.BigEndian.Uint32(trun); vf != 0x01000f01 {
+			t.Errorf("traf %d: trun version and flags 0x%x", i, vf)
+		}
+		if n := binary.BigEndian.Uint32(trun[4:]); n != uint32(len(f.Samples)) {
+			t.Fatalf("traf %d: %d samples", i, n)
+		}
+
+		// the data offset is from the moof to the samples in the mdat
+		offset := int(binary.BigEndian.Uint32(trun[8:]))
+		for j, s := range f.Samples {
+			e := trun[12+16*j:]
+			if d := binary.BigEndian.Uint32(e); d != s.Duration {
+				t.Errorf("traf %d sample %d: duration %d", i, j, d)
+			}
+			if size := binary.BigEndian.Uint32(e[4:]); size != uint32(len(s.Data)) {
+				t.Errorf("traf %d sample %d: size %d", i, j, size)
+			}
+			flags := uint32(SAMPLE_FLAGS_NON_SYNC)
+			if s.Sync {
+				flags = SAMPLE_FLAGS_SYNC
+			}
+			if fl := binary.BigEndian.Uint32(e[8:]); fl != flags {
+				t.Errorf("traf %d sample %d: flags 0x%x", i, j, fl)
+			}
+			if cts := int32(binary.BigEndian.Uint32(e[12:])); cts != s.CTS {
+				t.Errorf("traf %d sample %d: cts %d", i, j, cts)
+			}
+
+			if offset+len(s.Data) > len(out) || !bytes.Equal(out[offset:offset+len(s.Data)], s.Data) {
+				t.Errorf("traf %d sample %d: no data at %d", i, j, offset)
+			}
+			offset += len(s.Data)
+		}
+	}
+
+	if !bytes.Equal(boxes[1].data, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}) {
+		t.Errorf("mdat %x", boxes[1].data)
+	}
+}
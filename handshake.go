@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"time"
+)
+
+const (
+	RTMP_HS_PACKET_SIZE = 1536
+	RTMP_HS_DIGEST_SIZE = 32
+	RTMP_HS_SERVER_VER  = 0x04050001 // version we announce in s1
+)
+
+// complex handshake schemas: where the digest block is in c1/s1
+const (
+	RTMP_HS_SCHEMA0 = 0 // key block first, then digest block
+	RTMP_HS_SCHEMA1 = 1 // digest block first, then key block
+)
+
+var genuineKeySuffix = []byte{
+	0xf0, 0xee, 0xc2, 0x4a, 0x80, 0x68, 0xbe, 0xe8,
+	0x2e, 0x00, 0xd0, 0xd1, 0x02, 0x9e, 0x7e, 0x57,
+	0x6e, 0xec, 0x5d, 0x2d, 0x29, 0x80, 0x6f, 0xab,
+	0x93, 0xb8, 0xe6, 0x36, 0xcf, 0xeb, 0x31, 0xae,
+}
+
+// the client digest is keyed with the first 30 bytes, the server digest
+// with the first 36 bytes, s2 with the whole keys
+var genuineFPKey = append([]byte("Genuine Adobe Flash Player 001"), genuineKeySuffix...)
+var genuineFMSKey = append([]byte("Genuine Adobe Flash Media Server 001"), genuineKeySuffix...)
+
+// hsDigestOffset gives the position of the 32 bytes digest in a c1/s1
+// packet. The 764 bytes digest block starts with 4 bytes whose sum gives
+// the offset of the digest in the block.
+func hsDigestOffset(b []byte, schema int) int {
+	base := 8
+	if schema == RTMP_HS_SCHEMA0 {
+		base = 8 + 764
+	}
+
+	sum := int(b[base]) + int(b[base+1]) + int(b[base+2]) + int(b[base+3])
+	return base + 4 + sum%728
+}
+
+// hsMakeDigest computes the hmac of b without the digest at offset, or of
+// the whole b if offset < 0
+func hsMakeDigest(key []byte, b []byte, offset int) []byte {
+	h := hmac.New(sha256.New, key)
+	if offset < 0 {
+		h.Write(b)
+	} else {
+		h.Write(b[:offset])
+		h.Write(b[offset+RTMP_HS_DIGEST_SIZE:])
+	}
+	return h.Sum(nil)
+}
+
+// hsValidateC1 looks for a valid client digest with each schema
+func hsValidateC1(c1 []byte) (bool, int, []byte) {
+	for _, schema := range []int{RTMP_HS_SCHEMA0, RTMP_HS_SCHEMA1} {
+		offset := hsDigestOffset(c1, schema)
+		digest := hsMakeDigest(genuineFPKey[:30], c1, offset)
+		if bytes.Equal(digest, c1[offset:offset+RTMP_HS_DIGEST_SIZE]) {
+			return true, schema, digest
+		}
+	}
+
+	return false, 0, nil
+}
+
+// hsCreateComplexS1S2 signs s1 with the schema of c1, s2 is signed with a
+// key derived from the client digest
+func hsCreateComplexS1S2(schema int, c1digest []byte) ([]byte, []byte) {
+	s1 := make([]byte, RTMP_HS_PACKET_SIZE)
+	rand.Read(s1[8:])
+	binary.BigEndian.PutUint32(s1[0:], uint32(time.Now().Unix()))
+	binary.BigEndian.PutUint32(s1[4:], RTMP_HS_SERVER_VER)
+
+	offset := hsDigestOffset(s1, schema)
+	copy(s1[offset:], hsMakeDigest(genuineFMSKey[:36], s1, offset))
+
+	s2 := make([]byte, RTMP_HS_PACKET_SIZE)
+	rand.Read(s2)
+	key := hsMakeDigest(genuineFMSKey, c1digest, -1)
+	digestpos := RTMP_HS_PACKET_SIZE - RTMP_HS_DIGEST_SIZE
+	copy(s2[digestpos:], hsMakeDigest(key, s2[:digestpos], -1))
+
+	return s1, s2
+}
+
+// hsCreateSimpleS1S2 creates a random s1 and echoes c1 in s2
+func hsCreateSimpleS1S2(c1 []byte) ([]byte, []byte) {
+	s1 := make([]byte, RTMP_HS_PACKET_SIZE)
+	rand.Read(s1[8:])
+	binary.BigEndian.PutUint32(s1[0:], uint32(time.Now().Unix()))
+
+	s2 := make([]byte, RTMP_HS_PACKET_SIZE)
+	copy(s2, c1)
+	// time the c1 was read
+	binary.BigEndian.PutUint32(s2[4:], uint32(time.Now().Unix()))
+
+	return s1, s2
+}
+
+// hsCreateS1S2 answers a complex c1 with digests, falling back to the
+// simple handshake if c1 has no version or no valid digest
+func hsCreateS1S2(c1 []byte) ([]byte, []byte) {
+	if binary.BigEndian.Uint32(c1[4:8]) != 0 {
+		if ok, schema, digest := hsValidateC1(c1); ok {
+			log.Printf("complex handshake, schema=%d\n", schema)
+			return hsCreateComplexS1S2(schema, digest)
+		}
+		log.Println("fail to validate c1 digest, use simple handshake")
+	}
+
+	return hsCreateSimpleS1S2(c1)
+}
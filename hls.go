@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go_rtmp_srv/ts"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HLSConf struct {
+	enabled    bool
+	target     time.Duration // segment duration, cut on the next key frame
+	window     int           // segments in the playlist
+	lowlatency bool          // fMP4 segments made of parts, LL-HLS
+	part       time.Duration // part duration, cut on any frame
+}
+
+var default_hls_conf = HLSConf{
+	enabled: true,
+	target:  4 * time.Second,
+	window:  5,
+	part:    500 * time.Millisecond,
+}
+
+// segments kept out of the playlist for the players still loading them
+const HLS_EXTRA_SEGMENTS = 2
+
+// flv timestamps are in ms
+const HLS_CLOCK_PER_MS = ts.TS_CLOCK_RATE / 1000
+
+type hlsSegment struct {
+	seq           int
+	duration      float64 // seconds
+	discontinuity bool
+	data          []byte
+}
+
+// hlsPackager is a muxer of a stream served as HLS
+type hlsPackager interface {
+	run(pi *PullInfo)
+	// file is what follows stream- in the path, empty for the playlist
+	serve(w http.ResponseWriter, r *http.Request, file string)
+}
+
+// HLSMuxer cuts a stream in MPEG-TS segments and keeps a sliding window of
+// them in memory, it reads the stream as a pull node
+type HLSMuxer struct {
+	name string // app/stream
+	conf HLSConf
+
+	// owned by the muxer goroutine
+	avc      *ts.AVCConfig
+	aac      *ts.AACConfig
+	mux      *ts.Muxer
+	cur      bytes.Buffer // segment being written
+	curstart uint32       // dts of its first frame, in ms
+	curdisc  bool
+	lastdts  uint32
+	started  bool
+
+	// protects the fields below, taken by the http handlers
+	lock     sync.Mutex
+	segments []hlsSegment
+	nextseq  int
+	ended    bool
+}
+
+func NewHLSMuxer(name string, conf HLSConf) *HLSMuxer {
+	m := new(HLSMuxer)
+	m.name = name
+	m.conf = conf
+	// one muxer for all the segments, its continuity counters go on
+	m.mux = ts.NewMuxer(&m.cur, false, false)
+	return m
+}
+
+// run feeds the muxer from the stream until it ends
+func (m *HLSMuxer) run(pi *PullInfo) {
+	for _, tag := range pi.takeReplay() {
+		m.handleTag(tag)
+	}
+
+	for {
+		tag, status := pi.Next(nil)
+		if status != PULL_OK {
+			break
+		}
+		m.handleTag(tag)
+	}
+
+	m.flush(m.lastdts)
+	m.lock.Lock()
+	m.ended = true
+	m.lock.Unlock()
+	log.Printf("hls %s ended\n", m.name)
+}
+
+func (m *HLSMuxer) handleTag(tag bytes.Buffer) {
+	ret, fh, body := ParseFlvTag(tag.Bytes())
+	if !ret || len(body) < 2 {
+		return
+	}
+	dts := fh.ts | uint32(fh.exts)<<24
+
+	switch fh.t {
+	case RTMP_MSG_TYPEID_VIDEO_PKT:
+		if body[0]&FLV_EX_HEADER != 0 || body[0]&0x0f != FLV_CODEC_AVC || len(body) < 5 {
+			return
+		}
+
+		if isVideoSeqHeader(body) {
+			avc, err := ts.ParseAVCConfig(body[5:])
+			if err != nil {
+				log.Println("hls:", err)
+				return
+			}
+			m.avc = avc
+			m.setTracks()
+			return
+		}
+
+		if m.avc == nil {
+			return
+		}
+
+		// composition time, signed 24 bits
+		cts := int32(uint32(body[2])<<16|uint32(body[3])<<8|uint32(body[4])) << 8 >> 8
+		keyframe := isKeyFrame(body)
+		if !m.cut(dts, keyframe) {
+			return
+		}
+
+		pts := int64(dts) + int64(cts)
+		if pts < int64(dts) {
+			pts = int64(dts)
+		}
+		m.mux.WriteVideo(uint64(pts)*HLS_CLOCK_PER_MS, uint64(dts)*HLS_CLOCK_PER_MS,
+			keyframe, m.avc.AnnexB(body[5:], keyframe))
+	case RTMP_MSG_TYPEID_AUDIO_PKT:
+		if body[0]>>4 != FLV_SOUND_AAC {
+			return
+		}
+
+		if isAudioSeqHeader(body) {
+			aac, err := ts.ParseAACConfig(body[2:])
+			if err != nil {
+				log.Println("hls:", err)
+				return
+			}
+			m.aac = aac
+			m.setTracks()
+			return
+		}
+
+		if m.aac == nil {
+			return
+		}
+
+		// an audio only stream is cut on any frame
+		if !m.cut(dts, m.avc == nil) {
+			return
+		}
+		m.mux.WriteAudio(uint64(dts)*HLS_CLOCK_PER_MS, m.aac.ADTS(body[2:]))
+	}
+}
+
+// setTracks announces the tracks known so far, one coming in the middle of
+// a segment gets new tables before its first frame
+func (m *HLSMuxer) setTracks() {
+	if m.mux.SetTracks(m.avc != nil, m.aac != nil) && m.started {
+		m.mux.WriteTables()
+	}
+}
+
+// cut starts a new segment on a key frame once the target duration is
+// reached, it tells whether the frame can be written
+func (m *HLSMuxer) cut(dts uint32, keyframe bool) bool {
+	// the publisher reset its clock
+	disc := m.started && (int64(dts)+FLV_TS_MAX_BACKWARD < int64(m.lastdts) ||
+		int64(dts) > int64(m.lastdts)+FLV_TS_MAX_FORWARD)
+	if disc {
+		log.Printf("hls %s: timestamp jumps from %d to %d\n", m.name, m.lastdts, dts)
+	}
+
+	if !m.started && !keyframe {
+		return false
+	}
+
+	target := uint32(m.conf.target / time.Millisecond)
+	if !m.started || disc && keyframe || keyframe && dts-m.curstart >= target {
+		// a segment lasts up to the next one, unless the clock was reset
+		if m.started && disc {
+			m.flush(m.lastdts)
+		} else if m.started {
+			m.flush(dts)
+		}
+
+		m.started = true
+		m.curstart = dts
+		m.curdisc = disc
+		m.mux.WriteTables()
+	}
+
+	m.lastdts = dts
+	return true
+}
+
+// flush closes the current segment and slides the window
+func (m *HLSMuxer) flush(enddts uint32) {
+	if m.cur.Len() == 0 {
+		return
+	}
+
+	var seg hlsSegment
+	seg.duration = float64(enddts-m.curstart) / 1000
+	seg.discontinuity = m.curdisc
+	seg.data = make([]byte, m.cur.Len())
+	copy(seg.data, m.cur.Bytes())
+	m.cur.Reset()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	seg.seq = m.nextseq
+	m.nextseq++
+	m.segments = append(m.segments, seg)
+	if len(m.segments) > m.conf.window+HLS_EXTRA_SEGMENTS {
+		m.segments = m.segments[1:]
+	}
+}
+
+// Playlist gives the live playlist of the latest segments
+func (m *HLSMuxer) Playlist() (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	segs := m.segments
+	if len(segs) > m.conf.window {
+		segs = segs[len(segs)-m.conf.window:]
+	}
+	if len(segs) == 0 {
+		return "", false
+	}
+
+	target := m.conf.target.Seconds()
+	for _, seg := range segs {
+		target = math.Max(target, seg.duration)
+	}
+
+	base := path.Base(m.name)
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segs[0].seq)
+	for _, seg := range segs {
+		if seg.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", seg.duration)
+		fmt.Fprintf(&b, "%s-%d.ts\n", base, seg.seq)
+	}
+	if m.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	return b.String(), true
+}
+
+func (m *HLSMuxer) Segment(seq int) ([]byte, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, seg := range m.segments {
+		if seg.seq == seq {
+			return seg.data, true
+		}
+	}
+	return nil, false
+}
+
+// serve answers the playlist and the N.ts segments
+func (m *HLSMuxer) serve(w http.ResponseWriter, r *http.Request, file string) {
+	if file == "" {
+		playlist, ok := m.Playlist()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(playlist))
+		return
+	}
+
+	seq, err := strconv.Atoi(strings.TrimSuffix(file, ".ts"))
+	if err != nil || !strings.HasSuffix(file, ".ts") {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, ok := m.Segment(seq)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Write(data)
+}
+
+// HLSServer keeps the muxers of the published streams, by app/stream
+type HLSServer struct {
+	lock   sync.Mutex
+	conf   HLSConf
+	muxers map[string]hlsPackager
+}
+
+func NewHLSServer() *HLSServer {
+	hs := new(HLSServer)
+	hs.conf = default_hls_conf
+	hs.muxers = make(map[string]hlsPackager)
+	return hs
+}
+
+var hls = NewHLSServer()
+
+func (hs *HLSServer) SetConf(conf HLSConf) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	hs.conf = conf
+}
+
+// onStreamEvent starts a muxer for each new stream, it's kept a while
+// after the stream ended for the players to get the last segments
+func (hs *HLSServer) onStreamEvent(event int, ls *LiveStream) {
+	if event != STREAM_EVENT_CREATED {
+		return
+	}
+
+	hs.lock.Lock()
+	conf := hs.conf
+	hs.lock.Unlock()
+	if !conf.enabled {
+		return
+	}
+
+	name := path.Join(ls.app, ls.name)
+
+	cn := NewClientNode(nil, 0)
+	cn.addr = "hls"
+	_, pi, ok := streams.Subscribe(ls.app, ls.name, cn)
+	if !ok {
+		return
+	}
+
+	var m hlsPackager
+	if conf.lowlatency {
+		m = NewLLHLSMuxer(name, conf)
+	} else {
+		m = NewHLSMuxer(name, conf)
+	}
+	hs.lock.Lock()
+	hs.muxers[name] = m
+	hs.lock.Unlock()
+	log.Printf("hls %s started\n", name)
+
+	go func() {
+		m.run(pi)
+		streams.Unsubscribe(ls, cn)
+
+		linger := time.Duration(conf.window) * conf.target
+		time.AfterFunc(linger, func() {
+			hs.lock.Lock()
+			defer hs.lock.Unlock()
+			if hs.muxers[name] == m {
+				delete(hs.muxers, name)
+			}
+		})
+	}()
+}
+
+func (hs *HLSServer) lookup(name string) (hlsPackager, bool) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	m, ok := hs.muxers[name]
+	return m, ok
+}
+
+// ServeHTTP serves /app/stream.m3u8 and the files of its muxer, named
+// /app/stream-file
+func (hs *HLSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+
+	name, file := strings.TrimSuffix(p, ".m3u8"), ""
+	if !strings.HasSuffix(p, ".m3u8") {
+		i := strings.LastIndex(p, "-")
+		if i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		name, file = p[:i], p[i+1:]
+	}
+
+	m, ok := hs.lookup(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	m.serve(w, r, file)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a segment older than this many target durations can be skipped in a
+// delta playlist
+const LLHLS_SKIP_TARGETS = 6
+
+// parts are listed for the segments of the last target durations
+const LLHLS_PART_TARGETS = 3
+
+type llPart struct {
+	duration    float64
+	independent bool
+	data        []byte
+}
+
+type llSegment struct {
+	seq           int
+	duration      float64
+	discontinuity bool
+	initver       int
+	parts         []llPart
+	complete      bool
+	data          []byte // the parts, once complete
+}
+
+// LLHLSMuxer cuts a stream in fMP4 segments made of parts and keeps a
+// sliding window of them in memory. The playlist requests can wait for a
+// part to come, the parts are listed as soon as they are written.
+type LLHLSMuxer struct {
+	name string // app/stream
+	conf HLSConf
+	frag *CMAFFragmenter
+
+	// protects the fields below, taken by the http handlers
+	lock     sync.Mutex
+	inits    map[int][]byte
+	segments []*llSegment // the last one may be in progress
+	nextseq  int
+	ended    bool
+	signal   chan struct{} // closed and replaced on each new part
+}
+
+func NewLLHLSMuxer(name string, conf HLSConf) *LLHLSMuxer {
+	m := new(LLHLSMuxer)
+	m.name = name
+	m.conf = conf
+	m.frag = NewCMAFFragmenter(name, conf.target, conf.part, m.addPart)
+	m.inits = make(map[int][]byte)
+	m.signal = make(chan struct{})
+	return m
+}
+
+// run feeds the muxer from the stream until it ends
+func (m *LLHLSMuxer) run(pi *PullInfo) {
+	for _, tag := range pi.takeReplay() {
+		m.frag.handleTag(tag)
+	}
+
+	for {
+		tag, status := pi.Next(nil)
+		if status != PULL_OK {
+			break
+		}
+		m.frag.handleTag(tag)
+	}
+
+	m.frag.Close()
+	m.lock.Lock()
+	m.ended = true
+	close(m.signal)
+	m.lock.Unlock()
+	log.Printf("ll-hls %s ended\n", m.name)
+}
+
+// addPart adds a part to the current segment, it's called by the
+// fragmenter
+func (m *LLHLSMuxer) addPart(f *CMAFFragment) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var seg *llSegment
+	if n := len(m.segments); n > 0 && !m.segments[n-1].complete {
+		seg = m.segments[n-1]
+	} else {
+		seg = &llSegment{seq: m.nextseq, discontinuity: f.discontinuity, initver: f.initver}
+		m.nextseq++
+		if _, ok := m.inits[f.initver]; !ok {
+			m.inits[f.initver] = cmafInit(f.tracks...)
+		}
+		m.segments = append(m.segments, seg)
+	}
+
+	seg.parts = append(seg.parts, llPart{f.duration, f.independent, f.mux()})
+	seg.duration += f.duration
+
+	if f.last {
+		seg.complete = true
+		for _, p := range seg.parts {
+			seg.data = append(seg.data, p.data...)
+		}
+
+		if len(m.segments) > m.conf.window+HLS_EXTRA_SEGMENTS {
+			m.segments = m.segments[1:]
+			for v := range m.inits {
+				if v < m.segments[0].initver {
+					delete(m.inits, v)
+				}
+			}
+		}
+	}
+
+	close(m.signal)
+	m.signal = make(chan struct{})
+}
+
+// available tells whether the part of the segment msn is there, a negative
+// part is the whole segment
+func (m *LLHLSMuxer) available(msn, part int) bool {
+	if m.ended {
+		return true
+	}
+	if len(m.segments) == 0 {
+		return false
+	}
+
+	last := m.segments[len(m.segments)-1]
+	if msn != last.seq {
+		return msn < last.seq
+	}
+	return last.complete || part >= 0 && part < len(last.parts)
+}
+
+// wait blocks until the part of the segment msn is there, at most for
+// three target durations
+func (m *LLHLSMuxer) wait(r *http.Request, msn, part int) bool {
+	timeout := time.NewTimer(3 * m.conf.target)
+	defer timeout.Stop()
+
+	for {
+		m.lock.Lock()
+		if m.available(msn, part) {
+			m.lock.Unlock()
+			return true
+		}
+		signal := m.signal
+		m.lock.Unlock()
+
+		select {
+		case <-signal:
+		case <-timeout.C:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+// Playlist gives the live playlist of the latest segments with their
+// parts, or a delta playlist without the older segments
+func (m *LLHLSMuxer) Playlist(skip bool) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// the window is of complete segments
+	segs := m.segments
+	complete := len(segs)
+	if complete > 0 && !segs[complete-1].complete {
+		complete--
+	}
+	if complete > m.conf.window {
+		segs = segs[complete-m.conf.window:]
+	}
+	if len(segs) == 0 {
+		return "", false
+	}
+
+	target := m.conf.target.Seconds()
+	for _, seg := range segs {
+		target = math.Max(target, seg.duration)
+	}
+	targetdur := int(math.Ceil(target))
+	skipuntil := float64(LLHLS_SKIP_TARGETS * targetdur)
+
+	// the segments older than skipuntil from the end, the discontinuities
+	// are never skipped
+	var total float64
+	for _, seg := range segs {
+		total += seg.duration
+	}
+	skipped := 0
+	if skip {
+		remain := total
+		for _, seg := range segs[:len(segs)-1] {
+			if remain-seg.duration < skipuntil || seg.discontinuity {
+				break
+			}
+			remain -= seg.duration
+			skipped++
+		}
+	}
+
+	// the parts of the last target durations
+	partsfrom := len(segs)
+	for remain := 0.0; partsfrom > 0 && remain < LLHLS_PART_TARGETS*target; {
+		partsfrom--
+		remain += segs[partsfrom].duration
+	}
+
+	base := path.Base(m.name)
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetdur)
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=%.1f,PART-HOLD-BACK=%.3f\n",
+		skipuntil, 3*m.conf.part.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", m.conf.part.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segs[0].seq)
+	if skipped > 0 {
+		fmt.Fprintf(&b, "#EXT-X-SKIP:SKIPPED-SEGMENTS=%d\n", skipped)
+	}
+
+	initver := -1
+	for i, seg := range segs[skipped:] {
+		if seg.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.initver != initver {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s-init%d.mp4\"\n", base, seg.initver)
+			initver = seg.initver
+		}
+		if skipped+i >= partsfrom {
+			for j, p := range seg.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s-%d.%d.m4s\"", p.duration, base, seg.seq, j)
+				if p.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+		if seg.complete {
+			fmt.Fprintf(&b, "#EXTINF:%.3f,\n", seg.duration)
+			fmt.Fprintf(&b, "%s-%d.m4s\n", base, seg.seq)
+		}
+	}
+
+	if m.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	} else {
+		last := segs[len(segs)-1]
+		if last.complete {
+			fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s-%d.0.m4s\"\n", base, last.seq+1)
+		} else {
+			fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s-%d.%d.m4s\"\n",
+				base, last.seq, len(last.parts))
+		}
+	}
+
+	return b.String(), true
+}
+
+// Segment gives a complete segment or one of its parts, a negative part
+// is the whole segment
+func (m *LLHLSMuxer) Segment(seq, part int) ([]byte, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, seg := range m.segments {
+		if seg.seq != seq {
+			continue
+		}
+		if part < 0 {
+			return seg.data, seg.complete
+		}
+		if part < len(seg.parts) {
+			return seg.parts[part].data, true
+		}
+		break
+	}
+	return nil, false
+}
+
+func (m *LLHLSMuxer) Init(version int) ([]byte, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	init, ok := m.inits[version]
+	return init, ok
+}
+
+// lastSeq gives the sequence of the last segment, -1 without any
+func (m *LLHLSMuxer) lastSeq() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.nextseq - 1
+}
+
+// serve answers the playlist, with _HLS_msn/_HLS_part to wait for a part
+// and _HLS_skip for a delta playlist, and the init, segments and parts:
+// init0.mp4, N.m4s, N.P.m4s
+func (m *LLHLSMuxer) serve(w http.ResponseWriter, r *http.Request, file string) {
+	if file == "" {
+		q := r.URL.Query()
+		if q.Get("_HLS_msn") != "" {
+			msn, err := strconv.Atoi(q.Get("_HLS_msn"))
+			part := -1
+			if q.Get("_HLS_part") != "" && err == nil {
+				part, err = strconv.Atoi(q.Get("_HLS_part"))
+			}
+			if err != nil || msn < 0 || msn > m.lastSeq()+2 {
+				http.Error(w, "bad _HLS_msn or _HLS_part", http.StatusBadRequest)
+				return
+			}
+			if !m.wait(r, msn, part) {
+				http.Error(w, "part not available", http.StatusServiceUnavailable)
+				return
+			}
+		} else if q.Get("_HLS_part") != "" {
+			http.Error(w, "_HLS_part without _HLS_msn", http.StatusBadRequest)
+			return
+		}
+
+		playlist, ok := m.Playlist(q.Get("_HLS_skip") == "YES" || q.Get("_HLS_skip") == "v2")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(playlist))
+		return
+	}
+
+	if strings.HasPrefix(file, "init") && strings.HasSuffix(file, ".mp4") {
+		version, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(file, "init"), ".mp4"))
+		init, ok := m.Init(version)
+		if err != nil || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(init)
+		return
+	}
+
+	if !strings.HasSuffix(file, ".m4s") {
+		http.NotFound(w, r)
+		return
+	}
+
+	// N.m4s or N.P.m4s
+	fields := strings.Split(strings.TrimSuffix(file, ".m4s"), ".")
+	seq, err := strconv.Atoi(fields[0])
+	part := -1
+	if len(fields) == 2 && err == nil {
+		part, err = strconv.Atoi(fields[1])
+	}
+	if err != nil || len(fields) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// the preload hint is asked before the part is written
+	data, ok := m.Segment(seq, part)
+	if !ok && part >= 0 && seq <= m.lastSeq()+1 && m.wait(r, seq, part) {
+		data, ok = m.Segment(seq, part)
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/iso.segment")
+	w.Write(data)
+}
@@ -1,34 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"container/list"
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
 )
 
-type ClientNode struct {
-	ip   uint32
-	port uint16
-}
-
-type PullInfo struct {
-	registered bool
-	channel    chan bytes.Buffer
-	pulling    bool // pull action has began
-	gopcache   list.List
-	recycle    bool // recycle flag
-}
-
-type LiveStream struct {
-	gopcache    list.List
-	pullnodemap map[ClientNode]*PullInfo
-}
-
-// stream map: streamid to stream info
-var streammap = map[string]*LiveStream{}
-
 func (r *RtmpServer) Run(rtmp_conf RtmpConf) bool {
 	l, err := net.Listen("tcp", rtmp_conf.server_addr.String())
 	if err != nil {
@@ -52,6 +31,78 @@ func (r *RtmpServer) Run(rtmp_conf RtmpConf) bool {
 }
 
 func main() {
+	var rtmp_conf RtmpConf
+	flag.DurationVar(&rtmp_conf.publish_grace, "publish_grace", 0,
+		"keep a stream that long after its publisher left")
+	rtmp_conf.subscriber = default_subscriber_conf
+	flag.IntVar(&rtmp_conf.subscriber.queue_size, "sub_queue",
+		rtmp_conf.subscriber.queue_size, "tags kept for the viewers of each stream")
+	policy := flag.String("slow_policy", slow_policy_name[rtmp_conf.subscriber.policy],
+		"slow viewers: keyframe, nonref or disconnect")
+	flag.DurationVar(&rtmp_conf.subscriber.max_lag, "max_lag",
+		rtmp_conf.subscriber.max_lag, "disconnect policy, lag of a slow viewer")
+	hls_conf := default_hls_conf
+	flag.BoolVar(&hls_conf.enabled, "hls", hls_conf.enabled, "serve the streams as hls")
+	flag.DurationVar(&hls_conf.target, "hls_target", hls_conf.target,
+		"target duration of the hls segments")
+	flag.IntVar(&hls_conf.window, "hls_window", hls_conf.window,
+		"segments in the hls playlists")
+	flag.BoolVar(&hls_conf.lowlatency, "hls_ll", hls_conf.lowlatency,
+		"low latency hls with fmp4 parts, best with a -hls_target of 2s")
+	flag.DurationVar(&hls_conf.part, "hls_part", hls_conf.part,
+		"target duration of the low latency hls parts")
+	dash_conf := default_dash_conf
+	flag.BoolVar(&dash_conf.enabled, "dash", dash_conf.enabled, "serve the streams as mpeg-dash")
+	flag.DurationVar(&dash_conf.target, "dash_target", dash_conf.target,
+		"target duration of the dash segments")
+	flag.IntVar(&dash_conf.window, "dash_window", dash_conf.window,
+		"segments in the dash manifests")
+	record_conf := default_record_conf
+	flag.BoolVar(&record_conf.auto, "record", record_conf.auto,
+		"record the streams to flv files once published")
+	flag.StringVar(&record_conf.dir, "record_dir", record_conf.dir,
+		"directory of the recordings")
+	flag.StringVar(&record_conf.template, "record_file", record_conf.template,
+		"name of the recordings, with {app}, {stream} and {time}")
+	flag.DurationVar(&record_conf.duration, "record_duration", record_conf.duration,
+		"start a new recording file after that long, 0 for never")
+	flag.Int64Var(&record_conf.size, "record_size", record_conf.size,
+		"start a new recording file after that many bytes, 0 for never")
+	proxies := flag.String("trusted_proxies", "",
+		"comma separated proxies trusted for X-Forwarded-For and X-Real-IP")
+	flag.Parse()
+
+	var ok bool
+	var err error
+	if rtmp_conf.subscriber.policy, ok = parseSlowPolicy(*policy); !ok {
+		fmt.Fprintln(os.Stderr, "unknown slow policy", *policy)
+		os.Exit(2)
+	}
+	if trusted_proxies, err = parseTrustedProxies(*proxies); err != nil {
+		fmt.Fprintln(os.Stderr, "bad trusted proxies:", err)
+		os.Exit(2)
+	}
+	if hls_conf.target <= 0 || hls_conf.window < 1 {
+		fmt.Fprintln(os.Stderr, "bad hls target duration or window")
+		os.Exit(2)
+	}
+	if hls_conf.lowlatency && (hls_conf.part <= 0 || hls_conf.part > hls_conf.target) {
+		fmt.Fprintln(os.Stderr, "bad hls part duration")
+		os.Exit(2)
+	}
+	if dash_conf.target <= 0 || dash_conf.window < 1 {
+		fmt.Fprintln(os.Stderr, "bad dash target duration or window")
+		os.Exit(2)
+	}
+	if record_conf.duration < 0 || record_conf.size < 0 || record_conf.template == "" {
+		fmt.Fprintln(os.Stderr, "bad recording file, duration or size")
+		os.Exit(2)
+	}
+	if rtmp_conf.subscriber.queue_size < 1 {
+		fmt.Fprintln(os.Stderr, "the viewer queue needs at least one tag")
+		os.Exit(2)
+	}
+
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	f, err := os.OpenFile("rtmp.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
@@ -61,11 +112,19 @@ func main() {
 
 	log.SetOutput(f)
 
-	var rtmp_conf RtmpConf
 	rtmp_conf.server_addr.IP = net.ParseIP("0.0.0.0")
 	rtmp_conf.server_addr.Port = 1935
 	log.Println(rtmp_conf)
 
+	streams.SetGracePeriod(rtmp_conf.publish_grace)
+	streams.SetSubscriberConf(rtmp_conf.subscriber)
+	hls.SetConf(hls_conf)
+	streams.OnEvent(hls.onStreamEvent)
+	dash.SetConf(dash_conf)
+	streams.OnEvent(dash.onStreamEvent)
+	recorder.SetConf(record_conf)
+	streams.OnEvent(recorder.onStreamEvent)
+
 	go HttpServer()
 
 	var srv RtmpServer
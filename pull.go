@@ -3,106 +3,263 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 )
 
-// ipv4 only
-func parseIPPort(s string) (uint32, uint16) {
-	ipport := strings.Split(s, ":")
-	if len(ipport) == 1 {
-		ip := net.ParseIP(ipport[0])
-		if ip != nil {
-			return binary.BigEndian.Uint32(ip), 80
+// parseIPPort splits an ipv4 or ipv6 address with an optional port, 80 by
+// default
+func parseIPPort(s string) (net.IP, uint16) {
+	host, sport, err := net.SplitHostPort(s)
+	if err != nil {
+		// no port
+		host = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+		sport = "80"
+	}
+
+	ip := net.ParseIP(host)
+	port, _ := strconv.Atoi(sport)
+	return ip, uint16(port)
+}
+
+// proxies whose X-Forwarded-For and X-Real-IP headers are trusted
+var trusted_proxies []*net.IPNet
+
+// parseTrustedProxies reads a comma separated list of addresses or networks
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("bad proxy address %s", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
 		}
-	} else if len(ipport) == 2 {
-		ip := net.ParseIP(ipport[0])
-		port, _ := strconv.Atoi(ipport[1])
-		return binary.BigEndian.Uint32(ip), uint16(port)
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
 	}
 
-	return 0, 0
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trusted_proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr gives the address of the viewer behind the trusted proxies: the
+// last address of X-Forwarded-For which is not a trusted proxy, else
+// X-Real-IP, else the peer address
+func clientAddr(r *http.Request) (net.IP, uint16) {
+	ip, port := parseIPPort(r.RemoteAddr)
+	if ip == nil || !isTrustedProxy(ip) {
+		return ip, port
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, _ := parseIPPort(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			// the port is the proxy's one
+			ip, port = hop, 0
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+		return ip, port
+	}
+
+	if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
+		if hop, _ := parseIPPort(strings.TrimSpace(xrip)); hop != nil {
+			return hop, 0
+		}
+	}
+
+	return ip, port
 }
 
 func pullStream(w http.ResponseWriter, r *http.Request) {
 	// find the stream
 
 	log.Printf("uri = %s\n", r.RequestURI)
+	app, name := splitStreamKey(strings.TrimPrefix(r.URL.Path, "/"))
 
-	if val, ok := streammap[r.RequestURI[1:]]; ok {
-
-		// register stream reqeust
-		var cn ClientNode
-		cliip, cliport := parseIPPort(r.RemoteAddr)
-		cn.ip = cliip
-		cn.port = cliport
-		var pi *PullInfo = new(PullInfo)
-		pi.registered = true
-		pi.pulling = false
-		pi.recycle = false
-		pi.channel = make(chan bytes.Buffer, 10)
-		val.pullnodemap[cn] = pi
-
-		// return flv head
-		var szpretag uint32 = 0
-		bsszpretag := make([]byte, 4)
+	// register stream reqeust
+	cn := NewClientNode(clientAddr(r))
+	log.Printf("viewer %s from %s\n", cn, r.RemoteAddr)
 
-		var flvhead FLVHeader
-		flvhead.flv = [3]byte{'F', 'L', 'V'}
-		flvhead.ver = 0x1
-		flvhead.sinfo = 0x5
-		flvhead.len = 9
+	if ls, pi, ok := streams.Subscribe(app, name, cn); ok {
+		defer streams.Unsubscribe(ls, cn)
 
-		// write to file for test
-		// f, _ := os.Create("/tmp/3000_dylanzheng")
-		// f.Write(flvhead)
+		var szpretag uint32 = 0
+		bsszpretag := make([]byte, 4)
+		started := false
 
+		w.Header().Set("Content-Type", "video/x-flv")
 		flusher, _ := w.(http.Flusher)
-		_, err := w.Write([]byte(flvhead.toBytes()))
-		if err != nil {
-			pi.recycle = true
-			log.Println("write error")
-			return
-		}
 
-		flusher.Flush()
+		// each viewer starts at zero
+		var rebaser TimestampRebaser
 
-		// recv audio/video package from channel
-		for {
-			tag := <-val.pullnodemap[cn].channel
+		// each tag is preceded by the size of the former one, the flv
+		// header counting as a zero sized tag
+		writeTag := func(tag bytes.Buffer) bool {
+			ret, fh, body := ParseFlvTag(tag.Bytes())
+			if !ret {
+				return true
+			}
+
+			// the tag is shared with the other viewers, only the header
+			// is rewritten
+			ts := rebaser.Rebase(fh.t, fh.ts|uint32(fh.exts)<<24, body)
+			fh.ts = ts & 0xffffff
+			fh.exts = uint8(ts >> 24)
 
 			binary.BigEndian.PutUint32(bsszpretag, szpretag)
-			// f.Write(bsszpretag)
-			// f.Write(tag.Bytes())
 
-			_, err = w.Write(bsszpretag)
+			_, err := w.Write(bsszpretag)
 			if err != nil {
 				log.Println("write error")
-				break
+				return false
 			}
 
-			_, err = w.Write(tag.Bytes())
+			_, err = w.Write(fh.toBytes())
 			if err != nil {
 				log.Println("write error")
-				break
+				return false
+			}
+
+			_, err = w.Write(body)
+			if err != nil {
+				log.Println("write error")
+				return false
+			}
+
+			szpretag = uint32(11 + len(body))
+			return true
+		}
+
+		// the flv head and the replayed tags come first, if the stream has
+		// nothing yet the tracks are known with the first tag
+		start := func() bool {
+			started = true
+			var flvhead FLVHeader
+			flvhead.flv = [3]byte{'F', 'L', 'V'}
+			flvhead.ver = 0x1
+			flvhead.sinfo = ls.FLVFlags()
+			flvhead.len = 9
+
+			if _, err := w.Write(flvhead.toBytes()); err != nil {
+				log.Println("write error")
+				return false
+			}
+
+			for _, cached := range pi.takeReplay() {
+				if !writeTag(cached) {
+					return false
+				}
 			}
+			return true
+		}
 
+		if len(pi.replay) > 0 {
+			if !start() {
+				return
+			}
 			flusher.Flush()
-			szpretag = uint32(tag.Len())
 		}
 
-		val.pullnodemap[cn].recycle = true
+		// recv audio/video package from the stream
+		for {
+			tag, status := pi.Next(r.Context().Done())
+			if status == PULL_DONE {
+				break
+			} else if status == PULL_SLOW {
+				log.Println("viewer is too slow, stop")
+				break
+			} else if status == PULL_END {
+				// the size of the last tag ends the file
+				log.Println("stream is over")
+				if szpretag > 0 {
+					binary.BigEndian.PutUint32(bsszpretag, szpretag)
+					w.Write(bsszpretag)
+				}
+				break
+			}
+
+			if !started && !start() {
+				return
+			}
+
+			if !writeTag(tag) {
+				break
+			}
+
+			flusher.Flush()
+		}
 	} else {
 		log.Println("r.remoteaddr:", r.RemoteAddr)
 		http.NotFound(w, r)
 	}
 }
 
+// stats gives the streams and their viewers as json
+func stats(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(streams.Stats(), "", "  ")
+	if err != nil {
+		log.Println("fail to marshal stats:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
 func HttpServer() {
-	http.HandleFunc("/", pullStream)
+	http.HandleFunc("/stats", stats)
+	http.Handle("/record", recorder)
+	http.Handle("/record/", recorder)
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		switch path.Ext(r.URL.Path) {
+		case ".m3u8", ".ts", ".m4s", ".mp4":
+			hls.ServeHTTP(w, r)
+			return
+		case ".mpd", ".m4v", ".m4a":
+			dash.ServeHTTP(w, r)
+			return
+		}
+		pullStream(w, r)
+	})
 	err := http.ListenAndServe(":80", nil)
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go_rtmp_srv/amf"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RecordConf struct {
+	auto     bool          // record the streams once published
+	dir      string        // where the recordings go
+	template string        // file name, with {app}, {stream} and {time}
+	duration time.Duration // a new file after that long, 0 for none
+	size     int64         // a new file after that many bytes, 0 for none
+}
+
+var default_record_conf = RecordConf{
+	dir:      "record",
+	template: "{app}/{stream}-{time}.flv",
+}
+
+const RECORD_TIME_LAYOUT = "20060102-150405"
+
+// the tags go to the file with this suffix, it's removed once the file
+// is written with the metadata in front, or kept as is on failure
+const RECORD_PART_SUFFIX = ".part"
+
+// flv header and the size of the tag before the first one
+const RECORD_HEADER_SIZE = 9 + 4
+
+// recordName keeps the app and stream names in their directory
+var recordName = strings.NewReplacer("/", "_", "\\", "_", "..", "__")
+
+// path gives the file of a recording started at t
+func (c *RecordConf) path(app, stream string, t time.Time) string {
+	r := strings.NewReplacer("{app}", recordName.Replace(app),
+		"{stream}", recordName.Replace(stream),
+		"{time}", t.Format(RECORD_TIME_LAYOUT))
+	return filepath.Join(c.dir, r.Replace(c.template))
+}
+
+type flvKeyframe struct {
+	time float64 // seconds
+	pos  int64   // offset of the tag in the file
+}
+
+// FLVRecorder writes a stream to FLV files, it reads the stream as a pull
+// node. Each file starts with a key frame at zero, after the sequence
+// headers. The onMetaData with the duration, the size and the key frames
+// is written in front once the file is closed, until then the tags are in
+// the .part file.
+type FLVRecorder struct {
+	name   string
+	app    string
+	stream *LiveStream // recorded, not a later one of the same name
+	conf   RecordConf
+	stop   chan struct{} // closed to stop recording
+	done   chan struct{} // closed once the last file is written
+
+	lock    sync.Mutex
+	current string // file being written, read by the api
+
+	// owned by the recorder goroutine
+	metadata  amf.EcmaArray
+	audioseq  []byte // bodies of the latest sequence headers
+	videoseq  []byte
+	hasaudio  bool
+	hasvideo  bool
+	file      *os.File
+	w         *bufio.Writer
+	path      string
+	size      int64
+	rebaser   TimestampRebaser
+	lastts    uint32
+	keyframes []flvKeyframe
+}
+
+func NewFLVRecorder(app, name string, conf RecordConf) *FLVRecorder {
+	rec := new(FLVRecorder)
+	rec.name = name
+	rec.app = app
+	rec.conf = conf
+	rec.stop = make(chan struct{})
+	rec.done = make(chan struct{})
+	return rec
+}
+
+// run records the stream until it ends or the recorder is stopped
+func (rec *FLVRecorder) run(pi *PullInfo) {
+	defer close(rec.done)
+
+	for _, tag := range pi.takeReplay() {
+		if !rec.handleTag(tag) {
+			rec.close()
+			return
+		}
+	}
+
+	for {
+		tag, status := pi.Next(rec.stop)
+		if status != PULL_OK {
+			break
+		}
+		if !rec.handleTag(tag) {
+			break
+		}
+	}
+
+	rec.close()
+}
+
+// handleTag writes a tag, starting a new file as needed, it tells whether
+// the recording can go on
+func (rec *FLVRecorder) handleTag(tag bytes.Buffer) bool {
+	ret, fh, body := ParseFlvTag(tag.Bytes())
+	if !ret {
+		return true
+	}
+
+	switch fh.t {
+	case RTMP_MSG_TYPEID_INVIKE:
+		var data DataMessage
+		if !data.Parse(bytes.NewBuffer(body)) {
+			return true
+		}
+		// written in front on close
+		if metadata, ok := data.MetaData(); ok {
+			rec.metadata = metadata
+			if _, ok := metadata["audiocodecid"]; ok {
+				rec.hasaudio = true
+			}
+			if _, ok := metadata["videocodecid"]; ok {
+				rec.hasvideo = true
+			}
+			return true
+		}
+	case RTMP_MSG_TYPEID_AUDIO_PKT:
+		rec.hasaudio = true
+		if isAudioSeqHeader(body) {
+			rec.audioseq = body
+		}
+	case RTMP_MSG_TYPEID_VIDEO_PKT:
+		rec.hasvideo = true
+		if isVideoSeqHeader(body) {
+			rec.videoseq = body
+		}
+	}
+
+	// a file starts with a key frame, or any audio without video
+	start := fh.t == RTMP_MSG_TYPEID_VIDEO_PKT && isKeyFrame(body) && !isVideoSeqHeader(body) ||
+		fh.t == RTMP_MSG_TYPEID_AUDIO_PKT && !rec.hasvideo && !isAudioSeqHeader(body)
+
+	if rec.file != nil && start {
+		// rebased like the tag, the file starts at zero
+		ts := fh.ts | uint32(fh.exts)<<24
+		tr := rec.rebaser
+		elapsed := time.Duration(tr.Rebase(fh.t, ts, body)) * time.Millisecond
+		if rec.conf.duration > 0 && elapsed >= rec.conf.duration ||
+			rec.conf.size > 0 && rec.size >= rec.conf.size {
+			rec.close()
+		}
+	}
+
+	if rec.file == nil {
+		if !start {
+			return true
+		}
+		if !rec.open() {
+			return false
+		}
+	}
+
+	if !rec.writeTag(fh.t, fh.ts|uint32(fh.exts)<<24, body) {
+		rec.close()
+		return false
+	}
+	return true
+}
+
+// open starts a file with the flv header and the sequence headers
+func (rec *FLVRecorder) open() bool {
+	// the files rotated within a second are numbered
+	rec.path = rec.conf.path(rec.app, rec.name, time.Now())
+	ext := filepath.Ext(rec.path)
+	for i := 1; rec.exists(rec.path); i++ {
+		rec.path = fmt.Sprintf("%s-%d%s",
+			strings.TrimSuffix(rec.conf.path(rec.app, rec.name, time.Now()), ext), i, ext)
+	}
+	if err := os.MkdirAll(filepath.Dir(rec.path), 0755); err != nil {
+		log.Println("record:", err)
+		return false
+	}
+
+	f, err := os.Create(rec.path + RECORD_PART_SUFFIX)
+	if err != nil {
+		log.Println("record:", err)
+		return false
+	}
+	log.Printf("record %s to %s\n", rec.name, rec.path)
+
+	rec.lock.Lock()
+	rec.current = rec.path
+	rec.lock.Unlock()
+
+	rec.file = f
+	rec.w = bufio.NewWriter(f)
+	rec.rebaser = TimestampRebaser{}
+	rec.lastts = 0
+	rec.keyframes = nil
+
+	var flvhead FLVHeader
+	flvhead.flv = [3]byte{'F', 'L', 'V'}
+	flvhead.ver = 0x1
+	flvhead.sinfo = rec.flvFlags()
+	flvhead.len = 9
+	rec.w.Write(flvhead.toBytes())
+	rec.w.Write([]byte{0, 0, 0, 0})
+	rec.size = RECORD_HEADER_SIZE
+
+	if rec.videoseq != nil && !rec.writeTag(RTMP_MSG_TYPEID_VIDEO_PKT, 0, rec.videoseq) ||
+		rec.audioseq != nil && !rec.writeTag(RTMP_MSG_TYPEID_AUDIO_PKT, 0, rec.audioseq) {
+		rec.close()
+		return false
+	}
+	return true
+}
+
+func (rec *FLVRecorder) exists(path string) bool {
+	for _, p := range []string{path, path + RECORD_PART_SUFFIX} {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (rec *FLVRecorder) flvFlags() byte {
+	var flags byte
+	if rec.hasaudio {
+		flags |= FLV_HEADER_AUDIO
+	}
+	if rec.hasvideo {
+		flags |= FLV_HEADER_VIDEO
+	}
+	return flags
+}
+
+// writeTag writes a tag followed by its size, the key frames are indexed
+func (rec *FLVRecorder) writeTag(t uint8, ts uint32, body []byte) bool {
+	ts = rec.rebaser.Rebase(t, ts, body)
+	if ts > rec.lastts {
+		rec.lastts = ts
+	}
+
+	if t == RTMP_MSG_TYPEID_VIDEO_PKT && isKeyFrame(body) && !isVideoSeqHeader(body) {
+		rec.keyframes = append(rec.keyframes, flvKeyframe{float64(ts) / 1000, rec.size})
+	}
+
+	var ft bytes.Buffer
+	PackFlvTag(&ft, t, ts, *bytes.NewBuffer(body))
+	binary.Write(&ft, binary.BigEndian, uint32(ft.Len()))
+
+	if _, err := rec.w.Write(ft.Bytes()); err != nil {
+		log.Println("record:", err)
+		return false
+	}
+	rec.size += int64(ft.Len())
+	return true
+}
+
+// close writes the file with its metadata in front of the recorded tags
+func (rec *FLVRecorder) close() {
+	if rec.file == nil {
+		return
+	}
+
+	part := rec.file
+	rec.file = nil
+	rec.lock.Lock()
+	rec.current = ""
+	rec.lock.Unlock()
+	defer part.Close()
+
+	if err := rec.w.Flush(); err != nil {
+		log.Println("record:", err)
+		return
+	}
+
+	// the numbers of amf are of a fixed size, the metadata is encoded
+	// first to know its size then with the file positions
+	metadata := make(amf.EcmaArray)
+	for k, v := range rec.metadata {
+		metadata[k] = v
+	}
+	times := make([]interface{}, len(rec.keyframes))
+	positions := make([]interface{}, len(rec.keyframes))
+	for i := range rec.keyframes {
+		times[i] = float64(0)
+		positions[i] = float64(0)
+	}
+	metadata["duration"] = float64(rec.lastts) / 1000
+	metadata["filesize"] = float64(0)
+	metadata["hasAudio"] = rec.hasaudio
+	metadata["hasVideo"] = rec.hasvideo
+	metadata["hasKeyframes"] = len(rec.keyframes) > 0
+	metadata["keyframes"] = amf.Object{"times": times, "filepositions": positions}
+
+	encode := func() (bytes.Buffer, bool) {
+		var payload, tag bytes.Buffer
+		data := DataMessage{name: "onMetaData", values: []interface{}{metadata}}
+		if !data.Encode(&payload) {
+			return tag, false
+		}
+		PackFlvTag(&tag, RTMP_MSG_TYPEID_INVIKE, 0, payload)
+		binary.Write(&tag, binary.BigEndian, uint32(tag.Len()))
+		return tag, true
+	}
+
+	tag, ok := encode()
+	if !ok {
+		return
+	}
+	shift := int64(tag.Len())
+	for i, kf := range rec.keyframes {
+		times[i] = kf.time
+		positions[i] = float64(kf.pos + shift)
+	}
+	metadata["filesize"] = float64(rec.size + shift)
+	if tag, ok = encode(); !ok || int64(tag.Len()) != shift {
+		log.Println("record: the metadata changed size")
+		return
+	}
+
+	f, err := os.Create(rec.path)
+	if err != nil {
+		log.Println("record:", err)
+		return
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var flvhead FLVHeader
+	flvhead.flv = [3]byte{'F', 'L', 'V'}
+	flvhead.ver = 0x1
+	flvhead.sinfo = rec.flvFlags()
+	flvhead.len = 9
+	w.Write(flvhead.toBytes())
+	w.Write([]byte{0, 0, 0, 0})
+	w.Write(tag.Bytes())
+
+	if _, err := part.Seek(RECORD_HEADER_SIZE, io.SeekStart); err != nil {
+		log.Println("record:", err)
+		return
+	}
+	if _, err := io.Copy(w, part); err != nil {
+		log.Println("record:", err)
+		return
+	}
+	if err := w.Flush(); err != nil {
+		log.Println("record:", err)
+		return
+	}
+	part.Close()
+	os.Remove(part.Name())
+
+	log.Printf("record %s done: %s, %.1fs, %d bytes, %d key frames\n", rec.name,
+		rec.path, float64(rec.lastts)/1000, rec.size+shift, len(rec.keyframes))
+}
+
+// RecordServer keeps the recorders of the streams, by stream name
+type RecordServer struct {
+	lock      sync.Mutex
+	conf      RecordConf
+	recorders map[string]*FLVRecorder
+}
+
+func NewRecordServer() *RecordServer {
+	rs := new(RecordServer)
+	rs.conf = default_record_conf
+	rs.recorders = make(map[string]*FLVRecorder)
+	return rs
+}
+
+var recorder = NewRecordServer()
+
+func (rs *RecordServer) SetConf(conf RecordConf) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	rs.conf = conf
+}
+
+var (
+	ErrRecordNoStream  = errors.New("no such stream")
+	ErrRecordRecording = errors.New("already recording")
+)
+
+// Start records a stream until it ends or Stop is called
+func (rs *RecordServer) Start(app string, name string) (*FLVRecorder, error) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	key := streamKey(app, name)
+	cn := NewClientNode(nil, 0)
+	cn.addr = "record"
+	ls, pi, ok := streams.Subscribe(app, name, cn)
+	if !ok {
+		return nil, ErrRecordNoStream
+	}
+
+	// the recorder of a stream that ended may still be writing its file,
+	// a stream published again under the name replaces it
+	if old, ok := rs.recorders[key]; ok && old.stream == ls {
+		streams.Unsubscribe(ls, cn)
+		return nil, ErrRecordRecording
+	}
+
+	rec := NewFLVRecorder(app, name, rs.conf)
+	rec.stream = ls
+	rs.recorders[key] = rec
+	log.Printf("record %s started\n", key)
+
+	go func() {
+		rec.run(pi)
+		streams.Unsubscribe(ls, cn)
+
+		rs.lock.Lock()
+		defer rs.lock.Unlock()
+		if rs.recorders[key] == rec {
+			delete(rs.recorders, key)
+		}
+	}()
+
+	return rec, nil
+}
+
+// Stop ends the recording of a stream, once the file is written
+func (rs *RecordServer) Stop(app string, name string) bool {
+	key := streamKey(app, name)
+	rs.lock.Lock()
+	rec, ok := rs.recorders[key]
+	if ok {
+		delete(rs.recorders, key)
+	}
+	rs.lock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	close(rec.stop)
+	<-rec.done
+	log.Printf("record %s stopped\n", key)
+	return true
+}
+
+// onStreamEvent records the new streams when asked to
+func (rs *RecordServer) onStreamEvent(event int, ls *LiveStream) {
+	if event != STREAM_EVENT_CREATED {
+		return
+	}
+
+	rs.lock.Lock()
+	auto := rs.conf.auto
+	rs.lock.Unlock()
+	if !auto {
+		return
+	}
+
+	if _, err := rs.Start(ls.app, ls.name); err != nil {
+		log.Printf("record %s: %s\n", ls.name, err)
+	}
+}
+
+// allowMethod answers 405 unless the request has the method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+type RecordStat struct {
+	Stream string
+	Path   string
+}
+
+// ServeHTTP starts, POST /record/start?stream=app/name, or stops, POST
+// /record/stop?stream=app/name, a recording, GET /record lists them
+func (rs *RecordServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	app, name := splitStreamKey(r.URL.Query().Get("stream"))
+
+	switch r.URL.Path {
+	case "/record":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+	case "/record/start":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		if _, err := rs.Start(app, name); err == ErrRecordNoStream {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	case "/record/stop":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		if !rs.Stop(app, name) {
+			http.Error(w, "not recording", http.StatusNotFound)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	rs.lock.Lock()
+	list := make([]RecordStat, 0, len(rs.recorders))
+	for name, rec := range rs.recorders {
+		rec.lock.Lock()
+		list = append(list, RecordStat{name, rec.current})
+		rec.lock.Unlock()
+	}
+	rs.lock.Unlock()
+
+	b, err := json.Marshal(list)
+	if err != nil {
+		log.Println("record:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRecordRepublish(t *testing.T) {
+	rs := NewRecordServer()
+	rs.SetConf(RecordConf{auto: true, dir: t.TempDir(), template: "{stream}-{time}.flv"})
+	app := "record republish"
+	key := streamKey(app, "a")
+	recording := func() *FLVRecorder {
+		rs.lock.Lock()
+		defer rs.lock.Unlock()
+		return rs.recorders[key]
+	}
+
+	ls1, _ := streams.Publish(app, "a")
+	rs.onStreamEvent(STREAM_EVENT_CREATED, ls1)
+	rec1 := recording()
+	if rec1 == nil || rec1.stream != ls1 {
+		t.Fatal("stream not recorded")
+	}
+	if _, err := rs.Start(app, "a"); err != ErrRecordRecording {
+		t.Errorf("recorded twice: %v", err)
+	}
+
+	// the publisher comes back before the first recorder is done
+	streams.Unpublish(ls1)
+	ls2, _ := streams.Publish(app, "a")
+	rs.onStreamEvent(STREAM_EVENT_CREATED, ls2)
+	rec2 := recording()
+	if rec2 == nil || rec2.stream != ls2 {
+		t.Fatal("new stream not recorded")
+	}
+
+	<-rec1.done
+	if recording() != rec2 {
+		t.Error("the first recorder removed the second one")
+	}
+	if !rs.Stop(app, "a") {
+		t.Error("second recorder not stopped")
+	}
+	streams.Unpublish(ls2)
+}
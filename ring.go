@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ringEntry struct {
+	tag  bytes.Buffer
+	kind int       // TAG_*
+	at   time.Time // when the publisher sent it
+}
+
+// RingBuffer keeps the latest tags of a stream. The publisher appends to it
+// and each pull node reads it at its own pace with its own sequence, the tags
+// are shared and never modified. A pull node too far behind loses the tags
+// that have been overwritten.
+type RingBuffer struct {
+	lock    sync.Mutex
+	entries []ringEntry
+	head    uint64 // sequence of the next tag
+	closed  bool
+	signal  chan struct{} // closed and replaced on each change
+}
+
+func NewRingBuffer(size int) *RingBuffer {
+	rb := new(RingBuffer)
+	rb.entries = make([]ringEntry, size)
+	rb.signal = make(chan struct{})
+	return rb
+}
+
+// Append adds a tag and wakes up the waiting pull nodes
+func (rb *RingBuffer) Append(tag bytes.Buffer, kind int) {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	if rb.closed {
+		return
+	}
+
+	rb.entries[rb.head%uint64(len(rb.entries))] = ringEntry{tag, kind, time.Now()}
+	rb.head++
+	close(rb.signal)
+	rb.signal = make(chan struct{})
+}
+
+// Close ends the stream, the pull nodes read what is left then stop
+func (rb *RingBuffer) Close() {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	if !rb.closed {
+		rb.closed = true
+		close(rb.signal)
+	}
+}
+
+func (rb *RingBuffer) Head() uint64 {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	return rb.head
+}
+
+// results of PullInfo.Next
+const (
+	PULL_OK   = iota
+	PULL_END  // the publisher is gone
+	PULL_SLOW // the pull node lags too much, disconnect it
+	PULL_DONE // the pull node is done
+)
+
+// Next gives the next tag to send to the pull node, waiting for it until
+// done is closed. The tags are dropped as the slow consumer policy says.
+func (pi *PullInfo) Next(done <-chan struct{}) (bytes.Buffer, int) {
+	rb := pi.ring
+	size := uint64(len(rb.entries))
+
+	for {
+		rb.lock.Lock()
+		if pi.next == rb.head {
+			if rb.closed {
+				rb.lock.Unlock()
+				return bytes.Buffer{}, PULL_END
+			}
+
+			signal := rb.signal
+			rb.lock.Unlock()
+
+			select {
+			case <-signal:
+				continue
+			case <-done:
+				return bytes.Buffer{}, PULL_DONE
+			}
+		}
+
+		// overwritten, start again with a key frame
+		if rb.head-pi.next > size {
+			lost := rb.head - size - pi.next
+			log.Printf("pull node lost %d tags, drop until the next key frame\n", lost)
+			atomic.AddUint64(&pi.dropped, lost)
+			atomic.StoreUint64(&pi.next, rb.head-size)
+			pi.waitkey = true
+		}
+
+		lag := rb.head - pi.next
+		e := rb.entries[pi.next%size]
+		rb.lock.Unlock()
+
+		if pi.conf.policy == SLOW_DISCONNECT && time.Since(e.at) > pi.conf.max_lag {
+			log.Printf("pull node lags for %s, disconnect it\n", time.Since(e.at))
+			pi.slow = true
+			return bytes.Buffer{}, PULL_SLOW
+		}
+
+		atomic.AddUint64(&pi.next, 1)
+
+		if pi.waitkey {
+			if e.kind == TAG_FRAME || e.kind == TAG_NONREF {
+				atomic.AddUint64(&pi.dropped, 1)
+				continue
+			} else if e.kind == TAG_KEYFRAME {
+				pi.waitkey = false
+			}
+		}
+
+		// catch up without breaking the decoding
+		if pi.conf.policy == SLOW_DROP_NONREF && e.kind == TAG_NONREF &&
+			lag >= size*3/4 {
+			atomic.AddUint64(&pi.dropped, 1)
+			continue
+		}
+
+		return e.tag, PULL_OK
+	}
+}
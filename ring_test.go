@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// testRing gives a closed ring of tags of the kinds, each tag is its index
+func testRing(size int, kinds []int) *RingBuffer {
+	rb := NewRingBuffer(size)
+	for i, kind := range kinds {
+		rb.Append(*bytes.NewBuffer([]byte{byte(i)}), kind)
+	}
+	rb.Close()
+	return rb
+}
+
+// readAll gives the tags a pull node reads until the end of the ring
+func readAll(t *testing.T, pi *PullInfo) []int {
+	t.Helper()
+	var tags []int
+	for {
+		tag, status := pi.Next(nil)
+		if status == PULL_END {
+			return tags
+		} else if status != PULL_OK {
+			t.Fatalf("pull status %d after %v", status, tags)
+		}
+		tags = append(tags, int(tag.Bytes()[0]))
+	}
+}
+
+func TestPullPolicies(t *testing.T) {
+	const (
+		C = TAG_CONFIG
+		K = TAG_KEYFRAME
+		F = TAG_FRAME
+		N = TAG_NONREF
+	)
+
+	tests := []struct {
+		name    string
+		policy  int
+		size    int
+		kinds   []int
+		tags    []int
+		dropped uint64
+	}{
+		{"in time", SLOW_DROP_TO_KEYFRAME, 8, []int{K, F, N, F}, []int{0, 1, 2, 3}, 0},
+		{"overwritten", SLOW_DROP_TO_KEYFRAME, 4, []int{K, F, F, F, F, F, F, F, K, F},
+			[]int{8, 9}, 8},
+		{"config while waiting", SLOW_DROP_TO_KEYFRAME, 4, []int{K, F, F, F, F, F, C, F, K, F},
+			[]int{6, 8, 9}, 7},
+		{"overwritten up to a key frame", SLOW_DROP_TO_KEYFRAME, 4, []int{K, F, F, F, F, F, K, F, F, F},
+			[]int{6, 7, 8, 9}, 6},
+		{"non reference kept", SLOW_DROP_TO_KEYFRAME, 8, []int{K, N, F, N, F, N, F, N},
+			[]int{0, 1, 2, 3, 4, 5, 6, 7}, 0},
+		// dropped while they are 3/4 of the ring behind
+		{"non reference dropped", SLOW_DROP_NONREF, 8, []int{K, N, F, N, F, N, F, N},
+			[]int{0, 2, 3, 4, 5, 6, 7}, 1},
+		{"non reference dropped far behind", SLOW_DROP_NONREF, 8, []int{N, N, N, F, N, N, N, N},
+			[]int{3, 4, 5, 6, 7}, 3},
+		{"non reference overwritten", SLOW_DROP_NONREF, 4, []int{K, F, F, F, F, F, K, N, F, N},
+			[]int{6, 8, 9}, 7},
+		{"disconnect in time", SLOW_DISCONNECT, 4, []int{K, F, F, F, F, F, K, F, F, F},
+			[]int{6, 7, 8, 9}, 6},
+	}
+
+	for _, tt := range tests {
+		pi := &PullInfo{ring: testRing(tt.size, tt.kinds)}
+		pi.conf = default_subscriber_conf
+		pi.conf.policy = tt.policy
+
+		tags := readAll(t, pi)
+		if len(tags) != len(tt.tags) {
+			t.Errorf("%s: got tags %v, want %v", tt.name, tags, tt.tags)
+		} else {
+			for i := range tags {
+				if tags[i] != tt.tags[i] {
+					t.Errorf("%s: got tags %v, want %v", tt.name, tags, tt.tags)
+					break
+				}
+			}
+		}
+		if pi.dropped != tt.dropped {
+			t.Errorf("%s: %d dropped, want %d", tt.name, pi.dropped, tt.dropped)
+		}
+	}
+}
+
+func TestPullDisconnect(t *testing.T) {
+	pi := &PullInfo{ring: testRing(8, []int{TAG_KEYFRAME, TAG_FRAME})}
+	pi.conf = default_subscriber_conf
+	pi.conf.policy = SLOW_DISCONNECT
+	pi.conf.max_lag = 10 * time.Millisecond
+
+	time.Sleep(2 * pi.conf.max_lag)
+	if _, status := pi.Next(nil); status != PULL_SLOW || !pi.slow {
+		t.Errorf("pull status %d for a tag older than the max lag", status)
+	}
+}
+
+func TestRingReaders(t *testing.T) {
+	rb := NewRingBuffer(4)
+	fast := &PullInfo{ring: rb, conf: default_subscriber_conf}
+	slow := &PullInfo{ring: rb, conf: default_subscriber_conf}
+
+	// the fast reader keeps up, the slow one reads once the ring wrapped
+	var read []int
+	for i := 0; i < 6; i++ {
+		kind := TAG_FRAME
+		if i%3 == 0 {
+			kind = TAG_KEYFRAME
+		}
+		rb.Append(*bytes.NewBuffer([]byte{byte(i)}), kind)
+		tag, status := fast.Next(nil)
+		if status != PULL_OK {
+			t.Fatalf("pull status %d", status)
+		}
+		read = append(read, int(tag.Bytes()[0]))
+	}
+	rb.Close()
+
+	if tags := readAll(t, fast); len(tags) != 0 || len(read) != 6 || fast.dropped != 0 {
+		t.Errorf("fast reader got %v then %v, %d dropped", read, tags, fast.dropped)
+	}
+	if tags := readAll(t, slow); len(tags) != 3 || tags[0] != 3 || slow.dropped != 3 {
+		t.Errorf("slow reader got %v, %d dropped", tags, slow.dropped)
+	}
+}
+
+func TestRingShared(t *testing.T) {
+	rb := NewRingBuffer(4)
+	a := &PullInfo{ring: rb, conf: default_subscriber_conf}
+	b := &PullInfo{ring: rb, conf: default_subscriber_conf}
+	rb.Append(*bytes.NewBuffer([]byte{1, 2, 3}), TAG_KEYFRAME)
+
+	ta, _ := a.Next(nil)
+	tb, _ := b.Next(nil)
+	if &ta.Bytes()[0] != &tb.Bytes()[0] {
+		t.Error("tag copied for each reader")
+	}
+}
+
+func TestPullWait(t *testing.T) {
+	rb := NewRingBuffer(4)
+	pi := &PullInfo{ring: rb, conf: default_subscriber_conf}
+
+	// woken up by the publisher
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		rb.Append(*bytes.NewBuffer([]byte{7}), TAG_KEYFRAME)
+	}()
+	if tag, status := pi.Next(nil); status != PULL_OK || tag.Bytes()[0] != 7 {
+		t.Errorf("pull status %d", status)
+	}
+
+	// or by the pull node being done
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(done)
+	}()
+	if _, status := pi.Next(done); status != PULL_DONE {
+		t.Errorf("pull status %d once done", status)
+	}
+
+	rb.Close()
+	if _, status := pi.Next(done); status != PULL_END {
+		t.Errorf("pull status %d once closed", status)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"go_rtmp_srv/amf"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 )
@@ -29,30 +31,78 @@ const (
 	RTMP_FEED_MSG = 4
 )
 
+// timestamp field value announcing a 4 bytes extended timestamp
+const RTMP_EXTENDED_TIMESTAMP = 0xffffff
+
 const (
 	RTMP_MSG_TYPEID_SET_PKT_SIZE     = 0x01 // Set Packet Size Message.
+	RTMP_MSG_TYPEID_ABORT_MSG        = 0x02 // Abort Message.
+	RTMP_MSG_TYPEID_ACK              = 0x03 // Acknowledgement.
 	RTMP_MSG_TYPEID_PING_MSG         = 0x04 // Ping Message.
 	RTMP_MSG_TYPEID_SERVER_BINDWIDTH = 0x05 // Server Bandwidth
 	RTMP_MSG_TYPEID_CLIENT_BINDWIDTH = 0x06 // Client Bandwidth.
 	RTMP_MSG_TYPEID_AUDIO_PKT        = 0x08 // Audio Packet.
 	RTMP_MSG_TYPEID_VIDEO_PKT        = 0x09 // Video Packet.
+	RTMP_MSG_TYPEID_AMF3_DATA        = 0x0f // AMF3 data, metadata from AMF3 clients.
 	RTMP_MSG_TYPEID_AMF3             = 0x11 // An AMF3 type command.
 	RTMP_MSG_TYPEID_INVIKE           = 0x12 // Invoke (onMetaData info is sent as such).
 	RTMP_MSG_TYPEID_AMF0             = 0x14 // An AMF0 type command
 )
 
 var message_type_id = map[uint32]string{
-	RTMP_MSG_TYPEID_SET_PKT_SIZE: "Control message",
-	2: "Control message",
-	RTMP_MSG_TYPEID_AUDIO_PKT: "Audio message",
-	RTMP_MSG_TYPEID_VIDEO_PKT: "Video message",
-	RTMP_MSG_TYPEID_INVIKE:    "onMetaData",
-	RTMP_MSG_TYPEID_AMF0:      "AMF0",
-	22:                        "Aggregate message",
+	RTMP_MSG_TYPEID_SET_PKT_SIZE:     "Control message",
+	RTMP_MSG_TYPEID_ABORT_MSG:        "Control message",
+	RTMP_MSG_TYPEID_ACK:              "Control message",
+	RTMP_MSG_TYPEID_SERVER_BINDWIDTH: "Control message",
+	RTMP_MSG_TYPEID_CLIENT_BINDWIDTH: "Control message",
+	RTMP_MSG_TYPEID_AUDIO_PKT:        "Audio message",
+	RTMP_MSG_TYPEID_VIDEO_PKT:        "Video message",
+	RTMP_MSG_TYPEID_AMF3_DATA:        "onMetaData(AMF3)",
+	RTMP_MSG_TYPEID_INVIKE:           "onMetaData",
+	RTMP_MSG_TYPEID_AMF3:             "AMF3",
+	RTMP_MSG_TYPEID_AMF0:             "AMF0",
+	22:                               "Aggregate message",
 }
 
+const (
+	RTMP_DEFAULT_TRUNK_SIZE = 128
+	RTMP_OUT_TRUNK_SIZE     = 4096 // announced after connect
+	RTMP_MAX_TRUNK_SIZE     = 0x7fffffff
+	RTMP_WINDOW_ACK_SIZE    = 2500000 // advertised to the peer
+	RTMP_PEER_BINDWIDTH     = 2500000
+	RTMP_LIMIT_TYPE_DYNAMIC = 2
+)
+
+const (
+	RTMP_CSID_CONTROL = 2 // protocol control messages
+	RTMP_CSID_COMMAND = 3 // commands over the net connection
+	RTMP_CSID_STREAM  = 5 // commands and data over the message stream
+	RTMP_CSID_VIDEO   = 6
+	RTMP_CSID_AUDIO   = 7
+)
+
+// user control event types
+const (
+	RTMP_USER_STREAM_BEGIN = 0
+	RTMP_USER_STREAM_EOF   = 1
+)
+
+// message stream id given by createStream
+const RTMP_DEFAULT_MSG_STREAM_ID = 1
+
+// server version in the connect response
+const RTMP_FMS_VERSION = "FMS/3,0,1,123"
+
+// name added to the metadata of the streams
+const RTMP_SERVER_NAME = "go_rtmp_srv"
+
 type RtmpConf struct {
 	server_addr net.TCPAddr
+
+	// how long a stream outlives its publisher, waiting for it to reconnect
+	publish_grace time.Duration
+
+	subscriber SubscriberConf
 }
 
 type RtmpServer struct {
@@ -83,23 +133,45 @@ func (t *Trunk) Init() {
 	t.payload.payload.Reset()
 }
 
+// ChunkStream keeps the last message header and the partially received
+// message of one chunk stream, so that interleaved chunk streams don't
+// corrupt each other.
+type ChunkStream struct {
+	csid           uint32
+	message_header MessageHeader
+	tsdelta        uint32 // timestamp delta inherited by fmt=3 chunks
+	extended       bool   // preceding header carried an extended timestamp
+	lastfmt        int    // fmt of the preceding header we sent
+	payload        bytes.Buffer
+}
+
 type RtmpConn struct {
-	reqbuf             bytes.Buffer
-	state              int
-	preceding_streamid uint32
-	preceding_msglen   uint32
-	preceding_ts       uint32
-	conn               net.Conn
-	avc_pkt_type       bytes.Buffer
-	acc_pkt_type       bytes.Buffer
-	streamname         string
-
-	trunk_size     uint32
-	was            int
+	reqbuf       bytes.Buffer
+	state        int
+	chunkstreams map[uint32]*ChunkStream
+	// header state of the chunk streams we send on
+	outchunkstreams map[uint32]*ChunkStream
+	wlock           sync.Mutex
+	conn            net.Conn
+	app             string
+	streamname      string
+
+	trunk_size     uint32 // inbound chunk size
+	out_trunk_size uint32 // outbound chunk size
+	was            int    // window acknowledgement size we advertise
 	bindwidth      int
+	peer_was       uint32 // window acknowledgement size of the peer
+	inbytes        uint32 // bytes received, wraps around
+	lastack        uint32 // inbytes when the last acknowledgement was sent
 	trunk          Trunk
 	exit           bool
 	stream_created bool
+	msgstreamid    uint32      // message stream given by createStream
+	stream         *LiveStream // stream published or played
+	publishing     bool
+	playing        bool
+	pullnode       ClientNode    // key of the player in the stream
+	closed         chan struct{} // closed when the connection is over
 }
 
 func HandleNewConnection(conn net.Conn) {
@@ -111,9 +183,17 @@ func HandleNewConnection(conn net.Conn) {
 func (r *RtmpConn) handleNewConnection(conn net.Conn) {
 	r.conn = conn
 	r.state = RTMP_HS_NONE
-	r.trunk_size = 128
+	r.trunk_size = RTMP_DEFAULT_TRUNK_SIZE
+	r.was = RTMP_WINDOW_ACK_SIZE
+	r.bindwidth = RTMP_PEER_BINDWIDTH
 	r.exit = false
 	r.stream_created = false
+	r.chunkstreams = make(map[uint32]*ChunkStream)
+	r.outchunkstreams = make(map[uint32]*ChunkStream)
+	r.out_trunk_size = RTMP_DEFAULT_TRUNK_SIZE
+	r.closed = make(chan struct{})
+	defer close(r.closed)
+	defer r.release()
 
 	if !r.handShake() {
 		log.Println("fail hand shake")
@@ -126,13 +206,9 @@ func (r *RtmpConn) handleNewConnection(conn net.Conn) {
 			return
 		}
 
-		r.preceding_streamid = r.trunk.message_header.msgstreamid
-		r.preceding_msglen = r.trunk.message_header.msglen
-		r.preceding_ts = r.trunk.message_header.timestamp
-		log.Printf("msg complete(%s): %spreceding_streamid=%d|preceding_msglen=%d|preceding_ts=%d\n",
+		log.Printf("msg complete(%s): csid=%d|%s",
 			message_type_id[uint32(r.trunk.message_header.msgtype)],
-			spew.Sdump(r.trunk.message_header),
-			r.preceding_streamid, r.preceding_msglen, r.preceding_ts)
+			r.trunk.basic_header.csid, spew.Sdump(r.trunk.message_header))
 
 		r.handleMessage()
 	}
@@ -143,7 +219,7 @@ func (r *RtmpConn) handleNewConnection(conn net.Conn) {
 
 func (r *RtmpConn) handShake() bool {
 	var recvbuf [1024]byte
-	var rspbuf [1536]byte
+	var rspbuf [1]byte
 	var feedbuf bool = true
 
 	for {
@@ -153,6 +229,7 @@ func (r *RtmpConn) handShake() bool {
 				log.Println("fail to Read: ", err.Error())
 				return false
 			}
+			r.inbytes += uint32(len)
 			r.reqbuf.Write(recvbuf[0:len])
 			feedbuf = false
 		}
@@ -168,43 +245,34 @@ func (r *RtmpConn) handShake() bool {
 			r.conn.Write(rspbuf[0:1])
 			r.state = RTMP_HS_C0 // c0 done
 		} else if r.state == RTMP_HS_C0 {
-			if r.reqbuf.Len() < 1536 {
+			if r.reqbuf.Len() < RTMP_HS_PACKET_SIZE {
 				log.Println("the c1 is not complete")
 				feedbuf = true
 				continue
 			}
 			log.Println("c1...")
 
-			var ts uint32 = binary.BigEndian.Uint32(r.reqbuf.Next(4)[0:4])
-			r.reqbuf.Next(1532)
-
-			log.Printf("c1 rtmp, timestamp = %d\n", ts)
-			log.Println("s1...")
+			c1 := r.reqbuf.Next(RTMP_HS_PACKET_SIZE)
+			log.Printf("c1 rtmp, timestamp = %d, version = %x\n",
+				binary.BigEndian.Uint32(c1[0:4]), binary.BigEndian.Uint32(c1[4:8]))
 
-			copy(rspbuf[0:], r.reqbuf.Bytes())
-			binary.BigEndian.PutUint32(rspbuf[0:], ts)
-			r.conn.Write(rspbuf[0:1536])
+			// s2 goes along with s1, some clients wait for it before c2
+			log.Println("s1 s2...")
+			s1, s2 := hsCreateS1S2(c1)
+			r.conn.Write(append(s1, s2...))
 			r.state = RTMP_HS_C1 // c1 done
 		} else if r.state == RTMP_HS_C1 {
-			if r.reqbuf.Len() < 1536 {
+			if r.reqbuf.Len() < RTMP_HS_PACKET_SIZE {
 				log.Println("the c2 is not complete")
 				feedbuf = true
 				continue
 			}
 
 			log.Println("enter c2")
-			var ts1 = binary.BigEndian.Uint32(r.reqbuf.Next(4)[0:4])
-			var ts2 = binary.BigEndian.Uint32(r.reqbuf.Next(4)[0:4])
-			r.reqbuf.Next(1528)
-
-			copy(rspbuf[0:], r.reqbuf.Bytes())
-			log.Printf("c2 rtmp, timestamp1 = %d, timestamp2 = %d\n", ts1,
-				ts2)
-			binary.BigEndian.PutUint32(rspbuf[0:], ts1)
-			binary.BigEndian.PutUint32(rspbuf[4:], ts2)
-			binary.BigEndian.PutUint32(rspbuf[8:], 345345435)
-
-			r.conn.Write(rspbuf[0:1536])
+			c2 := r.reqbuf.Next(RTMP_HS_PACKET_SIZE)
+			log.Printf("c2 rtmp, timestamp1 = %d, timestamp2 = %d\n",
+				binary.BigEndian.Uint32(c2[0:4]), binary.BigEndian.Uint32(c2[4:8]))
+
 			r.state = RTMP_HS_DONE
 			break
 		}
@@ -221,317 +289,373 @@ func (r *RtmpConn) handShake() bool {
 func (r *RtmpConn) feed() int {
 	r.trunk.Init()
 
-	var pos uint32 = 0
-	var feedbuf bool = false
-
 	for {
-		log.Printf("parsed(pos)=%d|msglen=%d|len(msg)=%d|len(leftmsg)=%d\n", pos,
-			r.trunk.message_header.msglen, r.trunk.payload.payload.Len(),
-			r.trunk.message_header.msglen-uint32(r.trunk.payload.payload.Len()))
+		ret := r.readChunk()
+		if ret < 0 {
+			return -1
+		} else if ret == 0 {
+			// a whole message has been reassembled into r.trunk
+			break
+		} else if ret == 2 {
+			// chunk consumed, the message is still in flight
+			continue
+		}
 
-		if !feedbuf {
-			r.reqbuf.Next(int(pos))
+		var recvbuf [4096]byte
+		len, err := r.conn.Read(recvbuf[0:])
+		if err != nil {
+			log.Println("fail to read:", err.Error())
+			return -1
 		}
 
-		var recvbuf [1024]byte
-		if feedbuf || r.reqbuf.Len() == 0 {
-			len, err := r.conn.Read(recvbuf[0:])
-			if err != nil {
-				log.Println("fail to read:", err.Error())
-				return -1
-			}
+		r.reqbuf.Write(recvbuf[0:len])
 
-			log.Printf("ready to parse: len(reqqbuf)=%d|readlen=%d\n", r.reqbuf.Len(), len)
-			r.reqbuf.Write(recvbuf[0:len])
-			feedbuf = false
-
-		} else {
-			log.Printf("ready to parse: len(reqbuf)=%d\n", r.reqbuf.Len())
+		r.inbytes += uint32(len)
+		if r.inbytes-r.lastack >= uint32(r.was) {
+			r.SendAck()
 		}
+	}
 
-		pos = 0
+	log.Println("left reqbuf len =", r.reqbuf.Len())
 
-		var reqlen uint32 = uint32(r.reqbuf.Len())
-		reqbuf := r.reqbuf.Bytes()
+	return 0
+}
 
-		var rfmt uint8 = ((uint8(reqbuf[pos])) >> 6) & 0x3
-		var last6b uint8 = (uint8(reqbuf[pos])) & 63
-		var csid uint32 = 0
+// readChunk parses one chunk from reqbuf and appends its payload to the
+// chunk stream it belongs to. reqbuf is only consumed when the whole chunk
+// is available.
+// -1 error close connection
+// 0 a message is complete and copied to r.trunk
+// 1 not enouth
+// 2 chunk consumed, message not complete yet
+func (r *RtmpConn) readChunk() int {
+	reqbuf := r.reqbuf.Bytes()
+	var reqlen uint32 = uint32(len(reqbuf))
+	var pos uint32 = 0
 
-		if last6b != 0 && last6b != 1 {
-			csid = uint32(last6b)
-			pos += 1
-		} else if last6b == 0 {
-			if reqlen-pos < 2 {
-				feedbuf = true
-				continue
-			}
+	if reqlen < 1 {
+		return 1
+	}
 
-			csid = uint32(reqbuf[1])
-			pos += 2
-		} else if last6b == 1 {
-			if reqlen-pos < 3 {
-				feedbuf = true
-				continue
-			}
+	var rfmt uint8 = (reqbuf[0] >> 6) & 0x3
+	var csid uint32 = uint32(reqbuf[0] & 0x3f)
 
-			csid = uint32(binary.BigEndian.Uint16(reqbuf[pos+1 : pos+3]))
-			pos += 3
+	if csid == 0 {
+		if reqlen < 2 {
+			return 1
 		}
 
-		if 0 == rfmt || 1 == rfmt || 2 == rfmt {
-			r.trunk.basic_header.fmt = int(rfmt)
+		csid = uint32(reqbuf[1]) + 64
+		pos = 2
+	} else if csid == 1 {
+		if reqlen < 3 {
+			return 1
 		}
 
-		if 1 == rfmt || 2 == rfmt {
-			r.trunk.basic_header.csid = int(csid)
+		csid = uint32(reqbuf[2])*256 + uint32(reqbuf[1]) + 64
+		pos = 3
+	} else {
+		pos = 1
+	}
+
+	cs, ok := r.chunkstreams[csid]
+	if !ok {
+		if rfmt != 0 {
+			log.Printf("fmt=%d without preceding header on csid=%d\n", rfmt, csid)
+			return -1
 		}
 
-		log.Printf("csid=%d|rfmt=%d|last6b=%d\n", csid, rfmt, last6b)
+		cs = new(ChunkStream)
+		cs.csid = csid
+		r.chunkstreams[csid] = cs
+	}
+
+	// work on a copy so that nothing changes until the chunk is complete
+	header := cs.message_header
+	tsdelta := cs.tsdelta
+	extended := cs.extended
 
+	var tsfield uint32 = 0
+
+	if rfmt == 0 || rfmt == 1 || rfmt == 2 {
+		var hlen uint32 = 3
 		if rfmt == 0 {
-			if reqlen-pos < 11 { // len(message header) == 11
-				log.Println("fmt=0 message header is not complete")
-				feedbuf = true
-				continue
-			}
+			hlen = 11
+		} else if rfmt == 1 {
+			hlen = 7
+		}
 
-			r.trunk.message_header.timestamp = uint32(reqbuf[pos]) +
-				uint32(reqbuf[pos+1])*256 + uint32(reqbuf[pos+2])*256*256
-			pos += 3
+		if reqlen-pos < hlen {
+			return 1
+		}
+
+		tsfield = uint32(reqbuf[pos])<<16 | uint32(reqbuf[pos+1])<<8 |
+			uint32(reqbuf[pos+2])
+		pos += 3
 
-			r.trunk.message_header.msglen = uint32(reqbuf[pos])*256*256 +
-				uint32(reqbuf[pos+1])*256 + uint32(reqbuf[pos+2])
+		if rfmt == 0 || rfmt == 1 {
+			header.msglen = uint32(reqbuf[pos])<<16 | uint32(reqbuf[pos+1])<<8 |
+				uint32(reqbuf[pos+2])
 			pos += 3
 
-			r.trunk.message_header.msgtype = int(reqbuf[pos])
+			header.msgtype = int(reqbuf[pos])
 			pos += 1
+		}
 
-			r.trunk.message_header.msgstreamid = binary.LittleEndian.Uint32(reqbuf[pos : pos+4])
+		if rfmt == 0 {
+			header.msgstreamid = binary.LittleEndian.Uint32(reqbuf[pos : pos+4])
 			pos += 4
+		}
 
-			log.Printf("timestamp=%d|messagelen=%d|typeid=%d|string(typeid)=%s|streamid=%d|len(reqbuf)=%d\n",
-				r.trunk.message_header.timestamp,
-				r.trunk.message_header.msglen,
-				r.trunk.message_header.msgtype,
-				message_type_id[uint32(r.trunk.message_header.msgtype)],
-				csid,
-				reqlen-pos)
-
-			if r.trunk.message_header.msglen < r.trunk_size {
-				// over
-				if r.trunk.message_header.msglen <= uint32(reqlen-pos) {
-					binary.Write(&r.trunk.payload.payload, binary.LittleEndian,
-						reqbuf[pos:pos+r.trunk.message_header.msglen])
-					pos += r.trunk.message_header.msglen
-					break
-				} else {
-					log.Println("recv buf is not enough continue to read")
-					feedbuf = true
-					continue
-				}
-			} else {
-				if reqlen-pos >= r.trunk_size {
-					binary.Write(&r.trunk.payload.payload, binary.LittleEndian, reqbuf[pos:pos+r.trunk_size])
-					pos += r.trunk_size
-				} else {
-					log.Println("recv buf is not enough continue to read")
-					feedbuf = true
-					continue
-				}
+		// timestamp or delta doesn't fit in 24 bits
+		extended = tsfield == RTMP_EXTENDED_TIMESTAMP
+		if extended {
+			if reqlen-pos < 4 {
+				return 1
 			}
 
-		} else if rfmt == 1 {
-			if reqlen-pos < 7 {
-				log.Println("fmt=1 message header is not complete: reqlen=", reqlen)
-				feedbuf = true
-				continue
+			tsfield = binary.BigEndian.Uint32(reqbuf[pos : pos+4])
+			pos += 4
+		}
+
+		tsdelta = tsfield
+		if rfmt == 0 {
+			header.timestamp = tsfield
+		} else {
+			header.timestamp += tsfield
+		}
+	} else {
+		// fmt=3 repeats the extended timestamp of the preceding header
+		if extended {
+			if reqlen-pos < 4 {
+				return 1
 			}
 
-			r.trunk.message_header.msgstreamid = r.preceding_streamid
+			tsdelta = binary.BigEndian.Uint32(reqbuf[pos : pos+4])
+			pos += 4
+		}
 
-			r.trunk.message_header.timestamp = uint32(reqbuf[pos])*256*256 +
-				uint32(reqbuf[pos+1])*256 + uint32(reqbuf[pos+2])
-			pos += 3
+		// fmt=3 starting a new message repeats the preceding delta
+		if cs.payload.Len() == 0 {
+			header.timestamp += tsdelta
+		}
+	}
 
-			r.trunk.message_header.msglen = uint32(reqbuf[pos])*256*256 +
-				uint32(reqbuf[pos+1])*256 + uint32(reqbuf[pos+2])
-			pos += 3
+	if rfmt != 3 && cs.payload.Len() != 0 {
+		log.Printf("new header on csid=%d while %d bytes in flight, drop them\n",
+			csid, cs.payload.Len())
+		cs.payload.Reset()
+	}
 
-			r.trunk.message_header.msgtype = int(reqbuf[pos])
-			pos += 1
+	left := header.msglen - uint32(cs.payload.Len())
+	if left > r.trunk_size {
+		left = r.trunk_size
+	}
 
-			if r.trunk.message_header.msglen < r.trunk_size {
-				if r.trunk.message_header.msglen <= uint32(reqlen-pos) {
-					binary.Write(&r.trunk.payload.payload, binary.LittleEndian, reqbuf[pos:pos+r.trunk.message_header.msglen])
-					pos += r.trunk.message_header.msglen
-					break
-				} else {
-					log.Println("recv buf is not enough continue to read")
-					feedbuf = true
-					continue
-				}
-			} else {
-				if reqlen-pos >= r.trunk_size {
-					binary.Write(&r.trunk.payload.payload, binary.LittleEndian, reqbuf[pos:pos+r.trunk_size])
-					pos += r.trunk_size
-				} else {
-					log.Println("recv buf is not enough continue to read")
-					feedbuf = true
-					continue
-				}
-			}
+	if reqlen-pos < left {
+		return 1
+	}
 
-		} else if rfmt == 2 {
-			if reqlen-pos < 3 {
-				log.Println("message header is not complete")
-				feedbuf = true
-				continue
-			}
+	cs.message_header = header
+	cs.tsdelta = tsdelta
+	cs.extended = extended
+	cs.payload.Write(reqbuf[pos : pos+left])
+	pos += left
+	r.reqbuf.Next(int(pos))
 
-			r.trunk.message_header.msglen = r.preceding_msglen
-			r.trunk.message_header.msgstreamid = r.preceding_streamid
-			r.trunk.message_header.timestamp = uint32(reqbuf[pos])*256*256 +
-				uint32(reqbuf[pos+1])*256 + uint32(reqbuf[pos+2]) + r.preceding_ts
+	if uint32(cs.payload.Len()) < cs.message_header.msglen {
+		return 2
+	}
 
-			pos += 3
+	log.Printf("csid=%d|rfmt=%d|timestamp=%d|messagelen=%d|typeid=%d|string(typeid)=%s|streamid=%d\n",
+		csid, rfmt, header.timestamp, header.msglen, header.msgtype,
+		message_type_id[uint32(header.msgtype)], header.msgstreamid)
 
-			if r.trunk.message_header.msglen < r.trunk_size {
-				if r.trunk.message_header.msglen <= uint32(reqlen-pos) {
-					binary.Write(&r.trunk.payload.payload, binary.LittleEndian, reqbuf[pos:pos+r.trunk.message_header.msglen])
-					pos += r.trunk.message_header.msglen
-					break
-				} else {
-					log.Println("recv buf is not enough continue to read")
-					feedbuf = true
-					continue
-				}
-			} else {
-				if uint32(reqlen-pos) >= r.trunk_size {
-					binary.Write(&r.trunk.payload.payload, binary.LittleEndian, reqbuf[pos:pos+r.trunk_size])
-					pos += r.trunk_size
-				} else {
-					log.Println("recv buf is not enough continue to read")
-					feedbuf = true
-					continue
-				}
-			}
+	r.trunk.basic_header.fmt = int(rfmt)
+	r.trunk.basic_header.csid = int(csid)
+	r.trunk.message_header = cs.message_header
+	r.trunk.payload.payload.Write(cs.payload.Bytes())
+	cs.payload.Reset()
 
-		} else if rfmt == 3 {
-
-			if uint32(r.trunk.payload.payload.Len())+r.trunk_size < r.trunk.message_header.msglen {
-				// no message header
-				if reqlen-pos < r.trunk_size {
-					feedbuf = true
-					log.Println("fmt=3 message header is not complete")
-					continue
-				}
-
-				binary.Write(&r.trunk.payload.payload, binary.LittleEndian, reqbuf[pos:pos+r.trunk_size])
-				pos += r.trunk_size
-			} else {
-				left := r.trunk.message_header.msglen - uint32(r.trunk.payload.payload.Len())
-				if left <= reqlen-pos {
-					binary.Write(&r.trunk.payload.payload, binary.LittleEndian, reqbuf[pos:pos+left])
-					pos += left
-					break
-				}
+	return 0
+}
 
-				feedbuf = true
-			}
-		}
+// writeBasicHeader writes fmt and the 1, 2 or 3 bytes chunk stream id
+func writeBasicHeader(buf *bytes.Buffer, rfmt int, csid int) {
+	if csid >= 2 && csid <= 63 {
+		buf.WriteByte(byte(rfmt<<6 | csid))
+	} else if csid >= 64 && csid <= 319 {
+		buf.WriteByte(byte(rfmt << 6))
+		buf.WriteByte(byte(csid - 64))
+	} else {
+		buf.WriteByte(byte(rfmt<<6 | 1))
+		buf.WriteByte(byte((csid - 64) & 0xff))
+		buf.WriteByte(byte((csid - 64) >> 8))
 	}
+}
 
-	r.reqbuf.Next(int(pos))
-	log.Println("left reqbuf len =", r.reqbuf.Len())
-
-	return 0
+// SerializeToBytes splits the message into chunks of at most chunksize
+// bytes. The first chunk carries a header of basic_header.fmt and the
+// following ones are fmt=3. For fmt 1/2/3 message_header.timestamp is the
+// timestamp delta.
+func (t *Trunk) SerializeToBytes(chunksize uint32) (bool, []byte) {
+	ret, bufs := t.serializeBuffers(chunksize, t.payload.payload.Bytes())
+	if !ret {
+		return false, nil
+	}
+	return true, bytes.Join(bufs, nil)
 }
 
-func (t *Trunk) SerializeToBytes() (bool, []byte) {
-	var buf [1600]byte
-	var pos int = 0
+// serializeBuffers chunks payload as SerializeToBytes does, the chunk
+// headers are interleaved with slices of payload which is not copied
+func (t *Trunk) serializeBuffers(chunksize uint32, payload []byte) (bool, net.Buffers) {
+	var buf bytes.Buffer
 	csid := t.basic_header.csid
 	rfmt := t.basic_header.fmt
 
-	// trunk header
-	buf[pos] = byte((t.basic_header.fmt << 6))
+	if csid < 2 || csid > 65599 || rfmt < 0 || rfmt > 3 || chunksize == 0 {
+		log.Printf("fmt is not valid: fmt=%d|csid=%d|chunksize=%d\n", rfmt,
+			csid, chunksize)
+		return false, nil
+	}
 
-	if csid >= 2 && csid <= 63 {
-		buf[pos] = byte(int(buf[pos]) | (csid))
-		pos++
-	} else if csid >= 64 && csid <= 319 {
-		pos++
-		buf[pos] = byte(csid - 64)
-		pos++
-	} else if csid > 319 {
-		newcsid := csid - 64
-		buf[pos] = byte(int(buf[pos]) & (1 << 2))
-		pos++
-		binary.BigEndian.PutUint16(buf[pos:], uint16(newcsid))
-		pos += 2
+	if uint32(len(payload)) != t.message_header.msglen {
+		log.Printf("msglen=%d mismatches len(payload)=%d\n",
+			t.message_header.msglen, len(payload))
+		return false, nil
 	}
 
-	// trunk message header
-	if 0 == rfmt || 1 == rfmt {
-		// fix 16777215
-		if t.message_header.timestamp > 16777215 {
-			log.Println("fmt is not valid")
-			return false, nil
-		}
+	// timestamp doesn't fit in 24 bits, the 4 bytes extended timestamp
+	// follows the message header, fmt=3 chunks repeat it
+	var tsfield uint32 = t.message_header.timestamp
+	extended := tsfield >= RTMP_EXTENDED_TIMESTAMP
+	if extended {
+		tsfield = RTMP_EXTENDED_TIMESTAMP
+	}
 
+	writeBasicHeader(&buf, rfmt, csid)
+
+	// trunk message header
+	if 0 == rfmt || 1 == rfmt || 2 == rfmt {
 		// timestamp (3B)
-		buf[pos] = byte(t.message_header.timestamp & 0xff)
-		pos++
-		buf[pos] = byte(t.message_header.timestamp & (0xff << 8))
-		pos++
-		buf[pos] = byte(t.message_header.timestamp & (0xff << 16))
-		pos++
+		buf.WriteByte(byte(tsfield >> 16))
+		buf.WriteByte(byte(tsfield >> 8))
+		buf.WriteByte(byte(tsfield))
+	}
 
+	if 0 == rfmt || 1 == rfmt {
 		// message length (3B)
-		buf[pos] = byte(t.message_header.msglen & (0xff << 16))
-		pos++
-		buf[pos] = byte(t.message_header.msglen & (0xff << 8))
-		pos++
-		buf[pos] = byte(t.message_header.msglen & (0xff << 0))
-		pos++
+		buf.WriteByte(byte(t.message_header.msglen >> 16))
+		buf.WriteByte(byte(t.message_header.msglen >> 8))
+		buf.WriteByte(byte(t.message_header.msglen))
 
 		// message type id (1B)
-		buf[pos] = byte(t.message_header.msgtype)
-		// log.Println("msg type id = ", t.message_header.msgtype)
-		pos++
+		buf.WriteByte(byte(t.message_header.msgtype))
 
 		if 0 == rfmt {
 			// msg stream id (4B)
-			binary.BigEndian.PutUint32(buf[pos:], t.message_header.msgstreamid)
-			pos += 4
+			binary.Write(&buf, binary.LittleEndian, t.message_header.msgstreamid)
 		}
-	} else if 2 == rfmt {
-		// timestamp (3B)
-		buf[pos] = byte(t.message_header.timestamp & 0xff)
-		pos++
-		buf[pos] = byte(t.message_header.timestamp & (0xff << 8))
-		pos++
-		buf[pos] = byte(t.message_header.timestamp & (0xff << 16))
-		pos++
-	} else if 3 == rfmt {
-		log.Println("no messag header")
 	}
 
-	b := append(buf[0:pos], t.payload.payload.Bytes()...)
-	pos += int(t.message_header.msglen)
+	// the headers all go in buf, the end of each one is kept to slice it
+	// once buf is done growing
+	var ends []int
+	var chunks [][]byte
+	for first := true; ; first = false {
+		if !first {
+			writeBasicHeader(&buf, 3, csid)
+		}
+
+		if extended {
+			binary.Write(&buf, binary.BigEndian, t.message_header.timestamp)
+		}
 
-	// log.Println("serilized buf size", len(b), b)
+		n := uint32(len(payload))
+		if n > chunksize {
+			n = chunksize
+		}
 
-	log.Println("streamid = ", t.message_header.msgstreamid)
+		ends = append(ends, buf.Len())
+		chunks = append(chunks, payload[:n])
+		payload = payload[n:]
+		if len(payload) == 0 {
+			break
+		}
+	}
 
-	return true, b
+	hdrs := buf.Bytes()
+	bufs := make(net.Buffers, 0, 2*len(chunks))
+	start := 0
+	for i, end := range ends {
+		bufs = append(bufs, hdrs[start:end])
+		if len(chunks[i]) > 0 {
+			bufs = append(bufs, chunks[i])
+		}
+		start = end
+	}
+	return true, bufs
+}
+
+// protocol control messages, always on csid 2 and message stream 0
+func (r *RtmpConn) handleProtocolControlMessage() bool {
+	var t *Trunk = &r.trunk
+	if t.payload.payload.Len() < 4 {
+		log.Printf("control message %d too short: %d\n",
+			t.message_header.msgtype, t.payload.payload.Len())
+		return false
+	}
+
+	var v uint32 = binary.BigEndian.Uint32(t.payload.payload.Next(4))
+
+	switch t.message_header.msgtype {
+	case RTMP_MSG_TYPEID_SET_PKT_SIZE:
+		// the first bit must be zero
+		v &= RTMP_MAX_TRUNK_SIZE
+		if v == 0 {
+			log.Println("invalid chunk size 0")
+			return false
+		}
+		log.Printf("set chunk size %d -> %d\n", r.trunk_size, v)
+		r.trunk_size = v
+	case RTMP_MSG_TYPEID_ABORT_MSG:
+		if cs, ok := r.chunkstreams[v]; ok {
+			log.Printf("abort message on csid=%d, drop %d bytes\n", v,
+				cs.payload.Len())
+			cs.payload.Reset()
+		}
+	case RTMP_MSG_TYPEID_ACK:
+		log.Printf("peer acknowledged %d bytes\n", v)
+	case RTMP_MSG_TYPEID_SERVER_BINDWIDTH:
+		log.Printf("peer window acknowledgement size %d\n", v)
+		r.peer_was = v
+	}
+
+	return true
 }
 
 func (r *RtmpConn) handleMessage() {
 	var t *Trunk = &r.trunk
-	if t.message_header.msgtype == RTMP_MSG_TYPEID_AMF0 {
-		_, cmd := amf.DecodeString(&t.payload.payload)
+	if t.message_header.msgtype == RTMP_MSG_TYPEID_SET_PKT_SIZE ||
+		t.message_header.msgtype == RTMP_MSG_TYPEID_ABORT_MSG ||
+		t.message_header.msgtype == RTMP_MSG_TYPEID_ACK ||
+		t.message_header.msgtype == RTMP_MSG_TYPEID_SERVER_BINDWIDTH {
+		if !r.handleProtocolControlMessage() {
+			r.exit = true
+		}
+	} else if t.message_header.msgtype == RTMP_MSG_TYPEID_AMF0 ||
+		t.message_header.msgtype == RTMP_MSG_TYPEID_AMF3 {
+		// AMF3 commands start with a format byte, then the values are AMF0
+		// switching to AMF3 with the AMF3 marker where needed
+		if t.message_header.msgtype == RTMP_MSG_TYPEID_AMF3 {
+			t.payload.payload.Next(1)
+		}
+
+		cmd, err := amf.DecodeString(&t.payload.payload)
+		if err != nil {
+			log.Println("fail to decode cmd:", err)
+			return
+		}
 		log.Println("the cmd is", cmd)
 		switch cmd {
 		case "connect":
@@ -543,6 +667,12 @@ func (r *RtmpConn) handleMessage() {
 		case "publish":
 			log.Printf("handle %s\n", cmd)
 			r.HandlePublish(&t.payload.payload)
+		case "releaseStream", "FCPublish", "FCUnpublish":
+			log.Printf("handle %s\n", cmd)
+			r.HandleFCStream(cmd, &t.payload.payload)
+		case "play":
+			log.Printf("handle %s\n", cmd)
+			r.HandlePlay(&t.payload.payload)
 		case "deleteStream":
 			log.Printf("handle %s\n", cmd)
 			r.HandleDeleteStream(&t.payload.payload)
@@ -556,95 +686,100 @@ func (r *RtmpConn) handleMessage() {
 
 		// Chunk Stream ID with value 2 is
 		// reserved for low-level protocol control messages and commands.
-	} else if t.message_header.msgtype == RTMP_MSG_TYPEID_INVIKE { // metadata
-		log.Printf("metadata msg: %s\n", spew.Sdump(t.payload.payload.Bytes()))
-	} else if t.message_header.msgtype == RTMP_MSG_TYPEID_AUDIO_PKT ||
-		t.message_header.msgtype == RTMP_MSG_TYPEID_VIDEO_PKT {
-		// dispatch audio/video
-		if _, ok := streammap[r.streamname]; !ok {
+	} else if t.message_header.msgtype == RTMP_MSG_TYPEID_INVIKE ||
+		t.message_header.msgtype == RTMP_MSG_TYPEID_AMF3_DATA { // metadata
+		// same format byte as AMF3 commands
+		if t.message_header.msgtype == RTMP_MSG_TYPEID_AMF3_DATA {
+			t.payload.payload.Next(1)
+		}
+		if !r.publishing {
 			return
 		}
 
-		ls := streammap[r.streamname]
+		ls := r.stream
 
-		var b bytes.Buffer
-		PackFlvTag(&b, uint8(t.message_header.msgtype), uint32(t.message_header.timestamp),
-			t.payload.payload)
+		var data DataMessage
+		if !data.Parse(&t.payload.payload) {
+			return
+		}
+		log.Printf("data msg %s: %v\n", data.name, data.values)
 
-		if t.message_header.msgtype == RTMP_MSG_TYPEID_VIDEO_PKT {
-			// save recent gop
-			// the next key frame
-			if t.payload.payload.Bytes()[0]&0xf0 == 0x10 {
-				if ls.gopcache.Len() > 0 {
-					ls.gopcache.Init()
-				}
-			}
-			ls.gopcache.PushBack(b)
-			log.Println("new msg in gop cache", ls.gopcache.Len())
+		// onMetaData tells who serves the stream since when
+		metadata, ismetadata := data.MetaData()
+		if ismetadata {
+			metadata["server"] = RTMP_SERVER_NAME
+			metadata["starttime"] = ls.start
+		}
 
-			var avc_packettype uint8 = t.payload.payload.Bytes()[1]
-			if avc_packettype == 0 {
-				r.avc_pkt_type.Write(b.Bytes())
-			}
+		var payload bytes.Buffer
+		if !data.Encode(&payload) {
+			return
 		}
 
-		if t.message_header.msgtype == RTMP_MSG_TYPEID_AUDIO_PKT {
-			var aac_packettype uint8 = t.payload.payload.Bytes()[1]
-			if aac_packettype == 0 {
-				r.acc_pkt_type.Write(b.Bytes())
+		// a new buffer, the former one may still be read by pull nodes
+		var b bytes.Buffer
+		PackFlvTag(&b, RTMP_MSG_TYPEID_INVIKE, t.message_header.timestamp,
+			payload)
+
+		// the latest metadata is kept for new pull nodes, other data goes
+		// with the gop
+		ls.lock.Lock()
+		ls.dispatch(b)
+		if ismetadata {
+			ls.metadata = b
+			// encoders announce their tracks before sending them
+			if _, ok := metadata["audiocodecid"]; ok || metadata["hasAudio"] == true {
+				ls.hasaudio = true
 			}
+			if _, ok := metadata["videocodecid"]; ok || metadata["hasVideo"] == true {
+				ls.hasvideo = true
+			}
+		} else {
+			ls.cacheTag(b, false)
+		}
+		ls.lock.Unlock()
+	} else if t.message_header.msgtype == RTMP_MSG_TYPEID_AUDIO_PKT ||
+		t.message_header.msgtype == RTMP_MSG_TYPEID_VIDEO_PKT {
+		// dispatch audio/video
+		if !r.publishing {
+			return
 		}
 
-		dispatched_video := false
-		for k, v := range ls.pullnodemap {
-			if v.recycle {
-				log.Println("recycle stream pullinfo")
-				delete(ls.pullnodemap, k)
-				continue
-			}
+		ls := r.stream
+		ls.lock.Lock()
+		defer ls.lock.Unlock()
 
-			if v.registered {
-				if !v.pulling {
-					select {
-					case v.channel <- r.acc_pkt_type:
-					default:
-						log.Println("channel error")
-						continue
-					}
-
-					select {
-					case v.channel <- r.avc_pkt_type:
-					default:
-						log.Println("channel error")
-						continue
-					}
-					v.pulling = true
-				}
-
-				if t.message_header.msgtype == RTMP_MSG_TYPEID_VIDEO_PKT {
-					v.gopcache.PushBack(ls.gopcache.Front().Value)
-
-					select {
-					case v.channel <- v.gopcache.Front().Value.(bytes.Buffer):
-					default:
-						log.Println("channel error")
-						continue
-					}
-
-					v.gopcache.Remove(v.gopcache.Front())
-
-					dispatched_video = true
-				} else {
-					select {
-					case v.channel <- b:
-					default:
-						continue
-					}
-				}
-			}
+		body := t.payload.payload.Bytes()
+		if len(body) < 2 {
+			log.Println("too short audio/video packet, ignore")
+			return
 		}
-		if dispatched_video {
-			ls.gopcache.Remove(ls.gopcache.Front())
+
+		var b bytes.Buffer
+		PackFlvTag(&b, uint8(t.message_header.msgtype), uint32(t.message_header.timestamp),
+			t.payload.payload)
+
+		if t.message_header.msgtype == RTMP_MSG_TYPEID_VIDEO_PKT {
+			ls.hasvideo = true
+		} else {
+			ls.hasaudio = true
+		}
+		ls.dispatch(b)
+
+		// the sequence headers replace the former ones, each new gop
+		// replaces the cached one
+		if t.message_header.msgtype == RTMP_MSG_TYPEID_VIDEO_PKT &&
+			isVideoSeqHeader(body) {
+			log.Printf("new video sequence header for stream %s\n", ls.name)
+			ls.videoseq = b
+		} else if t.message_header.msgtype == RTMP_MSG_TYPEID_AUDIO_PKT &&
+			isAudioSeqHeader(body) {
+			log.Printf("new audio sequence header for stream %s\n", ls.name)
+			ls.audioseq = b
+		} else {
+			// an audio only stream starts a gop on any frame, as the ring
+			// lets a dropping pull node start again
+			ls.cacheTag(b, ls.tagKind(b) == TAG_KEYFRAME)
 		}
 	}
 }
@@ -655,72 +790,166 @@ func (r *RtmpConn) handleNetConnectionConect(buf *bytes.Buffer) bool {
 		return false
 	}
 
+	r.app = connect.app
+
 	r.SendWindowAckSize()
 	r.SendSetPeerBindWidth()
-	r.ResponseConnect()
+	r.SendSetChunkSize(RTMP_OUT_TRUNK_SIZE)
+	r.ResponseConnect(&connect)
 	return true
 }
 
 func (r *RtmpConn) SendWindowAckSize() {
 	var t Trunk
-	t.basic_header.fmt = 0
 	t.basic_header.csid = 2 // fixed
 	t.message_header.msglen = 4
 	t.message_header.msgstreamid = 0 // fixed
 	t.message_header.msgtype = RTMP_MSG_TYPEID_SERVER_BINDWIDTH
 	// t.message_header.timestamp; ignore
-	var as [4]byte
-	as[0] = 0x1
-	as[1] = 0x1
-	as[2] = 0x1
-	as[3] = 0x1
-	binary.Write(&t.payload.payload, binary.LittleEndian, as)
+	binary.Write(&t.payload.payload, binary.BigEndian, uint32(r.was))
+
+	r.SendMessage(&t)
+}
+
+// SendAck acknowledges the bytes received so far once a window is reached
+func (r *RtmpConn) SendAck() {
+	var t Trunk
+	t.basic_header.csid = 2 // fixed
+	t.message_header.msglen = 4
+	t.message_header.msgstreamid = 0 // fixed
+	t.message_header.msgtype = RTMP_MSG_TYPEID_ACK
+	binary.Write(&t.payload.payload, binary.BigEndian, r.inbytes)
+
+	r.SendMessage(&t)
+	r.lastack = r.inbytes
+}
 
-	_, b := t.SerializeToBytes()
-	r.conn.Write(b[0:])
+// SendMessage chunks t with the outbound chunk size and writes it. The
+// header is compressed against the preceding message of the same csid:
+// fmt=1 if only the length or type changed, fmt=2 if only the timestamp
+// changed and fmt=3 if the timestamp delta is repeated too.
+func (r *RtmpConn) SendMessage(t *Trunk) bool {
+	return r.sendPayload(t, t.payload.payload.Bytes())
+}
+
+// sendPayload sends payload as the message of t, it's written as is with
+// the chunk headers around it
+func (r *RtmpConn) sendPayload(t *Trunk, payload []byte) bool {
+	// the play loop sends aside the read loop
+	r.wlock.Lock()
+	defer r.wlock.Unlock()
+
+	csid := uint32(t.basic_header.csid)
+	ts := t.message_header.timestamp
+
+	var rfmt int = 0
+	var tsfield uint32 = ts
+
+	cs, ok := r.outchunkstreams[csid]
+	if !ok {
+		cs = new(ChunkStream)
+		cs.csid = csid
+		r.outchunkstreams[csid] = cs
+	} else if cs.message_header.msgstreamid == t.message_header.msgstreamid &&
+		ts >= cs.message_header.timestamp {
+		tsfield = ts - cs.message_header.timestamp
+		if cs.message_header.msglen != t.message_header.msglen ||
+			cs.message_header.msgtype != t.message_header.msgtype {
+			rfmt = 1
+		} else if tsfield != cs.tsdelta || cs.lastfmt == 0 {
+			// after fmt=0 the delta a fmt=3 repeats is the timestamp
+			rfmt = 2
+		} else {
+			rfmt = 3
+		}
+	}
+
+	t.basic_header.fmt = rfmt
+	t.message_header.timestamp = tsfield
+	ret, bufs := t.serializeBuffers(r.out_trunk_size, payload)
+	t.message_header.timestamp = ts
+	if !ret {
+		return false
+	}
+
+	if _, err := bufs.WriteTo(r.conn); err != nil {
+		log.Println("fail to write:", err.Error())
+		return false
+	}
+
+	cs.message_header = t.message_header
+	cs.tsdelta = tsfield
+	cs.lastfmt = rfmt
+	return true
+}
+
+// SendSetChunkSize announces our outbound chunk size, applied to all the
+// messages sent after it
+func (r *RtmpConn) SendSetChunkSize(size uint32) {
+	var t Trunk
+	t.basic_header.csid = 2 // fixed
+	t.message_header.msglen = 4
+	t.message_header.msgstreamid = 0 // fixed
+	t.message_header.msgtype = RTMP_MSG_TYPEID_SET_PKT_SIZE
+	binary.Write(&t.payload.payload, binary.BigEndian, size&RTMP_MAX_TRUNK_SIZE)
+
+	if r.SendMessage(&t) {
+		r.out_trunk_size = size
+	}
 }
 
 func (r *RtmpConn) SendSetPeerBindWidth() {
 	var t Trunk
 
-	t.basic_header.fmt = 0
 	t.basic_header.csid = 2 // fixed
 	t.message_header.msglen = 5
 	t.message_header.msgstreamid = 0 // fixed
 	t.message_header.msgtype = RTMP_MSG_TYPEID_CLIENT_BINDWIDTH
 	// t.message_header.timestamp; ignore
-	var bw [5]byte
-	bw[0] = 0x1
-	bw[1] = 0x1
-	bw[2] = 0x1
-	bw[3] = 0x1
-	bw[4] = 0x1
-	binary.Write(&t.payload.payload, binary.LittleEndian, bw)
+	binary.Write(&t.payload.payload, binary.BigEndian, uint32(r.bindwidth))
+	binary.Write(&t.payload.payload, binary.BigEndian, byte(RTMP_LIMIT_TYPE_DYNAMIC))
 
-	_, b := t.SerializeToBytes()
-	r.conn.Write(b[0:])
+	r.SendMessage(&t)
 }
 
-func (r *RtmpConn) ResponseConnect() {
-	var cs CreateStream
-	cs.cmd = "_result"
-	cs.transaction_id = 1
-
-	var rspbuf bytes.Buffer
-	amf.EncodeString(&rspbuf, "_result")
-	amf.EncodeNumber(&rspbuf, 1)
-	log.Println(spew.Sdump(rspbuf.Bytes()))
+// SendCommand encodes the command name and its values in AMF0 and sends it
+// on the given chunk stream and message stream
+func (r *RtmpConn) SendCommand(csid int, msgstreamid uint32, values ...interface{}) bool {
+	var b bytes.Buffer
+	for _, v := range values {
+		if err := amf.Encode(&b, v); err != nil {
+			log.Println("fail to encode command:", err)
+			return false
+		}
+	}
+	log.Println(spew.Sdump(b.Bytes()))
 
 	var t Trunk
-	t.basic_header.fmt = 0
-	t.basic_header.csid = 3
-	t.message_header.msglen = uint32(rspbuf.Len())
-	t.message_header.msgstreamid = 0
+	t.basic_header.csid = csid
+	t.message_header.msglen = uint32(b.Len())
+	t.message_header.msgstreamid = msgstreamid
 	t.message_header.msgtype = RTMP_MSG_TYPEID_AMF0
-	binary.Write(&t.payload.payload, binary.LittleEndian, rspbuf.Bytes())
+	t.payload.payload.Write(b.Bytes())
+
+	return r.SendMessage(&t)
+}
+
+func (r *RtmpConn) ResponseConnect(connect *Connect) {
+	props := amf.Object{
+		"fmsVer":       RTMP_FMS_VERSION,
+		"capabilities": 31,
+		"mode":         1,
+	}
+
+	info := amf.Object{
+		"level":          "status",
+		"code":           "NetConnection.Connect.Success",
+		"description":    "Connection succeeded.",
+		"objectEncoding": connect.objectencoding,
+	}
 
-	_, b := t.SerializeToBytes()
-	r.conn.Write(b)
+	r.SendCommand(RTMP_CSID_COMMAND, 0, "_result",
+		connect.transaction_id, props, info)
 }
 
 func (r *RtmpConn) HandleCreateStream(buf *bytes.Buffer) bool {
@@ -739,31 +968,9 @@ func (r *RtmpConn) HandleCreateStream(buf *bytes.Buffer) bool {
 
 	// create createStream packet which is from server to client
 	// it will specify stream id
-	var b bytes.Buffer
-	amf.EncodeString(&b, "_result")
-
-	var f float64 = float64(4)
-	amf.EncodeNumber(&b, f)
-	binary.Write(&b, binary.LittleEndian, byte(0x5))
-
-	f = 1
-	amf.EncodeNumber(&b, f)
-	binary.Write(&b, binary.LittleEndian, byte(0x5))
-
-	log.Println(spew.Sdump(b.Bytes()))
-
-	var rspt Trunk
-	rspt.basic_header.fmt = 0
-	rspt.basic_header.csid = 3
-	rspt.message_header.msglen = uint32(b.Len())
-	rspt.message_header.msgstreamid = 0 // fixed
-	rspt.message_header.msgtype = RTMP_MSG_TYPEID_AMF0
-	rspt.payload.payload.Write(b.Bytes())
-
-	_, bb := rspt.SerializeToBytes()
-
-	log.Println("len amf create stream =", len(b.Bytes()), spew.Sdump(bb))
-	r.conn.Write(bb[0:])
+	r.msgstreamid = RTMP_DEFAULT_MSG_STREAM_ID
+	r.SendCommand(RTMP_CSID_COMMAND, 0, "_result", cs.transaction_id, nil,
+		r.msgstreamid)
 	return true
 }
 
@@ -774,57 +981,211 @@ func (r *RtmpConn) HandlePublish(buf *bytes.Buffer) bool {
 	if ret := pub.Parse(buf); !ret {
 		return false
 	}
-	r.streamname = pub.publishing_name
+
+	// one stream per connection, a second publish would leave the first
+	// stream published forever
+	if r.publishing || r.playing {
+		r.SendOnStatus("error", "NetStream.Publish.BadConnection",
+			r.streamname+" is already in use on this connection")
+		return false
+	}
 
 	// insert new stream info
-	ls := new(LiveStream)
-	ls.pullnodemap = make(map[ClientNode]*PullInfo)
-	ls.gopcache.Init()
-	streammap[pub.publishing_name] = ls
+	ls, ok := streams.Publish(r.app, pub.publishing_name)
+	if !ok {
+		r.SendOnStatus("error", "NetStream.Publish.BadName",
+			pub.publishing_name+" is already published")
+		return false
+	}
 
-	var b bytes.Buffer
-	amf.EncodeString(&b, "onStatus")
-
-	var f float64 = 0
-	amf.EncodeNumber(&b, f)
-	binary.Write(&b, binary.LittleEndian, byte(0x5))
-
-	// todo
-	binary.Write(&b, binary.LittleEndian, byte(amf.AMF0_MARKER_OBJECT))
-	binary.Write(&b, binary.BigEndian, uint16(len("code")))
-	binary.Write(&b, binary.LittleEndian, []byte("code"))
-	binary.Write(&b, binary.LittleEndian, byte(amf.AMF0_MARKER_STRING))
-	binary.Write(&b, binary.BigEndian, uint16(len("NetStream.Play.Start")))
-	binary.Write(&b, binary.LittleEndian, []byte("NetStream.Play.Start"))
-
-	binary.Write(&b, binary.BigEndian, uint16(len("description")))
-	binary.Write(&b, binary.LittleEndian, []byte("description"))
-	binary.Write(&b, binary.LittleEndian, byte(amf.AMF0_MARKER_STRING))
-	binary.Write(&b, binary.BigEndian, uint16(len("start publish the string")))
-	binary.Write(&b, binary.LittleEndian, []byte("start publish the string"))
-
-	binary.Write(&b, binary.LittleEndian, byte(0))
-	binary.Write(&b, binary.LittleEndian, byte(0))
-	binary.Write(&b, binary.LittleEndian, byte(amf.AMF0_MARKER_OBJECT_END))
+	r.streamname = pub.publishing_name
+	r.stream = ls
+	r.publishing = true
 
-	log.Println(spew.Sdump(b.Bytes()))
+	r.SendOnStatus("status", "NetStream.Publish.Start",
+		pub.publishing_name+" is now published")
+	return true
+}
+
+func (r *RtmpConn) HandlePlay(buf *bytes.Buffer) bool {
+	var play Play
+	if ret := play.Parse(buf); !ret {
+		return false
+	}
+	log.Println("play:", spew.Sdump(play))
+
+	// one stream per connection, a second play would leak the first
+	// subscription and its play loop
+	if r.publishing || r.playing {
+		r.SendOnStatus("error", "NetStream.Play.Failed",
+			r.streamname+" is already in use on this connection")
+		return false
+	}
+
+	// register as a pull node of the stream, the cached metadata, sequence
+	// headers and gop come first through the channel
+	cn := NewClientNode(parseIPPort(r.conn.RemoteAddr().String()))
+	ls, pi, ok := streams.Subscribe(r.app, play.streamname, cn)
+	if !ok {
+		r.SendOnStatus("error", "NetStream.Play.StreamNotFound",
+			"stream not found: "+play.streamname)
+		return false
+	}
 
-	var rspt Trunk
-	rspt.Init()
-	rspt.basic_header.fmt = 0
-	rspt.basic_header.csid = 3
-	rspt.message_header.msglen = uint32(len(b.Bytes()))
-	rspt.message_header.msgstreamid = 0 // fixed
-	rspt.message_header.msgtype = RTMP_MSG_TYPEID_AMF0
-	rspt.payload.payload = *bytes.NewBuffer(b.Bytes())
+	r.streamname = play.streamname
+	r.stream = ls
+	r.pullnode = cn
+	r.playing = true
 
-	_, bb := rspt.SerializeToBytes()
+	r.SendUserControl(RTMP_USER_STREAM_BEGIN, r.msgstreamid)
+	r.SendOnStatus("status", "NetStream.Play.Reset",
+		"reset to play "+play.streamname)
+	r.SendOnStatus("status", "NetStream.Play.Start",
+		"start to play "+play.streamname)
 
-	log.Printf("len(publish response)=%d|%s\n", len(b.Bytes()), spew.Sdump(bb))
-	r.conn.Write(bb[0:])
+	go r.playLoop(pi)
 	return true
 }
 
+// playLoop turns the flv tags of the stream ring back into rtmp messages,
+// it runs aside the read loop which keeps handling the player's commands
+func (r *RtmpConn) playLoop(pi *PullInfo) {
+	for _, cached := range pi.takeReplay() {
+		if !r.playTag(cached) {
+			return
+		}
+	}
+
+	for {
+		tag, status := pi.Next(r.closed)
+		switch status {
+		case PULL_DONE:
+			return
+		case PULL_SLOW:
+			log.Println("player is too slow, close it")
+			r.conn.Close()
+			return
+		case PULL_END:
+			// the publisher is gone
+			r.SendUserControl(RTMP_USER_STREAM_EOF, r.msgstreamid)
+			r.SendOnStatus("status", "NetStream.Play.UnpublishNotify",
+				r.streamname+" is unpublished")
+			return
+		}
+
+		if !r.playTag(tag) {
+			return
+		}
+	}
+}
+
+// playTag sends a flv tag from the stream to the player, the connection is
+// closed on failure
+func (r *RtmpConn) playTag(tag bytes.Buffer) bool {
+	ret, fh, body := ParseFlvTag(tag.Bytes())
+	if !ret {
+		return true
+	}
+
+	var t Trunk
+	if fh.t == RTMP_MSG_TYPEID_AUDIO_PKT {
+		t.basic_header.csid = RTMP_CSID_AUDIO
+	} else if fh.t == RTMP_MSG_TYPEID_VIDEO_PKT {
+		t.basic_header.csid = RTMP_CSID_VIDEO
+	} else {
+		t.basic_header.csid = RTMP_CSID_STREAM
+	}
+	t.message_header.timestamp = fh.ts | uint32(fh.exts)<<24
+	t.message_header.msglen = uint32(len(body))
+	t.message_header.msgtype = int(fh.t)
+	t.message_header.msgstreamid = r.msgstreamid
+
+	// the body is shared by all the players of the stream, it's written
+	// from the ring without a copy
+	if !r.sendPayload(&t, body) {
+		log.Println("fail to send to player, close it")
+		r.conn.Close()
+		return false
+	}
+
+	return true
+}
+
+// SendUserControl sends a user control event about a message stream
+func (r *RtmpConn) SendUserControl(event uint16, streamid uint32) {
+	var t Trunk
+	t.basic_header.csid = 2 // fixed
+	t.message_header.msglen = 6
+	t.message_header.msgstreamid = 0 // fixed
+	t.message_header.msgtype = RTMP_MSG_TYPEID_PING_MSG
+	binary.Write(&t.payload.payload, binary.BigEndian, event)
+	binary.Write(&t.payload.payload, binary.BigEndian, streamid)
+
+	r.SendMessage(&t)
+}
+
+// SendOnStatus sends an onStatus command on the message stream
+func (r *RtmpConn) SendOnStatus(level string, code string, description string) {
+	info := amf.Object{
+		"level":       level,
+		"code":        code,
+		"description": description,
+	}
+
+	// onStatus has no transaction
+	r.SendCommand(RTMP_CSID_STREAM, r.msgstreamid, "onStatus", 0, nil, info)
+}
+
+// HandleFCStream answers the commands encoders send around publish
+func (r *RtmpConn) HandleFCStream(cmd string, buf *bytes.Buffer) bool {
+	var fc FCStream
+	fc.cmd = cmd
+	if ret := fc.Parse(buf); !ret {
+		return false
+	}
+	log.Println(cmd+":", spew.Sdump(fc))
+
+	switch cmd {
+	case "FCPublish":
+		r.SendCommand(RTMP_CSID_COMMAND, 0, "onFCPublish", 0, nil, amf.Object{
+			"code":        "NetStream.Publish.Start",
+			"description": fc.streamname,
+		})
+	case "FCUnpublish":
+		r.SendCommand(RTMP_CSID_COMMAND, 0, "onFCUnpublish", 0, nil, amf.Object{
+			"code":        "NetStream.Unpublish.Success",
+			"description": fc.streamname,
+		})
+		r.unpublish()
+	}
+
+	r.SendCommand(RTMP_CSID_COMMAND, 0, "_result", fc.transaction_id, nil,
+		amf.Undefined{})
+	return true
+}
+
+// unpublish stops the stream published on this connection, the media
+// received afterwards is dropped
+func (r *RtmpConn) unpublish() {
+	if !r.publishing {
+		return
+	}
+
+	log.Printf("unpublish %s\n", r.streamname)
+	r.publishing = false
+	streams.Unpublish(r.stream)
+}
+
+// release drops the references this connection holds on its stream
+func (r *RtmpConn) release() {
+	r.unpublish()
+
+	if r.playing {
+		r.playing = false
+		streams.Unsubscribe(r.stream, r.pullnode)
+	}
+}
+
 func (r *RtmpConn) HandleDeleteStream(buf *bytes.Buffer) bool {
 	var ds DeleteStream
 	if ret := ds.Parse(buf); !ret {
@@ -832,6 +1193,7 @@ func (r *RtmpConn) HandleDeleteStream(buf *bytes.Buffer) bool {
 	}
 
 	log.Println("deleteStream:", spew.Sdump(ds))
+	r.unpublish()
 	r.exit = true
 	return true
 }
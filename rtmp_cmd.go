@@ -3,111 +3,60 @@ package main
 import (
 	"bytes"
 	"go_rtmp_srv/amf"
+	"log"
 )
 
 type Connect struct {
 	cmd            string
 	transaction_id uint64
 
-	app         string
-	ttype       string // OH
-	flashver    string
-	swfurl      string
-	tcurl       string
-	fpad        bool
-	audiocodecs int
-	videocodecs int
-	videofunc   int
-	pageurl     string
+	app            string
+	ttype          string // OH
+	flashver       string
+	swfurl         string
+	tcurl          string
+	fpad           bool
+	audiocodecs    int
+	videocodecs    int
+	videofunc      int
+	pageurl        string
+	objectencoding int
+	props          amf.Object // the whole command object
 }
 
 func (c *Connect) Parse(buf *bytes.Buffer) bool {
 	c.cmd = "connect"
 
-	_, tid := amf.DecodeNumber(buf)
+	tid, err := amf.DecodeNumber(buf)
+	if err != nil {
+		log.Println("fail to decode connect transaction id:", err)
+		return false
+	}
 	c.transaction_id = uint64(tid)
 	if buf.Len() == 0 {
 		return true
 	}
 
-	buf.Next(1)
-
 	// parser cmd object
-	for {
-		ret, field := amf.DecodeObjectKey(buf)
-		if ret == false {
-			break
-		}
-
-		var f float64 = 0
-		var bret bool = false
-		switch field {
-		case "app":
-			bret, c.app = amf.DecodeString(buf)
-			if !bret {
-				return false
-			}
-		case "flashver":
-			bret, c.flashver = amf.DecodeString(buf)
-			if !bret {
-				return false
-			}
-		case "swfUrl":
-			bret, c.swfurl = amf.DecodeString(buf)
-			if !bret {
-				return false
-			}
-		case "tcUrl":
-			bret, c.tcurl = amf.DecodeString(buf)
-			if !bret {
-				return false
-			}
-		case "fpad":
-			bret, c.fpad = amf.DecodeBool(buf)
-			if !bret {
-				return false
-			}
-		case "audioCodecs":
-			bret, f = amf.DecodeNumber(buf)
-			if !bret {
-				return false
-			}
-			c.audiocodecs = int(f)
-		case "videoCodecs":
-			bret, f = amf.DecodeNumber(buf)
-			if !bret {
-				return false
-			}
-			c.videocodecs = int(f)
-		case "videoFunction":
-			bret, f = amf.DecodeNumber(buf)
-			if !bret {
-				return false
-			}
-			c.videofunc = int(f)
-		case "pageUrl":
-			bret, c.pageurl = amf.DecodeString(buf)
-			if !bret {
-				return false
-			}
-		case "type":
-			bret, c.ttype = amf.DecodeString(buf)
-			if !bret {
-				return false
-			}
-		default:
-			// skip this field
-			t := buf.Next(1)[0]
-			if t == amf.AMF0_MARKER_NUMBER {
-				amf.DecodeNumber(buf)
-			} else if t == amf.AMF0_MARKER_BOOL {
-				amf.DecodeBool(buf)
-			} else if t == amf.AMF0_MARKER_STRING {
-				amf.DecodeString(buf)
-			}
-		}
+	c.props, err = amf.DecodeObject(buf)
+	if err != nil {
+		log.Println("fail to decode connect command object:", err)
+		return false
 	}
 
+	c.app = c.props.String("app")
+	c.flashver = c.props.String("flashver")
+	c.swfurl = c.props.String("swfUrl")
+	c.tcurl = c.props.String("tcUrl")
+	c.fpad = c.props.Bool("fpad")
+	c.audiocodecs = int(c.props.Number("audioCodecs"))
+	c.videocodecs = int(c.props.Number("videoCodecs"))
+	c.videofunc = int(c.props.Number("videoFunction"))
+	c.pageurl = c.props.String("pageUrl")
+	c.ttype = c.props.String("type")
+	c.objectencoding = int(c.props.Number("objectEncoding"))
+
+	// optional user arguments are ignored
 	return true
 }
 
@@ -119,16 +68,20 @@ type CreateStream struct {
 func (c *CreateStream) Parse(buf *bytes.Buffer) bool {
 	c.cmd = "createStream"
 
-	_, tid := amf.DecodeNumber(buf)
+	tid, err := amf.DecodeNumber(buf)
+	if err != nil {
+		log.Println("fail to decode createStream transaction id:", err)
+		return false
+	}
 	c.transaction_id = uint64(tid)
 	if buf.Len() == 0 {
 		return true
 	}
 
-	f := buf.Next(1)[0]
-
-	if f == amf.AMF0_MARKER_OBJECT {
-		// parse object
+	// command object, null most of the time
+	if _, err := amf.DecodeObject(buf); err != nil {
+		log.Println("fail to decode createStream command object:", err)
+		return false
 	}
 
 	return true
@@ -144,12 +97,32 @@ type Publish struct {
 func (p *Publish) Parse(buf *bytes.Buffer) bool {
 	p.cmd = "publish"
 
-	_, tid := amf.DecodeNumber(buf)
+	tid, err := amf.DecodeNumber(buf)
+	if err != nil {
+		log.Println("fail to decode publish transaction id:", err)
+		return false
+	}
 	p.transaction_id = uint64(tid)
-	buf.Next(1) // null object
 
-	_, p.publishing_name = amf.DecodeString(buf)
-	_, p.publishing_type = amf.DecodeString(buf)
+	if err := amf.DecodeNull(buf); err != nil {
+		log.Println("fail to decode publish command object:", err)
+		return false
+	}
+
+	if p.publishing_name, err = amf.DecodeString(buf); err != nil {
+		log.Println("fail to decode publishing name:", err)
+		return false
+	}
+
+	// publishing type is optional, live by default
+	p.publishing_type = "live"
+	if buf.Len() > 0 {
+		if p.publishing_type, err = amf.DecodeString(buf); err != nil {
+			log.Println("fail to decode publishing type:", err)
+			return false
+		}
+	}
+
 	return true
 }
 
@@ -157,22 +130,56 @@ type Play struct {
 	cmd            string
 	transaction_id uint64
 	streamname     string
+	start          float64
+	duration       float64
+	reset          bool
 }
 
 func (p *Play) Parse(buf *bytes.Buffer) bool {
 	p.cmd = "play"
 
-	_, tid := amf.DecodeNumber(buf)
+	tid, err := amf.DecodeNumber(buf)
+	if err != nil {
+		log.Println("fail to decode play transaction id:", err)
+		return false
+	}
 	p.transaction_id = uint64(tid)
 	if buf.Len() == 0 {
 		return true
 	}
 
-	buf.Next(1) // null object
+	if err := amf.DecodeNull(buf); err != nil {
+		log.Println("fail to decode play command object:", err)
+		return false
+	}
 
-	_, p.streamname = amf.DecodeString(buf)
+	if p.streamname, err = amf.DecodeString(buf); err != nil {
+		log.Println("fail to decode play stream name:", err)
+		return false
+	}
+
+	// start, duration and reset are optional
+	p.start = -2
+	p.duration = -1
+	if buf.Len() > 0 {
+		if p.start, err = amf.DecodeNumber(buf); err != nil {
+			log.Println("fail to decode play start:", err)
+			return false
+		}
+	}
+	if buf.Len() > 0 {
+		if p.duration, err = amf.DecodeNumber(buf); err != nil {
+			log.Println("fail to decode play duration:", err)
+			return false
+		}
+	}
+	if buf.Len() > 0 {
+		if p.reset, err = amf.DecodeBool(buf); err != nil {
+			log.Println("fail to decode play reset:", err)
+			return false
+		}
+	}
 
-	// ignore start, duration, reset fields
 	return true
 }
 
@@ -185,16 +192,133 @@ type DeleteStream struct {
 func (d *DeleteStream) Parse(buf *bytes.Buffer) bool {
 	d.cmd = "deleteStream"
 
-	_, tid := amf.DecodeNumber(buf)
+	tid, err := amf.DecodeNumber(buf)
+	if err != nil {
+		log.Println("fail to decode deleteStream transaction id:", err)
+		return false
+	}
 	d.transaction_id = uint64(tid)
 	if buf.Len() == 0 {
 		return true
 	}
 
-	buf.Next(1) // null object
+	if err := amf.DecodeNull(buf); err != nil {
+		log.Println("fail to decode deleteStream command object:", err)
+		return false
+	}
 
-	_, streamid := amf.DecodeNumber(buf)
+	streamid, err := amf.DecodeNumber(buf)
+	if err != nil {
+		log.Println("fail to decode deleteStream stream id:", err)
+		return false
+	}
 	d.streamid = uint64(streamid)
 
 	return true
 }
+
+// releaseStream, FCPublish and FCUnpublish share the same arguments
+type FCStream struct {
+	cmd            string
+	transaction_id uint64
+	streamname     string
+}
+
+func (f *FCStream) Parse(buf *bytes.Buffer) bool {
+	tid, err := amf.DecodeNumber(buf)
+	if err != nil {
+		log.Printf("fail to decode %s transaction id: %s\n", f.cmd, err)
+		return false
+	}
+	f.transaction_id = uint64(tid)
+	if buf.Len() == 0 {
+		return true
+	}
+
+	if err := amf.DecodeNull(buf); err != nil {
+		log.Printf("fail to decode %s command object: %s\n", f.cmd, err)
+		return false
+	}
+
+	if buf.Len() == 0 {
+		return true
+	}
+
+	if f.streamname, err = amf.DecodeString(buf); err != nil {
+		log.Printf("fail to decode %s stream name: %s\n", f.cmd, err)
+		return false
+	}
+
+	return true
+}
+
+// DataMessage is a data message from the publisher: a handler name and its
+// values, such as onMetaData and its properties. The @setDataFrame wrapper
+// is removed.
+type DataMessage struct {
+	name   string
+	values []interface{}
+}
+
+func (d *DataMessage) Parse(buf *bytes.Buffer) bool {
+	dec := amf.NewDecoder(buf)
+	v, err := dec.Decode()
+	if err != nil {
+		log.Println("fail to decode data message name:", err)
+		return false
+	}
+
+	name, ok := v.(string)
+	if !ok {
+		log.Printf("data message name is a %T, not a string\n", v)
+		return false
+	}
+
+	for buf.Len() > 0 {
+		v, err := dec.Decode()
+		if err != nil {
+			log.Println("fail to decode data message values:", err)
+			return false
+		}
+		d.values = append(d.values, v)
+	}
+
+	d.name = name
+	if name == "@setDataFrame" && len(d.values) > 0 {
+		if inner, ok := d.values[0].(string); ok {
+			d.name = inner
+			d.values = d.values[1:]
+		}
+	}
+
+	return true
+}
+
+// Encode writes the message back without the @setDataFrame wrapper
+func (d *DataMessage) Encode(buf *bytes.Buffer) bool {
+	amf.EncodeString(buf, d.name)
+	for _, v := range d.values {
+		if err := amf.Encode(buf, v); err != nil {
+			log.Println("fail to encode data message:", err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// MetaData gives the properties of an onMetaData message
+func (d *DataMessage) MetaData() (amf.EcmaArray, bool) {
+	if d.name != "onMetaData" || len(d.values) == 0 {
+		return nil, false
+	}
+
+	switch v := d.values[0].(type) {
+	case amf.EcmaArray:
+		return v, true
+	case amf.Object:
+		return amf.EcmaArray(v), true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+
+	"go_rtmp_srv/amf"
+)
+
+// testConn keeps what is written to it
+type testConn struct {
+	net.Conn
+	lock sync.Mutex
+	out  bytes.Buffer
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.out.Write(b)
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+
+func (c *testConn) Close() error {
+	return nil
+}
+
+func (c *testConn) Bytes() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]byte(nil), c.out.Bytes()...)
+}
+
+// newTestConn gives a connection past connect and createStream
+func newTestConn(app string) (*RtmpConn, *testConn) {
+	c := new(testConn)
+	r := &RtmpConn{
+		conn:            c,
+		app:             app,
+		trunk_size:      RTMP_DEFAULT_TRUNK_SIZE,
+		out_trunk_size:  RTMP_DEFAULT_TRUNK_SIZE,
+		chunkstreams:    make(map[uint32]*ChunkStream),
+		outchunkstreams: make(map[uint32]*ChunkStream),
+		stream_created:  true,
+		msgstreamid:     RTMP_DEFAULT_MSG_STREAM_ID,
+		closed:          make(chan struct{}),
+	}
+	return r, c
+}
+
+type testMessage struct {
+	fmt     int // of the header of the first chunk
+	csid    int
+	header  MessageHeader
+	payload []byte
+}
+
+// readMessages reassembles the messages of the chunks in b, applying the
+// set chunk size and abort messages
+func readMessages(t *testing.T, b []byte, chunksize uint32) []testMessage {
+	t.Helper()
+	r := &RtmpConn{
+		trunk_size:   chunksize,
+		chunkstreams: make(map[uint32]*ChunkStream),
+	}
+	r.reqbuf.Write(b)
+
+	var msgs []testMessage
+	var first = -1
+	for r.reqbuf.Len() > 0 {
+		if first < 0 {
+			first = int(r.reqbuf.Bytes()[0] >> 6)
+		}
+		r.trunk.Init()
+		switch r.readChunk() {
+		case 0:
+			msgs = append(msgs, testMessage{first, r.trunk.basic_header.csid, r.trunk.message_header,
+				append([]byte(nil), r.trunk.payload.payload.Bytes()...)})
+			first = -1
+			if msgtype := r.trunk.message_header.msgtype; msgtype == RTMP_MSG_TYPEID_SET_PKT_SIZE ||
+				msgtype == RTMP_MSG_TYPEID_ABORT_MSG {
+				if !r.handleProtocolControlMessage() {
+					t.Fatalf("bad control message after %d messages", len(msgs))
+				}
+			}
+		case 2:
+		default:
+			t.Fatalf("bad chunk after %d messages, %d bytes left", len(msgs), r.reqbuf.Len())
+		}
+	}
+	return msgs
+}
+
+// statusCodes gives the codes of the onStatus commands in b
+func statusCodes(t *testing.T, b []byte) []string {
+	t.Helper()
+	var codes []string
+	for _, m := range readMessages(t, b, RTMP_DEFAULT_TRUNK_SIZE) {
+		if m.header.msgtype != RTMP_MSG_TYPEID_AMF0 {
+			continue
+		}
+		buf := bytes.NewBuffer(m.payload)
+		if cmd, err := amf.DecodeString(buf); err != nil || cmd != "onStatus" {
+			continue
+		}
+		amf.DecodeNumber(buf)
+		amf.DecodeNull(buf)
+		info, err := amf.DecodeObject(buf)
+		if err != nil {
+			t.Fatalf("onStatus without info: %v", err)
+		}
+		codes = append(codes, info.String("code"))
+	}
+	return codes
+}
+
+// streamCommand gives the arguments of publish and play after their name
+func streamCommand(name string) *bytes.Buffer {
+	var b bytes.Buffer
+	amf.EncodeNumber(&b, 0)
+	amf.EncodeNull(&b)
+	amf.EncodeString(&b, name)
+	return &b
+}
+
+func pullNodes(ls *LiveStream) int {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	return len(ls.pullnodemap)
+}
+
+func TestOneStreamPerConnection(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  string
+		second string
+		code   string
+	}{
+		{"publish twice", "publish", "publish", "NetStream.Publish.BadConnection"},
+		{"play twice", "play", "play", "NetStream.Play.Failed"},
+		{"play after publish", "publish", "play", "NetStream.Play.Failed"},
+		{"publish after play", "play", "publish", "NetStream.Publish.BadConnection"},
+	}
+
+	for _, tt := range tests {
+		app := "once " + tt.name
+		// the streams to play are published by someone else
+		played1, _ := streams.Publish(app, "played1")
+		played2, _ := streams.Publish(app, "played2")
+
+		r, c := newTestConn(app)
+		handle := func(cmd string, n string) bool {
+			if cmd == "publish" {
+				return r.HandlePublish(streamCommand("published" + n))
+			}
+			return r.HandlePlay(streamCommand("played" + n))
+		}
+
+		if !handle(tt.first, "1") {
+			t.Fatalf("%s: first %s refused", tt.name, tt.first)
+		}
+		stream := r.stream
+		if handle(tt.second, "2") {
+			t.Errorf("%s: second %s accepted", tt.name, tt.second)
+		}
+
+		codes := statusCodes(t, c.Bytes())
+		if len(codes) == 0 || codes[len(codes)-1] != tt.code {
+			t.Errorf("%s: got status %v, want %s last", tt.name, codes, tt.code)
+		}
+		if r.stream != stream || r.publishing != (tt.first == "publish") ||
+			r.playing != (tt.first == "play") {
+			t.Errorf("%s: the first stream was replaced", tt.name)
+		}
+		if _, ok := streams.Lookup(app, "published2"); ok {
+			t.Errorf("%s: second stream published", tt.name)
+		}
+		if n := pullNodes(played2); n != 0 {
+			t.Errorf("%s: %d pull nodes on the second stream", tt.name, n)
+		}
+
+		r.release()
+		close(r.closed)
+		if _, ok := streams.Lookup(app, "published1"); ok {
+			t.Errorf("%s: first stream still published", tt.name)
+		}
+		if n := pullNodes(played1); n != 0 {
+			t.Errorf("%s: %d pull nodes on the first stream", tt.name, n)
+		}
+		streams.Unpublish(played1)
+		streams.Unpublish(played2)
+	}
+}
+
+type testSend struct {
+	ts  uint32
+	len int
+}
+
+// sendVideo sends messages of the given timestamps and lengths on the
+// video chunk stream
+func sendVideo(r *RtmpConn, sends []testSend) [][]byte {
+	var payloads [][]byte
+	for i, s := range sends {
+		var t Trunk
+		t.basic_header.csid = RTMP_CSID_VIDEO
+		t.message_header.timestamp = s.ts
+		t.message_header.msglen = uint32(s.len)
+		t.message_header.msgtype = RTMP_MSG_TYPEID_VIDEO_PKT
+		t.message_header.msgstreamid = RTMP_DEFAULT_MSG_STREAM_ID
+		payload := bytes.Repeat([]byte{byte(i + 1)}, s.len)
+		t.payload.payload.Write(payload)
+		r.SendMessage(&t)
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+func TestSendHeaderCompression(t *testing.T) {
+	tests := []struct {
+		name  string
+		sends []testSend
+		fmts  []int
+	}{
+		{"same delta after fmt 0", []testSend{{40, 10}, {80, 10}}, []int{0, 2}},
+		{"same timestamp after fmt 0", []testSend{{0, 10}, {0, 10}}, []int{0, 2}},
+		{"same delta after fmt 2", []testSend{{0, 10}, {40, 10}, {80, 10}, {120, 10}}, []int{0, 2, 3, 3}},
+		{"same delta after fmt 1", []testSend{{0, 10}, {40, 20}, {80, 20}}, []int{0, 1, 3}},
+		{"new delta after fmt 3", []testSend{{0, 10}, {40, 10}, {80, 10}, {100, 10}}, []int{0, 2, 3, 2}},
+		{"timestamp going back", []testSend{{80, 10}, {40, 10}}, []int{0, 0}},
+		{"chunked", []testSend{{40, 300}, {80, 300}, {120, 300}}, []int{0, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		r, c := newTestConn("compression")
+		payloads := sendVideo(r, tt.sends)
+
+		msgs := readMessages(t, c.Bytes(), r.out_trunk_size)
+		if len(msgs) != len(tt.sends) {
+			t.Errorf("%s: %d messages", tt.name, len(msgs))
+			continue
+		}
+		for i, m := range msgs {
+			if m.fmt != tt.fmts[i] {
+				t.Errorf("%s: message %d of fmt %d, want %d", tt.name, i, m.fmt, tt.fmts[i])
+			}
+			if m.header.timestamp != tt.sends[i].ts {
+				t.Errorf("%s: message %d at %d, want %d", tt.name, i, m.header.timestamp, tt.sends[i].ts)
+			}
+			if !bytes.Equal(m.payload, payloads[i]) {
+				t.Errorf("%s: message %d changed", tt.name, i)
+			}
+		}
+	}
+}
+
+// serialize gives the chunks of a message with a fmt 0 header
+func serialize(t *testing.T, csid int, ts uint32, payload []byte, chunksize uint32) [][]byte {
+	t.Helper()
+	var tr Trunk
+	tr.basic_header.csid = csid
+	tr.message_header.timestamp = ts
+	tr.message_header.msglen = uint32(len(payload))
+	tr.message_header.msgtype = RTMP_MSG_TYPEID_VIDEO_PKT
+	tr.message_header.msgstreamid = RTMP_DEFAULT_MSG_STREAM_ID
+	ret, bufs := tr.serializeBuffers(chunksize, payload)
+	if !ret {
+		t.Fatalf("csid %d: not serialized", csid)
+	}
+
+	// the headers and the payloads alternate, a header alone ends an
+	// empty message
+	var chunks [][]byte
+	for i := 0; i < len(bufs); i += 2 {
+		chunk := append([]byte(nil), bufs[i]...)
+		if i+1 < len(bufs) {
+			chunk = append(chunk, bufs[i+1]...)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func TestReadInterleavedChunks(t *testing.T) {
+	// the basic header of each csid is of another size
+	csids := []int{3, 100, 1000}
+	var all [][][]byte
+	var payloads [][]byte
+	for i, csid := range csids {
+		payload := bytes.Repeat([]byte{byte(i + 1)}, 300)
+		all = append(all, serialize(t, csid, uint32(i*10), payload, 128))
+		payloads = append(payloads, payload)
+	}
+
+	// a chunk of each message in turn
+	var b []byte
+	for i := 0; i < len(all[0]); i++ {
+		for _, chunks := range all {
+			b = append(b, chunks[i]...)
+		}
+	}
+
+	msgs := readMessages(t, b, 128)
+	if len(msgs) != len(csids) {
+		t.Fatalf("%d messages", len(msgs))
+	}
+	for i, m := range msgs {
+		if m.csid != csids[i] || m.header.timestamp != uint32(i*10) {
+			t.Errorf("message %d on csid %d at %d", i, m.csid, m.header.timestamp)
+		}
+		if !bytes.Equal(m.payload, payloads[i]) {
+			t.Errorf("message %d on csid %d changed", i, m.csid)
+		}
+	}
+}
+
+func TestReadChunkPartial(t *testing.T) {
+	chunks := serialize(t, 3, 40, bytes.Repeat([]byte{1}, 200), 128)
+
+	tests := []struct {
+		name string
+		b    []byte
+		ret  int
+	}{
+		{"empty", nil, 1},
+		{"basic header of 2 bytes cut", []byte{0x00}, 1},
+		{"basic header of 3 bytes cut", []byte{0x01, 0x00}, 1},
+		{"message header cut", chunks[0][:8], 1},
+		{"payload cut", chunks[0][:len(chunks[0])-1], 1},
+		{"first chunk", chunks[0], 2},
+		{"fmt 3 without a header", chunks[1], -1},
+		{"fmt 1 without a header", []byte{0x43, 0, 0, 0, 0, 0, 1, 9, 0}, -1},
+	}
+
+	for _, tt := range tests {
+		r := &RtmpConn{
+			trunk_size:   128,
+			chunkstreams: make(map[uint32]*ChunkStream),
+		}
+		r.reqbuf.Write(tt.b)
+		r.trunk.Init()
+		if ret := r.readChunk(); ret != tt.ret {
+			t.Errorf("%s: got %d, want %d", tt.name, ret, tt.ret)
+		}
+		// nothing is consumed until the chunk is whole
+		if tt.ret == 1 && r.reqbuf.Len() != len(tt.b) {
+			t.Errorf("%s: %d of %d bytes left", tt.name, r.reqbuf.Len(), len(tt.b))
+		}
+	}
+}
+
+func TestExtendedTimestamp(t *testing.T) {
+	tests := []struct {
+		name     string
+		sends    []testSend
+		extended []bool // in the header of the first chunk, fmt 3 has none
+	}{
+		{"below", []testSend{{0xfffffe, 10}}, []bool{false}},
+		{"at", []testSend{{0xffffff, 10}}, []bool{true}},
+		{"above", []testSend{{0x1000000, 10}}, []bool{true}},
+		{"largest", []testSend{{0xffffffff, 10}}, []bool{true}},
+		{"chunked", []testSend{{0x1000000, 300}}, []bool{true}},
+		{"crossing", []testSend{{0xfffff0, 300}, {0x1000010, 300}, {0x1000030, 300}},
+			[]bool{false, false, false}},
+		{"delta at", []testSend{{0, 300}, {0xffffff, 300}, {0x1fffffe, 300}}, []bool{false, true, false}},
+		{"delta below", []testSend{{0x1000000, 10}, {0x1fffffe, 10}, {0x2fffffc, 10}}, []bool{true, false, false}},
+	}
+
+	for _, tt := range tests {
+		r, c := newTestConn("extended")
+		var payloads [][]byte
+		for i, s := range tt.sends {
+			start := len(c.Bytes())
+			payloads = append(payloads, sendVideo(r, []testSend{s})...)
+			b := c.Bytes()
+			if b[start]>>6 == 3 {
+				continue
+			}
+			if ext := bytes.Equal(b[start+1:start+4], []byte{0xff, 0xff, 0xff}); ext != tt.extended[i] {
+				t.Errorf("%s: message %d extended %t", tt.name, i, ext)
+			}
+		}
+
+		msgs := readMessages(t, c.Bytes(), r.out_trunk_size)
+		if len(msgs) != len(tt.sends) {
+			t.Errorf("%s: %d messages", tt.name, len(msgs))
+			continue
+		}
+		for i, m := range msgs {
+			if m.header.timestamp != tt.sends[i].ts {
+				t.Errorf("%s: message %d at 0x%x, want 0x%x", tt.name, i, m.header.timestamp, tt.sends[i].ts)
+			}
+			if !bytes.Equal(m.payload, payloads[i]) {
+				t.Errorf("%s: message %d changed", tt.name, i)
+			}
+		}
+	}
+}
+
+func TestChunkSizes(t *testing.T) {
+	for _, size := range []uint32{1, 127, 128, 129, 4096, 65536, RTMP_MAX_TRUNK_SIZE} {
+		for _, n := range []int{0, 1, 127, 128, 129, 256, 1000, 70000} {
+			r, c := newTestConn("chunk sizes")
+			r.out_trunk_size = size
+			payloads := sendVideo(r, []testSend{{40, n}, {80, n}})
+
+			msgs := readMessages(t, c.Bytes(), size)
+			if len(msgs) != 2 {
+				t.Errorf("%d bytes in chunks of %d: %d messages", n, size, len(msgs))
+				continue
+			}
+			for i, m := range msgs {
+				if !bytes.Equal(m.payload, payloads[i]) {
+					t.Errorf("%d bytes in chunks of %d: message %d changed", n, size, i)
+				}
+			}
+		}
+	}
+}
+
+func TestSetChunkSize(t *testing.T) {
+	r, c := newTestConn("set chunk size")
+	before := sendVideo(r, []testSend{{0, 1000}})
+	r.SendSetChunkSize(4096)
+	if r.out_trunk_size != 4096 {
+		t.Fatalf("chunk size %d", r.out_trunk_size)
+	}
+	after := sendVideo(r, []testSend{{40, 5000}})
+
+	// the reader starts with the default size and takes the new one
+	msgs := readMessages(t, c.Bytes(), RTMP_DEFAULT_TRUNK_SIZE)
+	if len(msgs) != 3 || msgs[1].header.msgtype != RTMP_MSG_TYPEID_SET_PKT_SIZE {
+		t.Fatalf("%d messages", len(msgs))
+	}
+	if !bytes.Equal(msgs[0].payload, before[0]) || !bytes.Equal(msgs[2].payload, after[0]) {
+		t.Error("messages changed")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	aborted := serialize(t, 4, 0, bytes.Repeat([]byte{1}, 300), 128)
+	payload := bytes.Repeat([]byte{2}, 300)
+	next := serialize(t, 4, 0, payload, 128)
+
+	// the first chunk of a message, the abort of its chunk stream, then a
+	// message of the same header which only has fmt 3 chunks
+	b := append([]byte(nil), aborted[0]...)
+	b = append(b, 0x02, 0, 0, 0, 0, 0, 4, RTMP_MSG_TYPEID_ABORT_MSG, 0, 0, 0, 0, 0, 0, 0, 4)
+	b = append(b, 0xc4)
+	b = append(b, payload[:128]...)
+	for _, chunk := range next[1:] {
+		b = append(b, chunk...)
+	}
+
+	msgs := readMessages(t, b, 128)
+	if len(msgs) != 2 || msgs[0].header.msgtype != RTMP_MSG_TYPEID_ABORT_MSG {
+		t.Fatalf("%d messages", len(msgs))
+	}
+	if m := msgs[1]; m.csid != 4 || !bytes.Equal(m.payload, payload) {
+		t.Errorf("message after the abort on csid %d changed", m.csid)
+	}
+}
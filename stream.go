@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientNode identifies a pull node by a session id, unique even for
+// viewers sharing an address
+type ClientNode struct {
+	id   uint64
+	addr string // ip:port of the viewer, without port behind a proxy
+}
+
+var last_session_id uint64
+
+func NewClientNode(ip net.IP, port uint16) ClientNode {
+	var cn ClientNode
+	cn.id = atomic.AddUint64(&last_session_id, 1)
+	if port == 0 {
+		cn.addr = ip.String()
+	} else {
+		cn.addr = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	}
+	return cn
+}
+
+func (cn ClientNode) String() string {
+	return fmt.Sprintf("#%d %s", cn.id, cn.addr)
+}
+
+// what to do with a pull node that doesn't read fast enough
+const (
+	SLOW_DROP_TO_KEYFRAME = iota // drop everything until the next key frame
+	SLOW_DROP_NONREF             // drop the non reference frames first
+	SLOW_DISCONNECT              // drop to the key frame, disconnect on lag
+)
+
+var slow_policy_name = map[int]string{
+	SLOW_DROP_TO_KEYFRAME: "keyframe",
+	SLOW_DROP_NONREF:      "nonref",
+	SLOW_DISCONNECT:       "disconnect",
+}
+
+func parseSlowPolicy(name string) (int, bool) {
+	for policy, n := range slow_policy_name {
+		if n == name {
+			return policy, true
+		}
+	}
+	return 0, false
+}
+
+// SubscriberConf sets how the pull nodes read the streams
+type SubscriberConf struct {
+	queue_size int           // tags of the ring, how far a pull node can lag
+	policy     int           // SLOW_*
+	max_lag    time.Duration // SLOW_DISCONNECT, age of the tags read
+}
+
+var default_subscriber_conf = SubscriberConf{
+	queue_size: 1024,
+	policy:     SLOW_DROP_TO_KEYFRAME,
+	max_lag:    5 * time.Second,
+}
+
+// PullInfo is the state of a pull node reading a stream
+type PullInfo struct {
+	ring   *RingBuffer
+	replay []bytes.Buffer // tags to write before the ones of the ring
+	conf   SubscriberConf
+
+	// owned by the pull node, next and dropped are read by the stats
+	next    uint64 // sequence of the next tag in the ring
+	waitkey bool   // dropping until the next key frame
+	slow    bool   // disconnected for being too slow
+	dropped uint64 // frames
+}
+
+// takeReplay gives the metadata, the sequence headers and the gop as they
+// were when the pull node came, only once
+func (pi *PullInfo) takeReplay() []bytes.Buffer {
+	replay := pi.replay
+	pi.replay = nil
+	return replay
+}
+
+// max number of tags in a gop cache, a longer gop is not cached
+const GOP_CACHE_MAX_TAGS = 4096
+
+type LiveStream struct {
+	name string
+	app  string
+
+	ring *RingBuffer
+
+	// protects the fields below, taken by the publisher to dispatch and by
+	// the pull nodes to register
+	lock        sync.Mutex
+	gopcache    []bytes.Buffer // tags since the latest key frame, never modified
+	metadata    bytes.Buffer   // flv tag of the latest onMetaData
+	videoseq    bytes.Buffer   // flv tag of the latest AVC/HEVC configuration
+	audioseq    bytes.Buffer   // flv tag of the latest AAC AudioSpecificConfig
+	hasaudio    bool           // seen or announced by the metadata
+	hasvideo    bool
+	pullnodemap map[ClientNode]*PullInfo
+
+	// owned by the registry lock
+	start       time.Time // latest publish
+	publishers  int
+	subscribers int
+	ended       bool        // removed, the ring is closed
+	grace_timer *time.Timer // ends the stream if no publisher comes back
+}
+
+const (
+	STREAM_EVENT_CREATED = iota // the first publisher came
+	STREAM_EVENT_REMOVED        // the publisher left for good
+)
+
+var stream_event_name = map[int]string{
+	STREAM_EVENT_CREATED: "created",
+	STREAM_EVENT_REMOVED: "removed",
+}
+
+type StreamListener func(event int, ls *LiveStream)
+
+// StreamRegistry maps app/name to live streams for both the rtmp and the
+// http sides. A stream is created by its publisher and is removed when
+// the publisher leaves, closing the ring of its pull nodes. With a
+// grace period the stream is kept that long so that a reconnecting
+// publisher takes it back without dropping the viewers.
+type StreamRegistry struct {
+	lock      sync.RWMutex
+	streams   map[string]*LiveStream
+	listeners []StreamListener
+	grace     time.Duration
+	subconf   SubscriberConf
+}
+
+func NewStreamRegistry() *StreamRegistry {
+	sr := new(StreamRegistry)
+	sr.streams = make(map[string]*LiveStream)
+	sr.subconf = default_subscriber_conf
+	return sr
+}
+
+// stream registry shared by all the connections
+var streams = NewStreamRegistry()
+
+// OnEvent registers a listener of streams appearing or disappearing, it's
+// called outside of the registry lock
+func (sr *StreamRegistry) OnEvent(l StreamListener) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	sr.listeners = append(sr.listeners, l)
+}
+
+func (sr *StreamRegistry) SetGracePeriod(grace time.Duration) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	sr.grace = grace
+}
+
+// SetSubscriberConf applies to the next pull nodes
+func (sr *StreamRegistry) SetSubscriberConf(conf SubscriberConf) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	sr.subconf = conf
+}
+
+func (sr *StreamRegistry) notify(event int, ls *LiveStream) {
+	sr.lock.RLock()
+	listeners := sr.listeners
+	sr.lock.RUnlock()
+
+	log.Printf("stream %s %s\n", ls.name, stream_event_name[event])
+	for _, l := range listeners {
+		l(event, ls)
+	}
+}
+
+// streamKey names a stream in the registry, the same name can be published
+// in several apps
+func streamKey(app string, name string) string {
+	return app + "/" + name
+}
+
+// splitStreamKey gives the app and the name of app/name, the name is after
+// the last slash
+func splitStreamKey(key string) (string, string) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
+}
+
+func (sr *StreamRegistry) Lookup(app string, name string) (*LiveStream, bool) {
+	sr.lock.RLock()
+	defer sr.lock.RUnlock()
+
+	ls, ok := sr.streams[streamKey(app, name)]
+	return ls, ok
+}
+
+// Len gives the number of streams
+func (sr *StreamRegistry) Len() int {
+	sr.lock.RLock()
+	defer sr.lock.RUnlock()
+
+	return len(sr.streams)
+}
+
+// Publish creates the stream or takes it back if only subscribers are
+// left. It fails if the stream already has a publisher.
+func (sr *StreamRegistry) Publish(app string, name string) (*LiveStream, bool) {
+	sr.lock.Lock()
+
+	key := streamKey(app, name)
+	ls, ok := sr.streams[key]
+	if ok && ls.publishers > 0 {
+		sr.lock.Unlock()
+		return nil, false
+	}
+
+	if ok && ls.grace_timer != nil {
+		log.Printf("stream %s is published again\n", key)
+		ls.grace_timer.Stop()
+		ls.grace_timer = nil
+
+		// the gop of the former publisher is stale, its sequence headers
+		// and metadata are kept until the new ones come
+		ls.lock.Lock()
+		ls.gopcache = nil
+		ls.lock.Unlock()
+	}
+
+	created := !ok
+	if created {
+		ls = new(LiveStream)
+		ls.name = name
+		ls.app = app
+		ls.pullnodemap = make(map[ClientNode]*PullInfo)
+		ls.ring = NewRingBuffer(sr.subconf.queue_size)
+		sr.streams[key] = ls
+	}
+	ls.publishers++
+	ls.start = time.Now()
+	sr.lock.Unlock()
+
+	if created {
+		sr.notify(STREAM_EVENT_CREATED, ls)
+	}
+	return ls, true
+}
+
+// dispatch hands a tag to the pull nodes through the ring, whatever their
+// number. ls.lock must be held.
+func (ls *LiveStream) dispatch(tag bytes.Buffer) {
+	ls.ring.Append(tag, ls.tagKind(tag))
+}
+
+// kinds of tags for the slow consumers
+const (
+	TAG_CONFIG   = iota // metadata and sequence headers, never dropped on purpose
+	TAG_KEYFRAME        // where a dropping pull node starts again
+	TAG_FRAME
+	TAG_NONREF // can be dropped alone
+)
+
+// tagKind tells how a tag can be dropped. ls.lock must be held.
+func (ls *LiveStream) tagKind(tag bytes.Buffer) int {
+	ret, fh, body := ParseFlvTag(tag.Bytes())
+	if !ret {
+		return TAG_FRAME
+	}
+
+	switch fh.t {
+	case RTMP_MSG_TYPEID_VIDEO_PKT:
+		if isVideoSeqHeader(body) {
+			return TAG_CONFIG
+		} else if isKeyFrame(body) {
+			return TAG_KEYFRAME
+		} else if isNonRefFrame(body) {
+			return TAG_NONREF
+		}
+		return TAG_FRAME
+	case RTMP_MSG_TYPEID_AUDIO_PKT:
+		if isAudioSeqHeader(body) {
+			return TAG_CONFIG
+		} else if !ls.hasvideo {
+			// any audio frame can start again
+			return TAG_KEYFRAME
+		}
+		return TAG_FRAME
+	}
+
+	return TAG_CONFIG
+}
+
+// FLVFlags gives the tracks of the flv header, both if none is known yet
+func (ls *LiveStream) FLVFlags() byte {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	var flags byte
+	if ls.hasaudio {
+		flags |= FLV_HEADER_AUDIO
+	}
+	if ls.hasvideo {
+		flags |= FLV_HEADER_VIDEO
+	}
+
+	if flags == 0 {
+		flags = FLV_HEADER_AUDIO | FLV_HEADER_VIDEO
+	}
+	return flags
+}
+
+// cacheTag keeps the tags of the current gop, a key frame starts a new one.
+// The cached tags are shared with the pull nodes so a new gop gets a new
+// slice rather than reusing the former one. ls.lock must be held.
+func (ls *LiveStream) cacheTag(tag bytes.Buffer, keyframe bool) {
+	if keyframe {
+		ls.gopcache = nil
+	} else if len(ls.gopcache) == 0 {
+		// wait for a key frame
+		return
+	} else if len(ls.gopcache) >= GOP_CACHE_MAX_TAGS {
+		log.Printf("gop of stream %s is too long, drop it\n", ls.name)
+		ls.gopcache = nil
+		return
+	}
+
+	ls.gopcache = append(ls.gopcache, tag)
+}
+
+// gopSnapshot gives the cached gop, appending to it doesn't change the
+// snapshot. ls.lock must be held.
+func (ls *LiveStream) gopSnapshot() []bytes.Buffer {
+	n := len(ls.gopcache)
+	return ls.gopcache[:n:n]
+}
+
+// Unpublish releases the publisher reference, the stream ends now or
+// after the grace period
+func (sr *StreamRegistry) Unpublish(ls *LiveStream) {
+	sr.lock.Lock()
+	if ls.publishers > 0 {
+		ls.publishers--
+	}
+
+	if ls.publishers > 0 || ls.ended {
+		sr.lock.Unlock()
+		return
+	}
+
+	if sr.grace > 0 {
+		log.Printf("stream %s unpublished, wait %s for its publisher\n",
+			ls.name, sr.grace)
+		ls.grace_timer = time.AfterFunc(sr.grace, func() {
+			sr.expire(ls)
+		})
+		sr.lock.Unlock()
+		return
+	}
+
+	sr.endLocked(ls)
+	sr.lock.Unlock()
+
+	sr.notify(STREAM_EVENT_REMOVED, ls)
+}
+
+// expire ends the stream at the end of the grace period unless it has been
+// published again
+func (sr *StreamRegistry) expire(ls *LiveStream) {
+	sr.lock.Lock()
+	if ls.publishers > 0 || ls.ended || ls.grace_timer == nil {
+		sr.lock.Unlock()
+		return
+	}
+
+	ls.grace_timer = nil
+	sr.endLocked(ls)
+	sr.lock.Unlock()
+
+	sr.notify(STREAM_EVENT_REMOVED, ls)
+}
+
+// endLocked removes the stream and closes its ring so that the pull nodes
+// stop, it must be called with the registry lock held
+func (sr *StreamRegistry) endLocked(ls *LiveStream) {
+	ls.ended = true
+	key := streamKey(ls.app, ls.name)
+	if sr.streams[key] == ls {
+		delete(sr.streams, key)
+	}
+
+	ls.ring.Close()
+
+	ls.lock.Lock()
+	for cn := range ls.pullnodemap {
+		delete(ls.pullnodemap, cn)
+	}
+	ls.subscribers = 0
+	ls.lock.Unlock()
+}
+
+// Subscribe registers a pull node on a published stream
+func (sr *StreamRegistry) Subscribe(app string, name string, cn ClientNode) (*LiveStream, *PullInfo, bool) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	// a stream in its grace period can be subscribed
+	ls, ok := sr.streams[streamKey(app, name)]
+	if !ok || ls.ended {
+		return nil, nil, false
+	}
+
+	var pi *PullInfo = new(PullInfo)
+	pi.ring = ls.ring
+	pi.conf = sr.subconf
+
+	// the publisher holds the lock while it dispatches, the pull node
+	// starts right after the replayed tags
+	ls.lock.Lock()
+	for _, b := range []bytes.Buffer{ls.metadata, ls.audioseq, ls.videoseq} {
+		if b.Len() > 0 {
+			pi.replay = append(pi.replay, b)
+		}
+	}
+	pi.replay = append(pi.replay, ls.gopSnapshot()...)
+	pi.next = ls.ring.Head()
+	ls.pullnodemap[cn] = pi
+	ls.lock.Unlock()
+
+	ls.subscribers++
+	return ls, pi, true
+}
+
+// Unsubscribe removes the pull node and releases its reference
+func (sr *StreamRegistry) Unsubscribe(ls *LiveStream, cn ClientNode) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+
+	// already gone if the stream ended
+	if pi, ok := ls.pullnodemap[cn]; ok {
+		if dropped := atomic.LoadUint64(&pi.dropped); dropped > 0 {
+			log.Printf("pull node %s of stream %s dropped %d frames\n",
+				cn, ls.name, dropped)
+		}
+		delete(ls.pullnodemap, cn)
+		ls.subscribers--
+	}
+}
+
+type SubscriberStat struct {
+	Session uint64 `json:"session"`
+	Client  string `json:"client"`
+	Lag     uint64 `json:"lag"` // tags
+	Dropped uint64 `json:"dropped"`
+}
+
+type StreamStat struct {
+	App         string           `json:"app"`
+	Name        string           `json:"name"`
+	Publishers  int              `json:"publishers"`
+	Start       time.Time        `json:"start"`
+	Subscribers []SubscriberStat `json:"subscribers"`
+}
+
+// Stats gives the state of the streams and of their pull nodes
+func (sr *StreamRegistry) Stats() []StreamStat {
+	sr.lock.RLock()
+	defer sr.lock.RUnlock()
+
+	stats := []StreamStat{}
+	for _, ls := range sr.streams {
+		st := StreamStat{
+			App:         ls.app,
+			Name:        ls.name,
+			Publishers:  ls.publishers,
+			Start:       ls.start,
+			Subscribers: []SubscriberStat{},
+		}
+
+		head := ls.ring.Head()
+		ls.lock.Lock()
+		for cn, pi := range ls.pullnodemap {
+			var lag uint64
+			if next := atomic.LoadUint64(&pi.next); head > next {
+				lag = head - next
+			}
+			st.Subscribers = append(st.Subscribers, SubscriberStat{
+				Session: cn.id,
+				Client:  cn.addr,
+				Lag:     lag,
+				Dropped: atomic.LoadUint64(&pi.dropped),
+			})
+		}
+		ls.lock.Unlock()
+
+		stats = append(stats, st)
+	}
+
+	return stats
+}
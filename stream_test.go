@@ -0,0 +1,159 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testRegistry gives a registry and the events it sent
+func testRegistry(grace time.Duration) (*StreamRegistry, chan int) {
+	sr := NewStreamRegistry()
+	sr.SetGracePeriod(grace)
+	events := make(chan int, 16)
+	sr.OnEvent(func(event int, ls *LiveStream) {
+		events <- event
+	})
+	return sr, events
+}
+
+// checkEvents checks the events sent since the last call
+func checkEvents(t *testing.T, name string, events chan int, want ...int) {
+	t.Helper()
+	var got []int
+	for len(events) > 0 {
+		got = append(got, <-events)
+	}
+	if len(got) != len(want) {
+		t.Errorf("%s: got events %v, want %v", name, got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s: got events %v, want %v", name, got, want)
+			return
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	sr, events := testRegistry(0)
+
+	ls, ok := sr.Publish("live", "a")
+	if !ok || ls.app != "live" || ls.name != "a" || ls.publishers != 1 {
+		t.Fatalf("got %+v, %t", ls, ok)
+	}
+	checkEvents(t, "publish", events, STREAM_EVENT_CREATED)
+
+	if _, ok := sr.Publish("live", "a"); ok {
+		t.Error("published twice")
+	}
+	other, ok := sr.Publish("other", "a")
+	if !ok || other == ls {
+		t.Error("same name in another app not published")
+	}
+	checkEvents(t, "publish again", events, STREAM_EVENT_CREATED)
+
+	if found, ok := sr.Lookup("live", "a"); !ok || found != ls {
+		t.Error("stream not found")
+	}
+	if n := sr.Len(); n != 2 {
+		t.Errorf("%d streams", n)
+	}
+
+	sr.Unpublish(ls)
+	checkEvents(t, "unpublish", events, STREAM_EVENT_REMOVED)
+	if _, ok := sr.Lookup("live", "a"); ok {
+		t.Error("stream found once unpublished")
+	}
+	if !ls.ended {
+		t.Error("stream not ended")
+	}
+	if _, _, ok := sr.Subscribe("live", "a", NewClientNode(nil, 0)); ok {
+		t.Error("unpublished stream subscribed")
+	}
+
+	// published again, it's a new stream
+	again, ok := sr.Publish("live", "a")
+	if !ok || again == ls {
+		t.Error("stream not published again")
+	}
+	checkEvents(t, "publish after unpublish", events, STREAM_EVENT_CREATED)
+}
+
+func TestUnpublishEndsSubscribers(t *testing.T) {
+	sr, _ := testRegistry(0)
+	ls, _ := sr.Publish("live", "a")
+	cn := NewClientNode(nil, 0)
+	if _, _, ok := sr.Subscribe("live", "a", cn); !ok {
+		t.Fatal("not subscribed")
+	}
+	_, pi, _ := sr.Subscribe("live", "a", NewClientNode(nil, 0))
+	if ls.subscribers != 2 {
+		t.Errorf("%d subscribers", ls.subscribers)
+	}
+	sr.Unsubscribe(ls, cn)
+	if ls.subscribers != 1 || pullNodes(ls) != 1 {
+		t.Errorf("%d subscribers after unsubscribing", ls.subscribers)
+	}
+
+	sr.Unpublish(ls)
+	if ls.subscribers != 0 || pullNodes(ls) != 0 {
+		t.Errorf("%d subscribers once unpublished", ls.subscribers)
+	}
+	if _, status := pi.Next(nil); status != PULL_END {
+		t.Errorf("pull status %d once unpublished", status)
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	const grace = 50 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		republish bool
+	}{
+		{"publisher back in time", true},
+		{"grace period over", false},
+	}
+
+	for _, tt := range tests {
+		sr, events := testRegistry(grace)
+		ls, _ := sr.Publish("live", "a")
+		_, pi, _ := sr.Subscribe("live", "a", NewClientNode(nil, 0))
+		checkEvents(t, tt.name, events, STREAM_EVENT_CREATED)
+
+		sr.Unpublish(ls)
+		checkEvents(t, tt.name, events)
+		if found, ok := sr.Lookup("live", "a"); !ok || found != ls {
+			t.Errorf("%s: stream gone in its grace period", tt.name)
+		}
+		if _, _, ok := sr.Subscribe("live", "a", NewClientNode(nil, 0)); !ok {
+			t.Errorf("%s: stream in its grace period not subscribed", tt.name)
+		}
+
+		if tt.republish {
+			again, ok := sr.Publish("live", "a")
+			if !ok || again != ls {
+				t.Errorf("%s: stream not taken back", tt.name)
+			}
+		}
+
+		time.Sleep(2 * grace)
+		_, found := sr.Lookup("live", "a")
+		if tt.republish {
+			checkEvents(t, tt.name, events)
+			if !found || ls.ended {
+				t.Errorf("%s: stream ended", tt.name)
+			}
+			continue
+		}
+
+		checkEvents(t, tt.name, events, STREAM_EVENT_REMOVED)
+		if found || !ls.ended {
+			t.Errorf("%s: stream not ended", tt.name)
+		}
+		if _, status := pi.Next(nil); status != PULL_END {
+			t.Errorf("%s: pull status %d", tt.name, status)
+		}
+	}
+}
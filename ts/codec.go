@@ -0,0 +1,184 @@
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// AVCConfig is what the muxer needs from the AVCDecoderConfigurationRecord
+// sent as the AVC sequence header
+type AVCConfig struct {
+	lengthsize int
+	sps        [][]byte
+	pps        [][]byte
+}
+
+var ErrBadAVCConfig = errors.New("ts: bad AVCDecoderConfigurationRecord")
+
+func ParseAVCConfig(b []byte) (*AVCConfig, error) {
+	if len(b) < 6 {
+		return nil, ErrBadAVCConfig
+	}
+
+	c := new(AVCConfig)
+	c.lengthsize = int(b[4]&0x03) + 1
+
+	readSets := func(n int, p []byte) ([][]byte, []byte, error) {
+		var sets [][]byte
+		for i := 0; i < n; i++ {
+			if len(p) < 2 {
+				return nil, nil, ErrBadAVCConfig
+			}
+			l := int(binary.BigEndian.Uint16(p))
+			if len(p) < 2+l {
+				return nil, nil, ErrBadAVCConfig
+			}
+			sets = append(sets, p[2:2+l])
+			p = p[2+l:]
+		}
+		return sets, p, nil
+	}
+
+	var err error
+	rest := b[6:]
+	if c.sps, rest, err = readSets(int(b[5]&0x1f), rest); err != nil {
+		return nil, err
+	}
+	if len(rest) < 1 {
+		return nil, ErrBadAVCConfig
+	}
+	if c.pps, _, err = readSets(int(rest[0]), rest[1:]); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+var annexb_start_code = []byte{0x00, 0x00, 0x00, 0x01}
+
+// AnnexB turns the length prefixed NAL units of an AVC video tag into an
+// access unit with start codes, opened by an access unit delimiter. Key
+// frames get the SPS and the PPS in front.
+func (c *AVCConfig) AnnexB(nalus []byte, keyframe bool) []byte {
+	var out bytes.Buffer
+	out.Write(annexb_start_code)
+	out.Write([]byte{0x09, 0xf0})
+
+	if keyframe {
+		for _, sets := range [][][]byte{c.sps, c.pps} {
+			for _, ps := range sets {
+				out.Write(annexb_start_code)
+				out.Write(ps)
+			}
+		}
+	}
+
+	for len(nalus) > c.lengthsize {
+		var l int
+		for _, v := range nalus[:c.lengthsize] {
+			l = l<<8 | int(v)
+		}
+		nalus = nalus[c.lengthsize:]
+		if l == 0 || l > len(nalus) {
+			break
+		}
+
+		// the encoder's own delimiters are replaced
+		if nalus[0]&0x1f != 0x09 {
+			out.Write(annexb_start_code)
+			out.Write(nalus[:l])
+		}
+		nalus = nalus[l:]
+	}
+
+	return out.Bytes()
+}
+
+// AACConfig is what ADTS needs from an AudioSpecificConfig
+type AACConfig struct {
+	objecttype  byte // of the AAC core
+	samplerate  byte // index, of the AAC core
+	channelconf byte
+}
+
+// object types signalling SBR or PS on top of an AAC core
+const (
+	AAC_OBJECT_SBR = 5
+	AAC_OBJECT_PS  = 29
+)
+
+var ErrBadAACConfig = errors.New("ts: bad AudioSpecificConfig")
+
+// bitReader reads the fields of an AudioSpecificConfig
+type bitReader struct {
+	b   []byte
+	pos int // in bits
+	err bool
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.b)*8 {
+			r.err = true
+			return 0
+		}
+		v = v<<1 | uint32(r.b[r.pos/8]>>(7-uint(r.pos%8))&0x01)
+		r.pos++
+	}
+	return v
+}
+
+// objectType reads an audio object type and its escape
+func (r *bitReader) objectType() uint32 {
+	t := r.bits(5)
+	if t == 31 {
+		t = 32 + r.bits(6)
+	}
+	return t
+}
+
+func ParseAACConfig(b []byte) (*AACConfig, error) {
+	r := &bitReader{b: b}
+	objecttype := r.objectType()
+	index := r.bits(4)
+	if index == 15 {
+		r.bits(24) // explicit rate
+	}
+	channelconf := r.bits(4)
+
+	// with explicit SBR/PS signalling the rate read is the one of the core,
+	// then come the extension rate and the object type of the core
+	if objecttype == AAC_OBJECT_SBR || objecttype == AAC_OBJECT_PS {
+		if r.bits(4) == 15 {
+			r.bits(24)
+		}
+		objecttype = r.objectType()
+	}
+
+	// ADTS only has the object types 1 to 4 and the indexed rates
+	if r.err || objecttype == 0 || objecttype > 4 || index > 12 {
+		return nil, ErrBadAACConfig
+	}
+
+	c := new(AACConfig)
+	c.objecttype = byte(objecttype)
+	c.samplerate = byte(index)
+	c.channelconf = byte(channelconf)
+	return c, nil
+}
+
+// ADTS prefixes a raw AAC frame with its ADTS header
+func (c *AACConfig) ADTS(frame []byte) []byte {
+	l := 7 + len(frame)
+	out := make([]byte, 7, l)
+	out[0] = 0xff
+	out[1] = 0xf1 // mpeg-4, no crc
+	out[2] = (c.objecttype-1)<<6 | (c.samplerate&0x0f)<<2 | (c.channelconf>>2)&0x01
+	out[3] = (c.channelconf&0x03)<<6 | byte(l>>11)&0x03
+	out[4] = byte(l >> 3)
+	out[5] = byte(l&0x07)<<5 | 0x1f
+	out[6] = 0xfc
+	return append(out, frame...)
+}
@@ -0,0 +1,186 @@
+package ts
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// profile high, 4 bytes lengths, one SPS and one PPS
+var test_avcc = []byte{
+	0x01, 0x64, 0x00, 0x1f, 0xff,
+	0xe1, 0x00, 0x04, 0x67, 0x64, 0x00, 0x1f,
+	0x01, 0x00, 0x02, 0x68, 0xee,
+}
+
+func TestParseAVCConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		sps  [][]byte
+		pps  [][]byte
+		err  error
+	}{
+		{"one sps and pps", test_avcc, [][]byte{{0x67, 0x64, 0x00, 0x1f}}, [][]byte{{0x68, 0xee}}, nil},
+		{"no parameter set", []byte{0x01, 0x64, 0x00, 0x1f, 0xff, 0xe0, 0x00}, nil, nil, nil},
+		{"shorter than its header", test_avcc[:5], nil, nil, ErrBadAVCConfig},
+		{"sps length cut", test_avcc[:7], nil, nil, ErrBadAVCConfig},
+		{"sps cut", test_avcc[:10], nil, nil, ErrBadAVCConfig},
+		{"no pps count", test_avcc[:12], nil, nil, ErrBadAVCConfig},
+		{"pps cut", test_avcc[:16], nil, nil, ErrBadAVCConfig},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseAVCConfig(tt.b)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if c.lengthsize != 4 {
+			t.Errorf("%s: length size %d", tt.name, c.lengthsize)
+		}
+		if !reflect.DeepEqual(c.sps, tt.sps) || !reflect.DeepEqual(c.pps, tt.pps) {
+			t.Errorf("%s: got sps %x pps %x, want %x %x", tt.name, c.sps, c.pps, tt.sps, tt.pps)
+		}
+	}
+}
+
+func TestAnnexB(t *testing.T) {
+	c, err := ParseAVCConfig(test_avcc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aud := []byte{0, 0, 0, 1, 0x09, 0xf0}
+	params := []byte{0, 0, 0, 1, 0x67, 0x64, 0x00, 0x1f, 0, 0, 0, 1, 0x68, 0xee}
+	tests := []struct {
+		name     string
+		nalus    []byte
+		keyframe bool
+		want     []byte
+	}{
+		{"key frame", []byte{0, 0, 0, 2, 0x65, 0xaa}, true,
+			concat(aud, params, []byte{0, 0, 0, 1, 0x65, 0xaa})},
+		{"frame", []byte{0, 0, 0, 2, 0x41, 0xbb, 0, 0, 0, 1, 0x41}, false,
+			concat(aud, []byte{0, 0, 0, 1, 0x41, 0xbb, 0, 0, 0, 1, 0x41})},
+		{"encoder delimiter", []byte{0, 0, 0, 2, 0x09, 0x10, 0, 0, 0, 1, 0x41}, false,
+			concat(aud, []byte{0, 0, 0, 1, 0x41})},
+		{"length over the tag", []byte{0, 0, 0, 1, 0x41, 0, 0, 0, 9, 0x41}, false,
+			concat(aud, []byte{0, 0, 0, 1, 0x41})},
+		{"zero length", []byte{0, 0, 0, 0, 0x41}, false, aud},
+		{"empty", nil, false, aud},
+	}
+
+	for _, tt := range tests {
+		if got := c.AnnexB(tt.nalus, tt.keyframe); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func concat(bs ...[]byte) []byte {
+	return bytes.Join(bs, nil)
+}
+
+func TestParseAACConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		b          []byte
+		objecttype byte
+		samplerate byte
+		channels   byte
+		err        error
+	}{
+		{"lc 44.1kHz stereo", []byte{0x12, 0x10}, 2, 4, 2, nil},
+		{"main 44.1kHz stereo", []byte{0x0a, 0x10}, 1, 4, 2, nil},
+		{"lc 96kHz 5.1", []byte{0x10, 0x30}, 2, 0, 6, nil},
+		// the rates are of the 24kHz core, the extension rate is 48kHz
+		{"he mono", []byte{0x2b, 0x09, 0x88}, 2, 6, 1, nil},
+		{"he v2 mono", []byte{0xeb, 0x09, 0x88}, 2, 6, 1, nil},
+		{"he explicit extension rate", []byte{0x2b, 0x17, 0x80, 0x5d, 0xc0, 0x08}, 2, 6, 2, nil},
+		{"he without core", []byte{0x2b, 0x09}, 0, 0, 0, ErrBadAACConfig},
+		{"he escaped core", []byte{0x2b, 0x11, 0xfc, 0xa0}, 0, 0, 0, ErrBadAACConfig},
+		{"escaped object type", []byte{0xf9, 0x46, 0x40}, 0, 0, 0, ErrBadAACConfig},
+		{"ld object type", []byte{0xb9, 0x90}, 0, 0, 0, ErrBadAACConfig},
+		{"explicit sample rate", []byte{0x17, 0x80, 0x56, 0x22, 0x10}, 0, 0, 0, ErrBadAACConfig},
+		{"reserved sample rate", []byte{0x16, 0x90}, 0, 0, 0, ErrBadAACConfig},
+		{"no object type", []byte{0x02, 0x10}, 0, 0, 0, ErrBadAACConfig},
+		{"short", []byte{0x12}, 0, 0, 0, ErrBadAACConfig},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseAACConfig(tt.b)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if c.objecttype != tt.objecttype || c.samplerate != tt.samplerate || c.channelconf != tt.channels {
+			t.Errorf("%s: got %d/%d/%d, want %d/%d/%d", tt.name, c.objecttype,
+				c.samplerate, c.channelconf, tt.objecttype, tt.samplerate, tt.channels)
+		}
+	}
+}
+
+func TestADTS(t *testing.T) {
+	c, err := ParseAACConfig([]byte{0x12, 0x10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{0, 1, 100, 2000, 8184} {
+		frame := bytes.Repeat([]byte{0x5a}, n)
+		out := c.ADTS(frame)
+
+		if out[0] != 0xff || out[1]&0xf6 != 0xf0 || out[1]&0x01 == 0 {
+			t.Errorf("%d bytes: bad sync word or crc flag %x", n, out[:2])
+		}
+		if profile := out[2] >> 6; profile != 1 {
+			t.Errorf("%d bytes: profile %d", n, profile)
+		}
+		if index := out[2] >> 2 & 0x0f; index != 4 {
+			t.Errorf("%d bytes: sample rate index %d", n, index)
+		}
+		if channels := (out[2]&0x01)<<2 | out[3]>>6; channels != 2 {
+			t.Errorf("%d bytes: channels %d", n, channels)
+		}
+		l := int(out[3]&0x03)<<11 | int(out[4])<<3 | int(out[5]>>5)
+		if l != len(out) || l != 7+n {
+			t.Errorf("%d bytes: frame length %d of %d", n, l, len(out))
+		}
+		if !bytes.Equal(out[7:], frame) {
+			t.Errorf("%d bytes: frame changed", n)
+		}
+	}
+}
+
+func TestADTSProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		asc     []byte
+		profile byte
+		index   byte
+	}{
+		{"main", []byte{0x0a, 0x10}, 0, 4},
+		{"lc", []byte{0x12, 0x10}, 1, 4},
+		{"he", []byte{0x2b, 0x09, 0x88}, 1, 6},
+		{"he v2", []byte{0xeb, 0x09, 0x88}, 1, 6},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseAACConfig(tt.asc)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		out := c.ADTS([]byte{1, 2, 3})
+		if profile, index := out[2]>>6, out[2]>>2&0x0f; profile != tt.profile || index != tt.index {
+			t.Errorf("%s: got profile %d index %d, want %d %d", tt.name, profile, index, tt.profile, tt.index)
+		}
+	}
+}
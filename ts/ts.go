@@ -0,0 +1,254 @@
+// Package ts writes MPEG-TS: PAT/PMT, PES of H.264 and AAC access units
+// with PCR, adaptation field stuffing and continuity counters.
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	TS_PACKET_SIZE = 188
+	TS_PID_PAT     = 0x0000
+	TS_PID_PMT     = 0x1000
+	TS_PID_VIDEO   = 0x0100
+	TS_PID_AUDIO   = 0x0101
+
+	TS_STREAM_TYPE_AAC  = 0x0f
+	TS_STREAM_TYPE_H264 = 0x1b
+
+	TS_STREAM_ID_AUDIO = 0xc0
+	TS_STREAM_ID_VIDEO = 0xe0
+
+	// timestamps are 33 bits at 90kHz
+	TS_CLOCK_RATE = 90000
+	TS_TIME_MASK  = 1<<33 - 1
+)
+
+var crc32_mpeg2_table = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// CRC32 is the crc of the psi sections, a section followed by its crc
+// gives 0
+func CRC32(b []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, v := range b {
+		crc = crc<<8 ^ crc32_mpeg2_table[byte(crc>>24)^v]
+	}
+	return crc
+}
+
+// Muxer writes the H.264/AAC access units of a program as MPEG-TS packets.
+// The PCR goes with the video, or with the audio if there is no video.
+type Muxer struct {
+	w        io.Writer
+	cc       map[uint16]uint8 // continuity counters
+	hasvideo bool
+	hasaudio bool
+	version  uint8 // of the PMT, changes with the tracks
+}
+
+func NewMuxer(w io.Writer, hasvideo bool, hasaudio bool) *Muxer {
+	m := new(Muxer)
+	m.w = w
+	m.cc = make(map[uint16]uint8)
+	m.hasvideo = hasvideo
+	m.hasaudio = hasaudio
+	return m
+}
+
+// SetTracks changes the tracks of the program, it tells whether they
+// changed. The next tables announce them with a new PMT version.
+func (m *Muxer) SetTracks(hasvideo bool, hasaudio bool) bool {
+	if hasvideo == m.hasvideo && hasaudio == m.hasaudio {
+		return false
+	}
+	m.hasvideo = hasvideo
+	m.hasaudio = hasaudio
+	m.version = (m.version + 1) & 0x1f
+	return true
+}
+
+func (m *Muxer) pcrPID() uint16 {
+	if m.hasvideo {
+		return TS_PID_VIDEO
+	}
+	return TS_PID_AUDIO
+}
+
+// writePackets splits a payload in packets of a pid, the first one may
+// carry a pcr and a random access flag, the last one is stuffed with its
+// adaptation field
+func (m *Muxer) writePackets(pid uint16, payload []byte, withpcr bool,
+	pcr uint64, randomaccess bool) error {
+	var buf bytes.Buffer
+	first := true
+	for len(payload) > 0 {
+		var pkt [TS_PACKET_SIZE]byte
+		pkt[0] = 0x47
+		pkt[1] = byte(pid >> 8 & 0x1f)
+		if first {
+			pkt[1] |= 0x40 // payload unit start
+		}
+		pkt[2] = byte(pid)
+
+		var af []byte
+		if first && (withpcr || randomaccess) {
+			af = []byte{1, 0}
+			if randomaccess {
+				af[1] |= 0x40
+			}
+			if withpcr {
+				af[1] |= 0x10
+				af = append(af, byte(pcr>>25), byte(pcr>>17), byte(pcr>>9),
+					byte(pcr>>1), byte(pcr<<7)|0x7e, 0)
+			}
+			af[0] = byte(len(af) - 1)
+		}
+
+		room := TS_PACKET_SIZE - 4 - len(af)
+		if len(payload) < room {
+			stuffing := room - len(payload)
+			if af == nil {
+				// the length byte alone, then the flags and 0xff
+				af = []byte{0}
+				stuffing--
+				if stuffing > 0 {
+					af = append(af, 0)
+					stuffing--
+				}
+			}
+			af = append(af, bytes.Repeat([]byte{0xff}, stuffing)...)
+			af[0] = byte(len(af) - 1)
+		}
+
+		pkt[3] = 0x10 | m.cc[pid]
+		if af != nil {
+			pkt[3] |= 0x20
+		}
+		m.cc[pid] = (m.cc[pid] + 1) & 0x0f
+
+		n := copy(pkt[4:], af)
+		n += copy(pkt[4+n:], payload)
+		payload = payload[n-len(af):]
+		first = false
+
+		buf.Write(pkt[:])
+	}
+
+	_, err := m.w.Write(buf.Bytes())
+	return err
+}
+
+// writeSection writes a psi section with its pointer field and crc
+func (m *Muxer) writeSection(pid uint16, section []byte) error {
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], CRC32(section))
+
+	payload := append([]byte{0}, section...)
+	payload = append(payload, crc[:]...)
+	// sections are stuffed with 0xff rather than an adaptation field
+	payload = append(payload, bytes.Repeat([]byte{0xff}, TS_PACKET_SIZE-4-len(payload))...)
+	return m.writePackets(pid, payload, false, 0, false)
+}
+
+// WriteTables writes the PAT and the PMT, before the first PES and at each
+// point a player may start from
+func (m *Muxer) WriteTables() error {
+	pat := []byte{
+		0x00,     // table id
+		0xb0, 13, // section length
+		0x00, 0x01, // transport stream id
+		0xc1,       // version 0, current
+		0x00, 0x00, // section numbers
+		0x00, 0x01, // program 1
+		0xe0 | TS_PID_PMT>>8, TS_PID_PMT & 0xff,
+	}
+	if err := m.writeSection(TS_PID_PAT, pat); err != nil {
+		return err
+	}
+
+	var es []byte
+	if m.hasvideo {
+		es = append(es, TS_STREAM_TYPE_H264, 0xe0|TS_PID_VIDEO>>8, TS_PID_VIDEO&0xff, 0xf0, 0)
+	}
+	if m.hasaudio {
+		es = append(es, TS_STREAM_TYPE_AAC, 0xe0|TS_PID_AUDIO>>8, TS_PID_AUDIO&0xff, 0xf0, 0)
+	}
+
+	pcrpid := m.pcrPID()
+	seclen := 9 + len(es) + 4
+	pmt := []byte{
+		0x02, // table id
+		0xb0 | byte(seclen>>8), byte(seclen),
+		0x00, 0x01, // program 1
+		0xc1 | m.version<<1,
+		0x00, 0x00,
+		0xe0 | byte(pcrpid>>8), byte(pcrpid),
+		0xf0, 0x00, // no program info
+	}
+	pmt = append(pmt, es...)
+	return m.writeSection(TS_PID_PMT, pmt)
+}
+
+// putTimestamp writes a 33 bits pts or dts with its 4 bits prefix
+func putTimestamp(b []byte, prefix byte, ts uint64) {
+	b[0] = prefix<<4 | byte(ts>>29)&0x0e | 1
+	b[1] = byte(ts >> 22)
+	b[2] = byte(ts>>14) | 1
+	b[3] = byte(ts >> 7)
+	b[4] = byte(ts<<1) | 1
+}
+
+// WritePES writes an access unit as a PES, timestamps are in 90kHz
+func (m *Muxer) WritePES(pid uint16, streamid byte, pts uint64, dts uint64,
+	randomaccess bool, data []byte) error {
+	pts &= TS_TIME_MASK
+	dts &= TS_TIME_MASK
+
+	hdr := []byte{0x00, 0x00, 0x01, streamid, 0, 0, 0x80, 0x80, 5}
+	var ts [10]byte
+	if pts != dts {
+		hdr[7] = 0xc0
+		hdr[8] = 10
+		putTimestamp(ts[0:], 0x3, pts)
+		putTimestamp(ts[5:], 0x1, dts)
+		hdr = append(hdr, ts[:10]...)
+	} else {
+		putTimestamp(ts[0:], 0x2, pts)
+		hdr = append(hdr, ts[:5]...)
+	}
+
+	// unbounded for video
+	if pesl := len(hdr) - 6 + len(data); streamid != TS_STREAM_ID_VIDEO && pesl <= 0xffff {
+		binary.BigEndian.PutUint16(hdr[4:], uint16(pesl))
+	}
+
+	payload := append(hdr, data...)
+	return m.writePackets(pid, payload, pid == m.pcrPID(), dts, randomaccess)
+}
+
+// WriteVideo writes an H.264 access unit in Annex-B
+func (m *Muxer) WriteVideo(pts uint64, dts uint64, keyframe bool, au []byte) error {
+	return m.WritePES(TS_PID_VIDEO, TS_STREAM_ID_VIDEO, pts, dts, keyframe, au)
+}
+
+// WriteAudio writes ADTS AAC frames
+func (m *Muxer) WriteAudio(pts uint64, frames []byte) error {
+	// any audio frame starts again in an audio only program
+	return m.WritePES(TS_PID_AUDIO, TS_STREAM_ID_AUDIO, pts, pts, !m.hasvideo, frames)
+}
@@ -0,0 +1,353 @@
+package ts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type testPacket struct {
+	pid     uint16
+	start   bool // payload unit start
+	cc      uint8
+	af      []byte // adaptation field, without its length
+	payload []byte
+}
+
+// parsePackets splits b in ts packets and checks their structure
+func parsePackets(t *testing.T, b []byte) []testPacket {
+	t.Helper()
+	if len(b)%TS_PACKET_SIZE != 0 {
+		t.Fatalf("%d bytes is not a whole number of packets", len(b))
+	}
+
+	var pkts []testPacket
+	for ; len(b) > 0; b = b[TS_PACKET_SIZE:] {
+		pkt := b[:TS_PACKET_SIZE]
+		if pkt[0] != 0x47 {
+			t.Fatalf("packet %d: sync byte 0x%02x", len(pkts), pkt[0])
+		}
+
+		var p testPacket
+		p.pid = binary.BigEndian.Uint16(pkt[1:]) & 0x1fff
+		p.start = pkt[1]&0x40 != 0
+		p.cc = pkt[3] & 0x0f
+		if pkt[3]&0x10 == 0 {
+			t.Fatalf("packet %d: no payload", len(pkts))
+		}
+
+		rest := pkt[4:]
+		if pkt[3]&0x20 != 0 {
+			n := int(rest[0])
+			if n+1 > len(rest) {
+				t.Fatalf("packet %d: adaptation field of %d bytes", len(pkts), n)
+			}
+			p.af = rest[1 : 1+n]
+			rest = rest[1+n:]
+		}
+		p.payload = rest
+		pkts = append(pkts, p)
+	}
+	return pkts
+}
+
+// checkContinuity checks the counters of each pid follow each other from
+// the counters in cc, which it updates
+func checkContinuity(t *testing.T, pkts []testPacket, cc map[uint16]uint8) {
+	t.Helper()
+	for i, p := range pkts {
+		if last, ok := cc[p.pid]; ok && p.cc != (last+1)&0x0f {
+			t.Errorf("packet %d of pid 0x%x: counter %d after %d", i, p.pid, p.cc, last)
+		}
+		cc[p.pid] = p.cc
+	}
+}
+
+// section gives the psi section of the packets of a pid, checking its crc
+func section(t *testing.T, pkts []testPacket, pid uint16) []byte {
+	t.Helper()
+	for _, p := range pkts {
+		if p.pid != pid {
+			continue
+		}
+		if !p.start || p.payload[0] != 0 {
+			t.Fatalf("pid 0x%x: no section start", pid)
+		}
+		s := p.payload[1:]
+		l := int(binary.BigEndian.Uint16(s[1:]) & 0x0fff)
+		s = s[:3+l]
+		if CRC32(s) != 0 {
+			t.Errorf("pid 0x%x: bad crc", pid)
+		}
+		return s
+	}
+	t.Fatalf("no section on pid 0x%x", pid)
+	return nil
+}
+
+// readTimestamp reads a 33 bits pts or dts
+func readTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 |
+		uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+type testPES struct {
+	streamid byte
+	pts, dts uint64
+	data     []byte
+	pcr      bool
+	random   bool
+}
+
+// readPES reassembles the pes of a pid
+func readPES(t *testing.T, pkts []testPacket, pid uint16) []testPES {
+	t.Helper()
+	var pes []testPES
+	var cur []byte
+	var pcr, random bool
+	end := func() {
+		if cur == nil {
+			return
+		}
+		if !bytes.Equal(cur[:3], []byte{0, 0, 1}) {
+			t.Fatalf("pid 0x%x: no pes start code", pid)
+		}
+		p := testPES{streamid: cur[3], pcr: pcr, random: random}
+		p.pts = readTimestamp(cur[9:])
+		p.dts = p.pts
+		if cur[7]&0x40 != 0 {
+			p.dts = readTimestamp(cur[14:])
+		}
+		p.data = cur[9+int(cur[8]):]
+		if l := int(binary.BigEndian.Uint16(cur[4:])); l != 0 && l != len(cur)-6 {
+			t.Errorf("pid 0x%x: pes length %d of %d", pid, l, len(cur)-6)
+		}
+		pes = append(pes, p)
+	}
+
+	for _, p := range pkts {
+		if p.pid != pid {
+			continue
+		}
+		if p.start {
+			end()
+			cur = []byte{}
+			pcr, random = false, false
+			if len(p.af) > 0 {
+				pcr = p.af[0]&0x10 != 0
+				random = p.af[0]&0x40 != 0
+			}
+		}
+		cur = append(cur, p.payload...)
+	}
+	end()
+	return pes
+}
+
+func TestPAT(t *testing.T) {
+	var b bytes.Buffer
+	NewMuxer(&b, true, true).WriteTables()
+	pkts := parsePackets(t, b.Bytes())
+
+	pat := section(t, pkts, TS_PID_PAT)
+	if pat[0] != 0x00 {
+		t.Errorf("table id 0x%02x", pat[0])
+	}
+	if program := binary.BigEndian.Uint16(pat[8:]); program != 1 {
+		t.Errorf("program %d", program)
+	}
+	if pid := binary.BigEndian.Uint16(pat[10:]) & 0x1fff; pid != TS_PID_PMT {
+		t.Errorf("pmt pid 0x%x", pid)
+	}
+}
+
+func TestPMT(t *testing.T) {
+	type es struct {
+		streamtype byte
+		pid        uint16
+	}
+	video := es{TS_STREAM_TYPE_H264, TS_PID_VIDEO}
+	audio := es{TS_STREAM_TYPE_AAC, TS_PID_AUDIO}
+
+	tests := []struct {
+		name     string
+		hasvideo bool
+		hasaudio bool
+		pcrpid   uint16
+		streams  []es
+	}{
+		{"video and audio", true, true, TS_PID_VIDEO, []es{video, audio}},
+		{"video only", true, false, TS_PID_VIDEO, []es{video}},
+		{"audio only", false, true, TS_PID_AUDIO, []es{audio}},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+		NewMuxer(&b, tt.hasvideo, tt.hasaudio).WriteTables()
+		pmt := section(t, parsePackets(t, b.Bytes()), TS_PID_PMT)
+
+		if pmt[0] != 0x02 {
+			t.Errorf("%s: table id 0x%02x", tt.name, pmt[0])
+		}
+		if pid := binary.BigEndian.Uint16(pmt[8:]) & 0x1fff; pid != tt.pcrpid {
+			t.Errorf("%s: pcr pid 0x%x", tt.name, pid)
+		}
+
+		var streams []es
+		for s := pmt[12 : len(pmt)-4]; len(s) >= 5; s = s[5:] {
+			streams = append(streams, es{s[0], binary.BigEndian.Uint16(s[1:]) & 0x1fff})
+		}
+		if len(streams) != len(tt.streams) {
+			t.Errorf("%s: got streams %v, want %v", tt.name, streams, tt.streams)
+			continue
+		}
+		for i := range streams {
+			if streams[i] != tt.streams[i] {
+				t.Errorf("%s: got streams %v, want %v", tt.name, streams, tt.streams)
+				break
+			}
+		}
+	}
+}
+
+func TestSetTracks(t *testing.T) {
+	var b bytes.Buffer
+	m := NewMuxer(&b, false, true)
+	version := func() byte {
+		pmt := section(t, parsePackets(t, b.Bytes()), TS_PID_PMT)
+		b.Reset()
+		return pmt[5] >> 1 & 0x1f
+	}
+
+	m.WriteTables()
+	if v := version(); v != 0 {
+		t.Errorf("first version %d", v)
+	}
+
+	if m.SetTracks(false, true) {
+		t.Error("same tracks told as changed")
+	}
+	m.WriteTables()
+	if v := version(); v != 0 {
+		t.Errorf("version %d after the same tracks", v)
+	}
+
+	if !m.SetTracks(true, true) {
+		t.Error("new video track not told as changed")
+	}
+	m.WriteTables()
+	if v := version(); v != 1 {
+		t.Errorf("version %d after a new track", v)
+	}
+}
+
+func TestPESPayloadSizes(t *testing.T) {
+	// around the sizes that fill a packet exactly, with and without an
+	// adaptation field
+	for _, n := range []int{0, 1, 100, 156, 157, 158, 162, 163, 164, 165, 170,
+		171, 172, 173, 176, 182, 183, 184, 185, 340, 341, 342, 1000} {
+		var b bytes.Buffer
+		m := NewMuxer(&b, true, true)
+		au := bytes.Repeat([]byte{0xa5}, n)
+		frames := bytes.Repeat([]byte{0x5a}, n)
+		if err := m.WriteVideo(2000, 1000, false, au); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.WriteAudio(1500, frames); err != nil {
+			t.Fatal(err)
+		}
+
+		pkts := parsePackets(t, b.Bytes())
+		checkContinuity(t, pkts, make(map[uint16]uint8))
+
+		video := readPES(t, pkts, TS_PID_VIDEO)
+		if len(video) != 1 || !bytes.Equal(video[0].data, au) {
+			t.Errorf("%d bytes: video access unit changed", n)
+		}
+		audio := readPES(t, pkts, TS_PID_AUDIO)
+		if len(audio) != 1 || !bytes.Equal(audio[0].data, frames) {
+			t.Errorf("%d bytes: audio frames changed", n)
+		}
+	}
+}
+
+func TestPESHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		hasvideo bool
+		video    bool
+		pts, dts uint64
+		keyframe bool
+		streamid byte
+		pcr      bool
+		random   bool
+	}{
+		{"key frame", true, true, 3000, 3000, true, TS_STREAM_ID_VIDEO, true, true},
+		{"b frame", true, true, 9000, 6000, false, TS_STREAM_ID_VIDEO, true, false},
+		{"wrapped timestamp", true, true, TS_TIME_MASK + 10, TS_TIME_MASK + 5, false, TS_STREAM_ID_VIDEO, true, false},
+		{"audio with video", true, false, 4500, 4500, false, TS_STREAM_ID_AUDIO, false, false},
+		{"audio only", false, false, 4500, 4500, false, TS_STREAM_ID_AUDIO, true, true},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+		m := NewMuxer(&b, tt.hasvideo, true)
+		pid := uint16(TS_PID_AUDIO)
+		if tt.video {
+			pid = TS_PID_VIDEO
+			m.WriteVideo(tt.pts, tt.dts, tt.keyframe, []byte{1, 2, 3})
+		} else {
+			m.WriteAudio(tt.pts, []byte{1, 2, 3})
+		}
+
+		pes := readPES(t, parsePackets(t, b.Bytes()), pid)
+		if len(pes) != 1 {
+			t.Errorf("%s: %d pes", tt.name, len(pes))
+			continue
+		}
+		p := pes[0]
+		if p.streamid != tt.streamid {
+			t.Errorf("%s: stream id 0x%02x", tt.name, p.streamid)
+		}
+		if p.pts != tt.pts&TS_TIME_MASK || p.dts != tt.dts&TS_TIME_MASK {
+			t.Errorf("%s: got pts %d dts %d", tt.name, p.pts, p.dts)
+		}
+		if p.pcr != tt.pcr || p.random != tt.random {
+			t.Errorf("%s: got pcr %t random access %t", tt.name, p.pcr, p.random)
+		}
+	}
+}
+
+func TestContinuityAcrossSegments(t *testing.T) {
+	// one muxer writes the segments one after the other
+	var b bytes.Buffer
+	m := NewMuxer(&b, true, true)
+	cc := make(map[uint16]uint8)
+	for seg := 0; seg < 3; seg++ {
+		m.WriteTables()
+		for i := 0; i < 10; i++ {
+			dts := uint64(seg*10+i) * 3000
+			m.WriteVideo(dts, dts, i == 0, bytes.Repeat([]byte{0xa5}, 500))
+			m.WriteAudio(dts, bytes.Repeat([]byte{0x5a}, 50))
+		}
+
+		checkContinuity(t, parsePackets(t, b.Bytes()), cc)
+		b.Reset()
+	}
+}
+
+func TestCRC32(t *testing.T) {
+	tests := []struct {
+		b   []byte
+		crc uint32
+	}{
+		{nil, 0xffffffff},
+		{[]byte("123456789"), 0x0376e6e7},
+	}
+
+	for _, tt := range tests {
+		if crc := CRC32(tt.b); crc != tt.crc {
+			t.Errorf("%q: got 0x%08x, want 0x%08x", tt.b, crc, tt.crc)
+		}
+	}
+}